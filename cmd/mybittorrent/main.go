@@ -1,18 +1,29 @@
 package main
 
 import (
+	"context"
 	"flag"
 	"fmt"
 	"log/slog"
 	"os"
+	"os/signal"
+	"path/filepath"
 	"strconv"
+	"strings"
+	"syscall"
 
 	"github.com/codecrafters-io/bittorrent-starter-go/internal/commands"
+	"github.com/codecrafters-io/bittorrent-starter-go/internal/torrentlib"
+	"github.com/codecrafters-io/bittorrent-starter-go/internal/torrentlib/dhtlib"
 )
 
 // global variables, set during init(), used in main()
 var debugLevel DebugType
 var totalConnections int
+var dhtEnabled bool
+var dhtPort int
+var dhtBootstrap string
+var dhtState string
 
 func main() {
 	args := flag.Args()
@@ -51,6 +62,39 @@ func main() {
 			return
 		}
 
+	case "scrape":
+		err := commands.Scrape(args[1:])
+		if err != nil {
+			fmt.Println(err)
+			return
+		}
+
+	case "magnet_parse":
+		err := commands.MagnetParse(file)
+		if err != nil {
+			fmt.Println(err)
+			return
+		}
+
+	case "magnet_info":
+		ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+		defer stop()
+
+		dht, err := startDHT(ctx)
+		if err != nil {
+			fmt.Println(err)
+			return
+		}
+		if dht != nil {
+			defer dht.Close()
+		}
+
+		err = commands.MagnetInfo(ctx, file, totalConnections, dht)
+		if err != nil {
+			fmt.Println(err)
+			return
+		}
+
 	case "handshake":
 		connection := args[2]
 		slog.Info("connection to be used", "connection", connection)
@@ -91,6 +135,9 @@ func main() {
 	case "download":
 		commandFlags := flag.NewFlagSet(command, flag.ExitOnError)
 		output := commandFlags.String("o", "", "Output file")
+		seed := commandFlags.Bool("seed", false, "Keep uploading after the download completes, until interrupted")
+		port := commandFlags.Int("port", torrentlib.DefaultPort, "Port where other peers can connect")
+		uploadSlots := commandFlags.Int("upload-slots", torrentlib.DefaultUploadSlots, "Amount of peers to upload to at once, besides the optimistic unchoke")
 		err := commandFlags.Parse(args[1:])
 		if err != nil {
 			fmt.Println(err)
@@ -106,8 +153,29 @@ func main() {
 			return
 		}
 
+		// on Ctrl-C the download is cancelled, so trackers get the stopped
+		// event
+		ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+		defer stop()
+
+		dht, err := startDHT(ctx)
+		if err != nil {
+			fmt.Println(err)
+			return
+		}
+		if dht != nil {
+			defer dht.Close()
+		}
+
 		file := commandArgs[0]
-		err = commands.Download(file, *output, totalConnections)
+		opts := torrentlib.DownloadOptions{
+			MaxConnections: totalConnections,
+			Seed:           *seed,
+			Port:           *port,
+			UploadSlots:    *uploadSlots,
+			DHT:            dht,
+		}
+		err = commands.Download(ctx, file, *output, opts)
 		if err != nil {
 			fmt.Println(err)
 			return
@@ -115,12 +183,38 @@ func main() {
 	}
 }
 
+// startDHT starts the DHT node when enabled with -dht, nil otherwise
+func startDHT(ctx context.Context) (*dhtlib.DHT, error) {
+	if !dhtEnabled {
+		return nil, nil
+	}
+	opts := dhtlib.Options{Port: dhtPort, StateFile: dhtState}
+	if dhtBootstrap != "" {
+		opts.Bootstrap = strings.Split(dhtBootstrap, ",")
+	}
+	return commands.StartDHT(ctx, opts)
+}
+
+// defaultDHTState is in the cache directory of the user, empty (nothing is
+// kept) when there is none
+func defaultDHTState() string {
+	dir, err := os.UserCacheDir()
+	if err != nil {
+		return ""
+	}
+	return filepath.Join(dir, "go-torrent", "dht.state")
+}
+
 // LOGGING
 
 func init() {
 	// get log level from flags
 	flag.Var(&debugLevel, "debug", "Debug level (info, debug, warning)")
 	flag.IntVar(&totalConnections, "c", 3, "Total amount of concurrent peer connections to download a file")
+	flag.BoolVar(&dhtEnabled, "dht", false, "Find peers with the DHT too, needed by torrents without trackers")
+	flag.IntVar(&dhtPort, "dht-port", torrentlib.DefaultPort, "UDP port of the DHT node")
+	flag.StringVar(&dhtBootstrap, "dht-bootstrap", strings.Join(dhtlib.DefaultBootstrap, ","), "Comma separated nodes to join the DHT from")
+	flag.StringVar(&dhtState, "dht-state", defaultDHTState(), "File where the DHT routing table is kept between runs")
 	flag.Parse()
 
 	// configure logger
@@ -1,6 +1,7 @@
 package commands
 
 import (
+	"context"
 	"encoding/hex"
 	"encoding/json"
 	"fmt"
@@ -9,6 +10,7 @@ import (
 
 	"github.com/codecrafters-io/bittorrent-starter-go/internal/encoding/bencode"
 	"github.com/codecrafters-io/bittorrent-starter-go/internal/torrentlib"
+	"github.com/codecrafters-io/bittorrent-starter-go/internal/torrentlib/dhtlib"
 	"github.com/codecrafters-io/bittorrent-starter-go/internal/torrentlib/peerlib"
 )
 
@@ -26,76 +28,151 @@ func Decode(bencodedValue []byte) error {
 
 func Info(file string) error {
 	slog.Info("calling Info command")
-	data, err := os.ReadFile(file)
+	torrent, err := torrentlib.Open(file)
 	if err != nil {
-		return fmt.Errorf("error during file %q reading: %v", file, err)
-	}
-
-	// unmarshal torrent into MetaData
-	slog.Debug(fmt.Sprintf("starting unmarshalling of: %s", string(data)))
-	var metaData torrentlib.MetaData
-	if err = bencode.Unmarshal(data, &metaData); err != nil {
 		return err
 	}
 
-	torrent, err := torrentlib.New(metaData)
-	if err != nil {
-		return err
-	}
+	printInfo(torrent)
+	return nil
+}
 
-	// print report
+func printInfo(torrent *torrentlib.Torrent) {
 	fmt.Printf("Tracker URL: %s\n", torrent.TrackerUrl)
 	fmt.Printf("Length: %d\n", torrent.Length)
 	fmt.Printf("Info Hash: %x\n", torrent.InfoHash)
 	fmt.Printf("Piece Length: %d\n", torrent.PieceLength)
+	if torrent.MultiFile {
+		fmt.Printf("Name: %s\n", torrent.Name)
+		fmt.Println("Files:")
+		for _, file := range torrent.Files {
+			fmt.Printf("%d %s\n", file.Length, file.Path)
+		}
+	}
 	fmt.Println("Piece Hashes:")
 	for _, pieceHash := range torrent.PiecesHash {
 		fmt.Println(hex.EncodeToString(pieceHash))
 	}
+}
+
+func MagnetParse(link string) error {
+	slog.Info("calling MagnetParse command")
+	magnet, err := torrentlib.ParseMagnet(link)
+	if err != nil {
+		return err
+	}
+
+	tracker := ""
+	if len(magnet.Trackers) > 0 {
+		tracker = magnet.Trackers[0]
+	}
+	fmt.Printf("Tracker URL: %s\n", tracker)
+	fmt.Printf("Info Hash: %x\n", magnet.InfoHash)
+	if magnet.Name != "" {
+		fmt.Printf("Name: %s\n", magnet.Name)
+	}
+	for _, peer := range magnet.Peers {
+		fmt.Printf("Peer: %s\n", peer)
+	}
+	for _, webSeed := range magnet.WebSeeds {
+		fmt.Printf("Web Seed: %s\n", webSeed)
+	}
 	return nil
 }
 
-func Peers(file string) error {
-	slog.Info("calling Peers command")
-	data, err := os.ReadFile(file)
+// link: magnet link, the info dictionary is downloaded from its peers
+// dht: finds more peers, nil to use only the ones of the link and trackers
+func MagnetInfo(ctx context.Context, link string, maxConnections int, dht *dhtlib.DHT) error {
+	slog.Info("calling MagnetInfo command")
+	torrent, err := openTorrent(ctx, link, maxConnections, dht)
+	if err != nil {
+		return err
+	}
+
+	printInfo(torrent)
+	return nil
+}
+
+// openTorrent opens a .torrent file, or fetches the torrent of a magnet link
+func openTorrent(ctx context.Context, fileOrLink string, maxConnections int, dht *dhtlib.DHT) (*torrentlib.Torrent, error) {
+	if !torrentlib.IsMagnet(fileOrLink) {
+		return torrentlib.Open(fileOrLink)
+	}
+
+	magnet, err := torrentlib.ParseMagnet(fileOrLink)
+	if err != nil {
+		return nil, err
+	}
+	return magnet.FetchTorrent(ctx, maxConnections, dht)
+}
+
+// StartDHT starts a DHT node and joins the DHT in the background, the node
+// must be closed so its routing table is saved
+func StartDHT(ctx context.Context, opts dhtlib.Options) (*dhtlib.DHT, error) {
+	slog.Info("starting dht node", "port", opts.Port, "stateFile", opts.StateFile)
+	dht, err := dhtlib.Listen(opts)
 	if err != nil {
-		return fmt.Errorf("error during file %q reading: %v", file, err)
+		return nil, err
 	}
 
-	// unmarshal torrent into MetaData
-	slog.Debug(fmt.Sprintf("starting unmarshalling of: %s", string(data)))
-	var metaData torrentlib.MetaData
-	if err = bencode.Unmarshal(data, &metaData); err != nil {
-		return fmt.Errorf("error during torrent unmarshaling: %v", err)
+	go func() {
+		if err := dht.Bootstrap(ctx); err != nil {
+			slog.Warn("could not join the dht", "error", err)
+		}
+	}()
+	return dht, nil
+}
+
+func Peers(file string) error {
+	slog.Info("calling Peers command")
+	torrent, err := torrentlib.Open(file)
+	if err != nil {
+		return err
 	}
 
-	torrent, err := torrentlib.New(metaData)
+	peers, err := torrent.Announce()
 	if err != nil {
 		return err
 	}
 
-	for _, peer := range torrent.Peers {
+	for _, peer := range peers {
 		fmt.Println(peer)
 	}
 
 	return nil
 }
 
-func Handshake(file, connection string) error {
-	slog.Info("doing a Handshake!")
-	data, err := os.ReadFile(file)
-	if err != nil {
-		return fmt.Errorf("error during file %q reading: %v", file, err)
+// files: names of .torrent files, torrents that share a tracker are scraped
+// with a single request
+func Scrape(files []string) error {
+	slog.Info("calling Scrape command", "torrents", len(files))
+	torrents := make([]*torrentlib.Torrent, len(files))
+	for i, file := range files {
+		torrent, err := torrentlib.Open(file)
+		if err != nil {
+			return err
+		}
+		torrents[i] = torrent
 	}
 
-	// unmarshal torrent into MetaData
-	slog.Debug(fmt.Sprintf("starting unmarshalling of: %s", string(data)))
-	var metaData torrentlib.MetaData
-	if err = bencode.Unmarshal(data, &metaData); err != nil {
-		return fmt.Errorf("error during torrent unmarshaling: %v", err)
+	stats := torrentlib.Scrape(torrents)
+
+	for _, torrent := range torrents {
+		torrentStats, ok := stats[[20]byte(torrent.InfoHash)]
+		if !ok {
+			fmt.Printf("%x %s: no tracker knows this torrent\n", torrent.InfoHash, torrent.Name)
+			continue
+		}
+		fmt.Printf("%x %s: seeders: %d, leechers: %d, completed: %d\n",
+			torrent.InfoHash, torrent.Name, torrentStats.Seeders, torrentStats.Leechers, torrentStats.Completed)
 	}
 
-	torrent, err := torrentlib.New(metaData)
+	return nil
+}
+
+func Handshake(file, connection string) error {
+	slog.Info("doing a Handshake!")
+	torrent, err := torrentlib.Open(file)
 	if err != nil {
 		return err
 	}
@@ -119,20 +196,12 @@ func Handshake(file, connection string) error {
 // urlPieceOutput: where to store the piece downloaded
 func DownloadPiece(file, urlPieceOutput string, pieceNumber int) error {
 	slog.Info("downloading a piece", "output", urlPieceOutput)
-	data, err := os.ReadFile(file)
+	torrent, err := torrentlib.Open(file)
 	if err != nil {
-		return fmt.Errorf("error during file %q reading: %v", file, err)
-	}
-
-	// unmarshal torrent into MetaData
-	slog.Debug(fmt.Sprintf("starting unmarshalling of: %s", string(data)))
-	var metaData torrentlib.MetaData
-	if err = bencode.Unmarshal(data, &metaData); err != nil {
-		return fmt.Errorf("error during torrent unmarshaling: %v", err)
+		return err
 	}
 
-	torrent, err := torrentlib.New(metaData)
-	if err != nil {
+	if _, err = torrent.Announce(); err != nil {
 		return err
 	}
 
@@ -150,34 +219,20 @@ func DownloadPiece(file, urlPieceOutput string, pieceNumber int) error {
 	return nil
 }
 
-// file: name of .torrent file
+// file: name of .torrent file or magnet link
 // urlPieceOutput: where to store the piece downloaded
-func Download(file, urlFileOutput string, desiredConnections int) error {
-	slog.Info("downloading a piece", "output", urlFileOutput, "desiredConnections", desiredConnections)
-	data, err := os.ReadFile(file)
-	if err != nil {
-		return fmt.Errorf("error during file %q reading: %v", file, err)
-	}
-
-	// unmarshal torrent into MetaData
-	slog.Debug(fmt.Sprintf("starting unmarshalling of: %s", string(data)))
-	var metaData torrentlib.MetaData
-	if err = bencode.Unmarshal(data, &metaData); err != nil {
-		return fmt.Errorf("error during torrent unmarshaling: %v", err)
-	}
-
-	torrent, err := torrentlib.New(metaData)
+func Download(ctx context.Context, file, urlFileOutput string, opts torrentlib.DownloadOptions) error {
+	slog.Info("downloading a piece", "output", urlFileOutput, "desiredConnections", opts.MaxConnections, "seed", opts.Seed, "port", opts.Port)
+	torrent, err := openTorrent(ctx, file, opts.MaxConnections, opts.DHT)
 	if err != nil {
 		return err
 	}
+	// the peers that sent the metadata may be the only ones (x.pe without
+	// trackers)
+	opts.Peers = append(opts.Peers, torrent.Peers...)
 
 	slog.Debug("Starting to download file. Rembember that both piece id and block id are 0 indexed")
-	downloadedFile, err := torrent.Download(desiredConnections)
-	if err != nil {
-		return err
-	}
-
-	if err = os.WriteFile(urlFileOutput, downloadedFile, 0644); err != nil {
+	if err = torrent.Download(ctx, urlFileOutput, opts); err != nil {
 		return err
 	}
 
@@ -3,6 +3,7 @@ package bencode
 import (
 	"bytes"
 	"fmt"
+	"io"
 	"log/slog"
 	"strconv"
 )
@@ -60,12 +61,16 @@ func readString(reader *bytes.Reader) (string, error) {
 
 	slog.Debug("reading string length", "length", length)
 
+	// the length comes from the input, it must not be trusted to allocate
+	if length < 0 || length > reader.Len() {
+		return "", fmt.Errorf("error invalid string length %d, %d bytes left", length, reader.Len())
+	}
 	if length == 0 {
 		return "", nil
 	}
 
 	strBytes := make([]byte, length)
-	_, err = reader.Read(strBytes)
+	_, err = io.ReadFull(reader, strBytes)
 	if err != nil {
 		return "", err
 	}
@@ -5,7 +5,9 @@ import (
 	"fmt"
 	"log/slog"
 	"reflect"
+	"sort"
 	"strconv"
+	"strings"
 )
 
 // Supports <Int, String, List, Dict> bencode formats
@@ -20,6 +22,12 @@ func Encode(element interface{}) ([]byte, error) {
 }
 
 func encodeValue(buf *bytes.Buffer, v reflect.Value) error {
+	if v.Type() == rawMessageType {
+		slog.Debug("found raw message", "length", v.Len())
+		buf.Write(v.Bytes())
+		return nil
+	}
+
 	switch v.Kind() {
 	case reflect.Int:
 		num := strconv.FormatInt(v.Int(), 10)
@@ -53,9 +61,10 @@ func encodeValue(buf *bytes.Buffer, v reflect.Value) error {
 
 		for i := 0; i < t.NumField(); i++ {
 			field := t.Field(i)
-			tag := field.Tag.Get("bencode")
-			if tag == "" {
-				tag = field.Name
+			tag, omitEmpty := parseTag(field)
+			if omitEmpty && isEmptyValue(v.Field(i)) {
+				slog.Debug("omitting empty field", "field", field.Name)
+				continue
 			}
 			slog.Debug("encoding field", "field", field.Name, "string", tag, "length", len(tag))
 
@@ -74,23 +83,38 @@ func encodeValue(buf *bytes.Buffer, v reflect.Value) error {
 
 	case reflect.Map:
 		slog.Debug("found map")
+		if v.Type().Key().Kind() != reflect.String {
+			return fmt.Errorf("error map keys must be strings, got %v", v.Type().Key().Kind())
+		}
+
+		// bencode dictionaries keys must be sorted, and the iteration order of
+		// a map is random
+		keys := v.MapKeys()
+		sort.Slice(keys, func(i, j int) bool {
+			return keys[i].String() < keys[j].String()
+		})
+
 		buf.WriteString("d")
-		iter := v.MapRange()
-		for iter.Next() {
+		for _, key := range keys {
 			// encode key
-			err := encodeValue(buf, iter.Key())
+			err := encodeValue(buf, key)
 			if err != nil {
 				return err
 			}
 
 			// encode field value
-			err = encodeValue(buf, iter.Value())
+			err = encodeValue(buf, v.MapIndex(key))
 			if err != nil {
 				return err
 			}
 		}
 		buf.WriteString("e")
 
+	case reflect.Interface, reflect.Pointer:
+		if v.IsNil() {
+			return fmt.Errorf("error cannot encode nil %v", v.Kind())
+		}
+		return encodeValue(buf, v.Elem())
 
 	default:
 		slog.Error("tried to encode unsupported type", "type", v.Kind())
@@ -98,3 +122,23 @@ func encodeValue(buf *bytes.Buffer, v reflect.Value) error {
 	}
 	return nil
 }
+
+// parseTag returns the bencode key of a struct field and whether it has the
+// omitempty option, e.g. `bencode:"files,omitempty"`
+func parseTag(field reflect.StructField) (string, bool) {
+	tag := field.Tag.Get("bencode")
+	name, options, _ := strings.Cut(tag, ",")
+	if name == "" {
+		name = field.Name
+	}
+	return name, options == "omitempty"
+}
+
+func isEmptyValue(v reflect.Value) bool {
+	switch v.Kind() {
+	case reflect.Slice, reflect.Map, reflect.String:
+		return v.Len() == 0
+	default:
+		return v.IsZero()
+	}
+}
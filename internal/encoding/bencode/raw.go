@@ -0,0 +1,13 @@
+package bencode
+
+import "reflect"
+
+// RawMessage is a raw encoded bencode value. When unmarshaling, it holds the
+// exact bytes of the value as they appear in the input, when encoding, those
+// bytes are written verbatim.
+//
+// It is useful to get the bytes of a sub-value without losing any key that is
+// not modeled, e.g. to hash the info dictionary of a torrent.
+type RawMessage []byte
+
+var rawMessageType = reflect.TypeOf(RawMessage(nil))
@@ -17,18 +17,21 @@ func Unmarshal(data []byte, v interface{}) error {
 		return fmt.Errorf("error expected a pointer but got %s", val.Kind())
 	}
 
-	elem := val.Elem()
+	if val.IsNil() {
+		return fmt.Errorf("error expected a non nil pointer")
+	}
 
+	elem := val.Elem()
 	slog.Debug("unmarshaling", "element kind", elem.Kind())
-	// check if pointer points to a struct
-	if elem.Kind() != reflect.Struct {
-		return fmt.Errorf("error expected a pointer to a struct but got pointer to %s", elem.Kind())
-	}
 
 	return unmarshalValue(reader, elem)
 }
 
 func unmarshalValue(reader *bytes.Reader, v reflect.Value) error {
+	if v.Type() == rawMessageType {
+		return unmarshalRaw(reader, v)
+	}
+
 	b, err := reader.ReadByte()
 	if err != nil {
 		return err
@@ -41,6 +44,9 @@ func unmarshalValue(reader *bytes.Reader, v reflect.Value) error {
 		if err != nil {
 			return err
 		}
+		if v.Kind() != reflect.String {
+			return fmt.Errorf("cannot unmarshal string into %s", v.Type())
+		}
 		v.SetString(str)
 
 	case 'i':
@@ -49,10 +55,16 @@ func unmarshalValue(reader *bytes.Reader, v reflect.Value) error {
 		if err != nil {
 			return err
 		}
+		if !v.CanInt() {
+			return fmt.Errorf("cannot unmarshal integer into %s", v.Type())
+		}
 		v.SetInt(int64(num))
 
 	case 'l':
 		slog.Debug("unmarhalling list into slice")
+		if v.Kind() != reflect.Slice {
+			return fmt.Errorf("cannot unmarshal list into %s", v.Type())
+		}
 		// list
 		v.Set(reflect.MakeSlice(v.Type(), 0, 0)) // initialize empty array
 		for {
@@ -108,10 +120,7 @@ func unmarshalValue(reader *bytes.Reader, v reflect.Value) error {
 				found := false
 				for i := 0; i < t.NumField(); i++ {
 					field = t.Field(i)
-					tag := field.Tag.Get("bencode")
-					if tag == "" {
-						tag = field.Name
-					}
+					tag, _ := parseTag(field)
 					if tag == key.String() {
 						found = true
 						break
@@ -141,6 +150,31 @@ func unmarshalValue(reader *bytes.Reader, v reflect.Value) error {
 				// Set the field value
 				fieldVal.Set(val)
 			}
+		} else if v.Kind() == reflect.Map && v.Type().Key().Kind() == reflect.String {
+			v.Set(reflect.MakeMap(v.Type()))
+			for {
+				// Peek the next byte
+				peekByte, err := reader.ReadByte()
+				if err != nil {
+					return err
+				}
+				if peekByte == 'e' {
+					break // End of dict
+				}
+
+				// readString already goes back one byte
+				key, err := readString(reader)
+				if err != nil {
+					return err
+				}
+				slog.Debug("found key", "key", key)
+
+				val := reflect.New(v.Type().Elem()).Elem()
+				if err = unmarshalValue(reader, val); err != nil {
+					return err
+				}
+				v.SetMapIndex(reflect.ValueOf(key).Convert(v.Type().Key()), val)
+			}
 		} else {
 			return fmt.Errorf("expected a map or struct, but got %s", v.Kind())
 		}
@@ -151,6 +185,24 @@ func unmarshalValue(reader *bytes.Reader, v reflect.Value) error {
 	return nil
 }
 
+// unmarshalRaw stores the exact bytes of the next value into v
+func unmarshalRaw(reader *bytes.Reader, v reflect.Value) error {
+	start := reader.Size() - int64(reader.Len())
+	if err := skipValue(reader); err != nil {
+		return err
+	}
+	end := reader.Size() - int64(reader.Len())
+
+	raw := make([]byte, end-start)
+	if _, err := reader.ReadAt(raw, start); err != nil {
+		return err
+	}
+	slog.Debug("unmarshalled raw value", "start", start, "end", end)
+
+	v.SetBytes(raw)
+	return nil
+}
+
 func readUntil(reader *bytes.Reader, delimiter byte) (string, error) {
 	var result bytes.Buffer
 	for {
@@ -214,7 +266,9 @@ func skipDictionary(reader *bytes.Reader) error {
 		if nextByte == 'e' { // End of dictionary
 			break
 		}
-		reader.UnreadByte() // Go back to read the next key-value pair
+
+		// readString already goes back one byte to get the full length, same as
+		// in decodeDictionary
 
 		// Skip the key (assuming the key is always a string)
 		_, err = readString(reader)
@@ -0,0 +1,139 @@
+package torrentlib
+
+import (
+	"crypto/sha1"
+	"log/slog"
+	"net"
+
+	"github.com/codecrafters-io/bittorrent-starter-go/internal/torrentlib/peerlib"
+)
+
+// Peers earn trust with pieces that pass the hash check and lose more with the
+// pieces they are known to have sent bad data for, so only peers that do it
+// repeatedly are banned.
+const (
+	GoodPieceTrust = 1
+	BadPieceTrust  = -2
+	MaxTrust       = 8
+	// BanTrust bans a peer once its trust drops to it
+	BanTrust = -7
+)
+
+// sentBlock is a block of a piece that failed the hash check, kept until the
+// piece passes to find out who sent bad data
+type sentBlock struct {
+	block int
+	ip    string
+	hash  [20]byte
+}
+
+// peerIP returns the IP of a peer address, peers are banned by IP so they
+// can't come back from another port
+func peerIP(addr string) string {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return addr
+	}
+	return host
+}
+
+// isBanned returns true if the address of a peer was banned
+func (s *session) isBanned(addr string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.banned[peerIP(addr)]
+}
+
+// pieceFailed is called when a piece does not match its hash. A peer that sent
+// the whole piece loses trust, and is banned once it drops to BanTrust. When
+// several peers sent the piece we don't know which one sent bad data yet, their
+// blocks are remembered until the piece passes, see piecePassed. It returns
+// true when several peers sent the piece.
+func (s *session) pieceFailed(piece *pieceDownload) bool {
+	contributors := make(map[string]bool)
+	for _, sender := range piece.senders {
+		contributors[peerIP(sender.Peer)] = true
+	}
+	shared := len(contributors) > 1
+
+	var ban []string
+	s.mu.Lock()
+	if shared {
+		for block, sender := range piece.senders {
+			s.suspects[piece.work.id] = append(s.suspects[piece.work.id], sentBlock{
+				block: block,
+				ip:    peerIP(sender.Peer),
+				hash:  sha1.Sum(piece.blockData(block)),
+			})
+		}
+	} else {
+		for ip := range contributors {
+			s.trust[ip] += BadPieceTrust
+			if s.trust[ip] <= BanTrust {
+				ban = append(ban, ip)
+			}
+		}
+	}
+	s.mu.Unlock()
+
+	for _, ip := range ban {
+		s.ban(ip, "pieceID", piece.work.id)
+	}
+	return shared
+}
+
+// piecePassed rewards the peers that sent blocks of a verified piece. Blocks
+// received in failed attempts shared by several peers are compared with the
+// good ones, the peers that sent a different block lose trust, and are banned
+// once it drops to BanTrust.
+func (s *session) piecePassed(piece *pieceDownload) {
+	s.mu.Lock()
+	for _, sender := range piece.senders {
+		ip := peerIP(sender.Peer)
+		s.trust[ip] = min(s.trust[ip]+GoodPieceTrust, MaxTrust)
+	}
+
+	bad := make(map[string]bool)
+	for _, sent := range s.suspects[piece.work.id] {
+		if sent.hash != sha1.Sum(piece.blockData(sent.block)) {
+			bad[sent.ip] = true
+		}
+	}
+	delete(s.suspects, piece.work.id)
+	var ban []string
+	for ip := range bad {
+		s.trust[ip] += BadPieceTrust
+		if s.trust[ip] <= BanTrust {
+			ban = append(ban, ip)
+		}
+	}
+	s.mu.Unlock()
+
+	for _, ip := range ban {
+		s.ban(ip, "pieceID", piece.work.id, "sentBadBlock", true)
+	}
+}
+
+// ban disconnects every peer with the IP and keeps it from connecting again
+// during the session
+func (s *session) ban(ip string, args ...any) {
+	s.mu.Lock()
+	if s.banned[ip] {
+		s.mu.Unlock()
+		return
+	}
+	s.banned[ip] = true
+	var peers []*peerlib.Peer
+	for peer := range s.peers {
+		if peerIP(peer.Peer) == ip {
+			peers = append(peers, peer)
+		}
+	}
+	s.mu.Unlock()
+
+	slog.Warn("banned peer for sending bad data", append([]any{"ip", ip}, args...)...)
+	// their workers stop on the next read and remove them from the session
+	for _, peer := range peers {
+		peer.Conn.Close()
+	}
+}
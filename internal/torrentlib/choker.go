@@ -0,0 +1,197 @@
+package torrentlib
+
+import (
+	"context"
+	"log/slog"
+	"math/rand"
+	"slices"
+	"time"
+
+	"github.com/codecrafters-io/bittorrent-starter-go/internal/torrentlib/peerlib"
+)
+
+// DefaultUploadSlots is the amount of peers unchoked by their rate, the
+// optimistic unchoke is one more
+const DefaultUploadSlots = 4
+
+// ChokeInterval is how often peers are rechoked. Rates are measured over it, so
+// peers are not choked and unchoked too quickly (fibrillation).
+const ChokeInterval = 10 * time.Second
+
+// the optimistic unchoke gives a new peer the chance to show a better rate
+const OptimisticUnchokeInterval = 30 * time.Second
+
+// choker decides which peers may request blocks from us (tit-for-tat). The
+// interested peers that upload faster to us are unchoked, when the torrent is
+// complete the ones we upload faster to. One more peer is unchoked
+// optimistically, regardless of its rate, and rotated every
+// OptimisticUnchokeInterval.
+type choker struct {
+	slots int
+	// rates are the bytes per second of the last interval, by peer
+	rates map[*peerlib.Peer]float64
+	// last are the bytes counted at the start of the interval, by peer
+	last       map[*peerlib.Peer]int64
+	optimistic *peerlib.Peer
+}
+
+func newChoker(slots int) *choker {
+	if slots <= 0 {
+		slots = DefaultUploadSlots
+	}
+	return &choker{
+		slots: slots,
+		rates: make(map[*peerlib.Peer]float64),
+		last:  make(map[*peerlib.Peer]int64),
+	}
+}
+
+// runChoker rechokes peers every ChokeInterval, and whenever a peer changes its
+// interest or disconnects (see s.rechoke), until ctx is done
+func (s *session) runChoker(ctx context.Context) {
+	ticker := time.NewTicker(ChokeInterval)
+	defer ticker.Stop()
+
+	rounds := int(OptimisticUnchokeInterval / ChokeInterval)
+	round := 0
+	// the optimistic unchoke is picked on the first round too
+	s.choker.rechoke(s.connectedPeers(), true)
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			round++
+			peers, seeding := s.connectedPeers(), s.isComplete()
+			s.choker.measure(peers, seeding, ChokeInterval)
+			s.choker.rechoke(peers, round%rounds == 0)
+		case <-s.rechokeCh:
+			s.choker.rechoke(s.connectedPeers(), false)
+		}
+	}
+}
+
+// rechoke wakes up the choker, e.g. after a peer became interested, so it does
+// not wait until the next interval
+func (s *session) rechoke() {
+	select {
+	case s.rechokeCh <- struct{}{}:
+	default:
+	}
+}
+
+// measure updates the rate of each peer, the download rate from it or, when
+// seeding, the upload rate to it
+func (c *choker) measure(peers []*peerlib.Peer, seeding bool, interval time.Duration) {
+	clear(c.rates)
+	last := make(map[*peerlib.Peer]int64, len(peers))
+	for _, peer := range peers {
+		total := peer.Downloaded.Load()
+		if seeding {
+			total = peer.Uploaded.Load()
+		}
+		// the counter changes when we complete, a peer that is new or went
+		// backwards starts from zero
+		if prev, ok := c.last[peer]; ok && total >= prev {
+			c.rates[peer] = float64(total-prev) / interval.Seconds()
+		}
+		last[peer] = total
+	}
+	c.last = last
+}
+
+// rechoke unchokes the interested peers with the best rates, up to c.slots,
+// and an optimistic one. Every other peer is choked. A new optimistic unchoke
+// is picked when rotate is set, or when the current one is gone.
+func (c *choker) rechoke(peers []*peerlib.Peer, rotate bool) {
+	var interested []*peerlib.Peer
+	for _, peer := range peers {
+		if peer.Interested.Load() {
+			interested = append(interested, peer)
+		}
+	}
+	slices.SortStableFunc(interested, func(a, b *peerlib.Peer) int {
+		// higher rates first
+		if c.rates[a] > c.rates[b] {
+			return -1
+		}
+		if c.rates[a] < c.rates[b] {
+			return 1
+		}
+		return 0
+	})
+
+	unchoke := make(map[*peerlib.Peer]bool)
+	for _, peer := range interested[:min(c.slots, len(interested))] {
+		unchoke[peer] = true
+	}
+
+	if c.optimistic != nil && (rotate || !c.optimistic.Interested.Load() || !slices.Contains(peers, c.optimistic)) {
+		c.optimistic = nil
+	}
+	if c.optimistic == nil || unchoke[c.optimistic] {
+		var candidates []*peerlib.Peer
+		for _, peer := range interested {
+			if !unchoke[peer] {
+				candidates = append(candidates, peer)
+			}
+		}
+		c.optimistic = nil
+		if len(candidates) > 0 {
+			c.optimistic = candidates[rand.Intn(len(candidates))]
+			slog.Debug("optimistic unchoke", "peer", c.optimistic.Peer)
+		}
+	}
+	if c.optimistic != nil {
+		unchoke[c.optimistic] = true
+	}
+
+	for _, peer := range peers {
+		var err error
+		if unchoke[peer] {
+			err = unchokePeer(peer, c.rates[peer])
+		} else {
+			err = chokePeer(peer)
+		}
+		if err != nil {
+			// the connection is gone, its worker cleans it up
+			slog.Debug("could not change choke state", "peer", peer.Peer, "error", err)
+		}
+	}
+
+	// forget peers that disconnected
+	for peer := range c.rates {
+		if !slices.Contains(peers, peer) {
+			delete(c.rates, peer)
+		}
+	}
+}
+
+// unchokePeer lets the peer request blocks from us
+func unchokePeer(peer *peerlib.Peer, rate float64) error {
+	if !peer.AmChoking.Load() {
+		return nil
+	}
+	// set before sending, so requests right after the unchoke are not ignored
+	peer.AmChoking.Store(false)
+	if err := peer.Send(&peerlib.Message{Type: peerlib.Unchoke, Payload: nil}); err != nil {
+		return err
+	}
+	slog.Debug("unchoked peer", "peer", peer.Peer, "rate", int(rate))
+	return nil
+}
+
+// chokePeer stops serving requests of the peer, pending ones are discarded
+func chokePeer(peer *peerlib.Peer) error {
+	if peer.AmChoking.Load() {
+		return nil
+	}
+	// requests that arrive after this point are ignored
+	peer.AmChoking.Store(true)
+	if err := peer.Send(&peerlib.Message{Type: peerlib.Choke, Payload: nil}); err != nil {
+		return err
+	}
+	slog.Debug("choked peer", "peer", peer.Peer)
+	return nil
+}
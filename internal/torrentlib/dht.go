@@ -0,0 +1,85 @@
+package torrentlib
+
+import (
+	"context"
+	"log/slog"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/codecrafters-io/bittorrent-starter-go/internal/torrentlib/dhtlib"
+	"github.com/codecrafters-io/bittorrent-starter-go/internal/torrentlib/peerlib"
+)
+
+// DHTAnnounceInterval is how often a download announces itself to the DHT,
+// announces expire after dhtlib.PeerTTL
+const DHTAnnounceInterval = 15 * time.Minute
+
+// after a failed announce (e.g. no node answered), the DHT is tried again
+// sooner
+const dhtRetryInterval = time.Minute
+
+// runDHT announces the torrent to the DHT until ctx is done, the peers found
+// are sent to the connection pool. The nodes of the torrent are pinged first,
+// so a DHT node with an empty routing table can join through them.
+func (s *session) runDHT(ctx context.Context, dht *dhtlib.DHT, port int) {
+	var wg sync.WaitGroup
+	for _, node := range s.torrent.Nodes {
+		wg.Add(1)
+		go func(node string) {
+			defer wg.Done()
+			if err := dht.Ping(ctx, node); err != nil {
+				slog.Debug("dht node of torrent did not answer", "node", node, "error", err)
+			}
+		}(node)
+	}
+	wg.Wait()
+
+	timer := time.NewTimer(0)
+	defer timer.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-timer.C:
+		}
+
+		peers, err := dht.Announce(ctx, [20]byte(s.torrent.InfoHash), port)
+		if err != nil {
+			if ctx.Err() == nil {
+				slog.Warn("could not announce to the dht", "error", err)
+			}
+			timer.Reset(dhtRetryInterval)
+			continue
+		}
+		timer.Reset(DHTAnnounceInterval)
+
+		slog.Info("got peers from the dht", "peers", len(peers))
+		if len(peers) == 0 {
+			continue
+		}
+		select {
+		case s.newPeers <- peers:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// pingDHTNode pings the DHT node a peer told us about with a Port message, it
+// is added to the routing table if it answers. This way a DHT node with an
+// empty routing table can join through the peers of a torrent.
+func (s *session) pingDHTNode(ctx context.Context, peer *peerlib.Peer, port int) {
+	host, _, err := net.SplitHostPort(peer.Peer)
+	if err != nil {
+		return
+	}
+	node := net.JoinHostPort(host, strconv.Itoa(port))
+	if err := s.dht.Ping(ctx, node); err != nil {
+		slog.Debug("dht node of peer did not answer", "peer", peer.Peer, "node", node, "error", err)
+		return
+	}
+	slog.Debug("added dht node of peer", "peer", peer.Peer, "node", node)
+}
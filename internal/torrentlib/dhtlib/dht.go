@@ -0,0 +1,492 @@
+package dhtlib
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/codecrafters-io/bittorrent-starter-go/internal/encoding/bencode"
+	"github.com/codecrafters-io/bittorrent-starter-go/internal/torrentlib/trackerlib"
+)
+
+// DefaultBootstrap are well known nodes used to join the DHT when the routing
+// table is empty
+var DefaultBootstrap = []string{
+	"router.bittorrent.com:6881",
+	"dht.transmissionbt.com:6881",
+	"router.utorrent.com:6881",
+}
+
+// QueryTimeout is how long we wait for the response of a query
+const QueryTimeout = 2 * time.Second
+
+// RefreshInterval is how often nodes not seen for StaleAge are pinged, nodes
+// that don't answer end up removed from the routing table
+const RefreshInterval = 5 * time.Minute
+const StaleAge = 15 * time.Minute
+
+// maxPacketSize is the largest packet read. Queries and responses are small,
+// but get_peers responses with many values can be a few KiB.
+const maxPacketSize = 8192
+
+// maxVerifying is the amount of nodes that queried us pinged at a time
+const maxVerifying = 32
+
+var errClosed = errors.New("dht node closed")
+
+// Options configures a DHT node
+type Options struct {
+	// Host is the IP to listen on, every interface when empty
+	Host string
+	// Port is the UDP port to listen on, a free one when 0
+	Port int
+	// Bootstrap are the "host:port" of nodes to join the DHT from, they are
+	// only used when the routing table has no nodes
+	Bootstrap []string
+	// StateFile keeps our id and the routing table between runs: it is loaded
+	// by Listen and written by Save and Close. Nothing is kept when empty.
+	StateFile string
+}
+
+// DHT is a node of the mainline DHT (BEP 5), a Kademlia network where nodes
+// store the peers of the info hashes closest to their id. It finds peers of
+// torrents without trackers, and answers the queries of other nodes while it
+// is open.
+//
+// TODO: only IPv4 is supported, IPv6 nodes (BEP 32) are ignored
+type DHT struct {
+	conn      *net.UDPConn
+	id        NodeID
+	table     *table
+	tokens    *tokens
+	peers     *peerStore
+	bootstrap []string
+	stateFile string
+
+	mu      sync.Mutex
+	pending map[string]*pendingQuery
+	nextID  uint16
+	// verifying are the addresses of the nodes that queried us being pinged
+	verifying map[string]bool
+
+	closed    chan struct{}
+	closeOnce sync.Once
+	wg        sync.WaitGroup
+}
+
+// pendingQuery waits for the response of a query, only packets from the
+// node queried are accepted
+type pendingQuery struct {
+	addr     *net.UDPAddr
+	response chan *message
+}
+
+// Listen starts a node, loading its state from opts.StateFile when there is
+// one. The node must be joined to the DHT with Bootstrap.
+func Listen(opts Options) (*DHT, error) {
+	addr := &net.UDPAddr{IP: net.ParseIP(opts.Host), Port: opts.Port}
+	conn, err := net.ListenUDP("udp4", addr)
+	if err != nil {
+		return nil, fmt.Errorf("error listening for dht on %s: %v", net.JoinHostPort(opts.Host, strconv.Itoa(opts.Port)), err)
+	}
+
+	d := &DHT{
+		conn:      conn,
+		id:        NewNodeID(),
+		tokens:    newTokens(),
+		peers:     newPeerStore(),
+		bootstrap: opts.Bootstrap,
+		stateFile: opts.StateFile,
+		pending:   make(map[string]*pendingQuery),
+		verifying: make(map[string]bool),
+		closed:    make(chan struct{}),
+	}
+	var saved []*node
+	if opts.StateFile != "" {
+		d.id, saved, err = loadState(opts.StateFile, d.id)
+		if err != nil {
+			// we can still join through the bootstrap nodes
+			slog.Warn("could not load dht state", "file", opts.StateFile, "error", err)
+		}
+	}
+	d.table = newTable(d.id)
+	// saved nodes are not seen yet, they are pinged on the first refresh
+	for _, n := range saved {
+		d.addNode(n.id, n.addr, time.Time{})
+	}
+
+	d.wg.Add(2)
+	go d.serve()
+	go d.refresh()
+
+	slog.Info("dht node listening", "address", conn.LocalAddr().String(), "id", fmt.Sprintf("%x", d.id), "nodes", len(saved))
+	return d, nil
+}
+
+// ID returns our node id
+func (d *DHT) ID() NodeID {
+	return d.id
+}
+
+// Addr returns the address the node listens on
+func (d *DHT) Addr() *net.UDPAddr {
+	return d.conn.LocalAddr().(*net.UDPAddr)
+}
+
+// Nodes returns the addresses of the nodes of the routing table
+func (d *DHT) Nodes() []string {
+	nodes := d.table.nodes()
+	addrs := make([]string, len(nodes))
+	for i, n := range nodes {
+		addrs[i] = n.addr.String()
+	}
+	return addrs
+}
+
+// Close saves the state and stops the node, pending queries fail
+func (d *DHT) Close() error {
+	var err error
+	d.closeOnce.Do(func() {
+		if d.stateFile != "" {
+			err = d.Save()
+		}
+		close(d.closed)
+		d.conn.Close()
+		d.wg.Wait()
+	})
+	return err
+}
+
+// Ping queries a node, it is added to the routing table if it answers
+func (d *DHT) Ping(ctx context.Context, addr string) error {
+	udpAddr, err := net.ResolveUDPAddr("udp4", addr)
+	if err != nil {
+		return fmt.Errorf("error resolving dht node %q: %v", addr, err)
+	}
+	_, err = d.query(ctx, udpAddr, methodPing, queryArgs{})
+	return err
+}
+
+// query sends a query and waits for its response. Nodes that answer are added
+// to the routing table, the ones that time out count a failure.
+func (d *DHT) query(ctx context.Context, addr *net.UDPAddr, method string, args queryArgs) (*response, error) {
+	d.mu.Lock()
+	d.nextID++
+	transactionID := string(binary.BigEndian.AppendUint16(nil, d.nextID))
+	pending := &pendingQuery{addr: addr, response: make(chan *message, 1)}
+	d.pending[transactionID] = pending
+	d.mu.Unlock()
+	defer func() {
+		d.mu.Lock()
+		delete(d.pending, transactionID)
+		d.mu.Unlock()
+	}()
+
+	args.ID = string(d.id[:])
+	if err := d.send(addr, message{T: transactionID, Y: "q", Q: method, A: args}); err != nil {
+		return nil, err
+	}
+
+	timer := time.NewTimer(QueryTimeout)
+	defer timer.Stop()
+
+	select {
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	case <-d.closed:
+		return nil, errClosed
+	case <-timer.C:
+		d.table.failed(addr)
+		return nil, fmt.Errorf("dht node %s did not answer %s in time", addr, method)
+	case msg := <-pending.response:
+		if msg.Y == "e" {
+			return nil, parseError(msg)
+		}
+		if len(msg.R.ID) != len(NodeID{}) {
+			return nil, fmt.Errorf("dht node %s answered with an invalid id", addr)
+		}
+		d.addNode(NodeID([]byte(msg.R.ID)), addr, time.Now())
+		return &msg.R, nil
+	}
+}
+
+// addNode adds a node to the routing table. When its bucket is full, a node of
+// the bucket is pinged and replaced if it does not answer.
+func (d *DHT) addNode(id NodeID, addr *net.UDPAddr, seen time.Time) {
+	old := d.table.add(id, addr, seen)
+	if old == nil {
+		return
+	}
+	go func() {
+		_, err := d.query(context.Background(), old.addr, methodPing, queryArgs{})
+		d.table.replace(old, id, addr, seen, err == nil)
+		if err != nil {
+			slog.Debug("replaced dht node", "node", old.addr.String(), "by", addr.String())
+		}
+	}()
+}
+
+// verify pings a node that queried us, it is added to the routing table once
+// it answers
+func (d *DHT) verify(addr *net.UDPAddr) {
+	key := addr.String()
+	d.mu.Lock()
+	if d.verifying[key] || len(d.verifying) >= maxVerifying {
+		d.mu.Unlock()
+		return
+	}
+	d.verifying[key] = true
+	d.mu.Unlock()
+
+	go func() {
+		defer func() {
+			d.mu.Lock()
+			delete(d.verifying, key)
+			d.mu.Unlock()
+		}()
+		if _, err := d.query(context.Background(), addr, methodPing, queryArgs{}); err != nil {
+			slog.Debug("dht node that queried us did not answer", "node", key, "error", err)
+		}
+	}()
+}
+
+func (d *DHT) send(addr *net.UDPAddr, msg message) error {
+	packet, err := bencode.Encode(msg)
+	if err != nil {
+		return fmt.Errorf("error encoding dht message: %v", err)
+	}
+	if _, err := d.conn.WriteToUDP(packet, addr); err != nil {
+		return fmt.Errorf("error sending dht message to %s: %v", addr, err)
+	}
+	return nil
+}
+
+// serve reads packets until the node is closed, queries are answered and
+// responses are handed to their pending query
+func (d *DHT) serve() {
+	defer d.wg.Done()
+
+	buf := make([]byte, maxPacketSize)
+	for {
+		n, addr, err := d.conn.ReadFromUDP(buf)
+		if errors.Is(err, net.ErrClosed) {
+			return
+		}
+		if err != nil {
+			slog.Debug("error reading dht packet", "error", err)
+			continue
+		}
+
+		var msg message
+		if err := bencode.Unmarshal(buf[:n], &msg); err != nil {
+			slog.Debug("ignoring invalid dht packet", "node", addr.String(), "error", err)
+			continue
+		}
+
+		switch msg.Y {
+		case "q":
+			d.handleQuery(addr, &msg)
+		case "r", "e":
+			d.mu.Lock()
+			pending, ok := d.pending[msg.T]
+			d.mu.Unlock()
+			if !ok || !pending.addr.IP.Equal(addr.IP) || pending.addr.Port != addr.Port {
+				slog.Debug("ignoring unexpected dht response", "node", addr.String())
+				continue
+			}
+			select {
+			case pending.response <- &msg:
+			default:
+			}
+		default:
+			slog.Debug("ignoring dht message of unknown type", "node", addr.String(), "type", msg.Y)
+		}
+	}
+}
+
+// handleQuery answers a query of another node
+func (d *DHT) handleQuery(addr *net.UDPAddr, msg *message) {
+	reply := func(res response) {
+		res.ID = string(d.id[:])
+		if err := d.send(addr, message{T: msg.T, Y: "r", R: res}); err != nil {
+			slog.Debug("could not answer dht query", "node", addr.String(), "error", err)
+		}
+	}
+	replyError := func(code int, reason string) {
+		if err := d.send(addr, newErrorMessage(msg.T, code, reason)); err != nil {
+			slog.Debug("could not answer dht query", "node", addr.String(), "error", err)
+		}
+	}
+
+	if len(msg.A.ID) != len(NodeID{}) {
+		replyError(ErrorProtocol, "invalid id")
+		return
+	}
+	// anyone can send a query with any id, the node is added once it answers
+	// ours
+	if id := NodeID([]byte(msg.A.ID)); id != d.id && !d.table.has(id) {
+		d.verify(addr)
+	}
+
+	slog.Debug("got dht query", "node", addr.String(), "method", msg.Q)
+	switch msg.Q {
+	case methodPing:
+		reply(response{})
+
+	case methodFindNode:
+		if len(msg.A.Target) != len(NodeID{}) {
+			replyError(ErrorProtocol, "invalid target")
+			return
+		}
+		reply(response{Nodes: formatNodes(d.table.closest(NodeID([]byte(msg.A.Target)), K))})
+
+	case methodGetPeers:
+		if len(msg.A.InfoHash) != len(NodeID{}) {
+			replyError(ErrorProtocol, "invalid info_hash")
+			return
+		}
+		infoHash := [20]byte([]byte(msg.A.InfoHash))
+		res := response{
+			Nodes: formatNodes(d.table.closest(NodeID(infoHash), K)),
+			Token: d.tokens.token(addr.IP),
+		}
+		for _, peer := range d.peers.get(infoHash) {
+			compact, err := trackerlib.FormatCompactPeer(peer)
+			if err != nil {
+				continue
+			}
+			res.Values = append(res.Values, string(compact))
+		}
+		reply(res)
+
+	case methodAnnouncePeer:
+		if len(msg.A.InfoHash) != len(NodeID{}) {
+			replyError(ErrorProtocol, "invalid info_hash")
+			return
+		}
+		if !d.tokens.valid(msg.A.Token, addr.IP) {
+			replyError(ErrorProtocol, "invalid token")
+			return
+		}
+		port := msg.A.Port
+		if msg.A.ImpliedPort != 0 {
+			port = addr.Port
+		}
+		if port <= 0 || port > 65535 {
+			replyError(ErrorProtocol, "invalid port")
+			return
+		}
+		peer := net.JoinHostPort(addr.IP.String(), strconv.Itoa(port))
+		d.peers.add([20]byte([]byte(msg.A.InfoHash)), peer)
+		slog.Debug("peer announced", "infoHash", fmt.Sprintf("%x", msg.A.InfoHash), "peer", peer)
+		reply(response{})
+
+	default:
+		replyError(ErrorMethod, "method unknown")
+	}
+}
+
+// refresh pings the nodes not seen for StaleAge every RefreshInterval, and
+// forgets expired peers, until the node is closed. With few nodes left, the
+// DHT is joined again.
+func (d *DHT) refresh() {
+	defer d.wg.Done()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		<-d.closed
+		cancel()
+	}()
+
+	ticker := time.NewTicker(RefreshInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		d.peers.expire()
+		if d.table.len() < K {
+			if err := d.Bootstrap(ctx); err != nil {
+				slog.Debug("could not bootstrap dht", "error", err)
+			}
+		}
+		var wg sync.WaitGroup
+		for _, n := range d.table.stale(time.Now().Add(-StaleAge)) {
+			wg.Add(1)
+			go func(n *node) {
+				defer wg.Done()
+				d.query(ctx, n.addr, methodPing, queryArgs{})
+			}(n)
+		}
+		wg.Wait()
+		slog.Debug("dht refreshed", "nodes", d.table.len())
+	}
+}
+
+// state is the content of the state file
+type state struct {
+	ID    string `bencode:"id"`
+	Nodes string `bencode:"nodes"`
+}
+
+// Save writes our id and the routing table to the state file
+func (d *DHT) Save() error {
+	if d.stateFile == "" {
+		return fmt.Errorf("dht node has no state file")
+	}
+
+	data, err := bencode.Encode(state{ID: string(d.id[:]), Nodes: formatNodes(d.table.nodes())})
+	if err != nil {
+		return fmt.Errorf("error encoding dht state: %v", err)
+	}
+	if err := os.MkdirAll(filepath.Dir(d.stateFile), 0755); err != nil {
+		return fmt.Errorf("error creating dht state directory: %v", err)
+	}
+	// written aside and renamed, so a crash never leaves a half written file
+	tmp := d.stateFile + ".tmp"
+	if err := os.WriteFile(tmp, data, 0644); err != nil {
+		return fmt.Errorf("error writing dht state: %v", err)
+	}
+	if err := os.Rename(tmp, d.stateFile); err != nil {
+		return fmt.Errorf("error writing dht state: %v", err)
+	}
+	slog.Debug("dht state saved", "file", d.stateFile, "nodes", d.table.len())
+	return nil
+}
+
+// loadState reads the state file, id is returned as is when there is no file
+func loadState(file string, id NodeID) (NodeID, []*node, error) {
+	data, err := os.ReadFile(file)
+	if errors.Is(err, os.ErrNotExist) {
+		return id, nil, nil
+	}
+	if err != nil {
+		return id, nil, fmt.Errorf("error reading dht state: %v", err)
+	}
+
+	var saved state
+	if err := bencode.Unmarshal(data, &saved); err != nil {
+		return id, nil, fmt.Errorf("error decoding dht state: %v", err)
+	}
+	if len(saved.ID) != len(id) {
+		return id, nil, fmt.Errorf("invalid id in dht state")
+	}
+	nodes, err := parseNodes(saved.Nodes)
+	if err != nil {
+		return id, nil, err
+	}
+	return NodeID([]byte(saved.ID)), nodes, nil
+}
@@ -0,0 +1,133 @@
+package dhtlib
+
+import (
+	"fmt"
+	"net"
+
+	"github.com/codecrafters-io/bittorrent-starter-go/internal/encoding/bencode"
+)
+
+// The methods of KRPC, the protocol of the DHT (BEP 5).
+//
+// Every message is a bencoded dictionary in a single UDP datagram. Queries
+// (y = "q") name a method (q) and carry its arguments (a), they are answered
+// with a response (y = "r", values in r) or an error (y = "e", [code, message]
+// in e) with the same transaction id (t).
+//
+// Fields of the structs are sorted by key, as bencode dictionaries must be.
+const (
+	methodPing         = "ping"
+	methodFindNode     = "find_node"
+	methodGetPeers     = "get_peers"
+	methodAnnouncePeer = "announce_peer"
+)
+
+// KRPC error codes
+const (
+	ErrorGeneric  = 201
+	ErrorServer   = 202
+	ErrorProtocol = 203
+	ErrorMethod   = 204
+)
+
+type message struct {
+	A queryArgs            `bencode:"a,omitempty"`
+	E []bencode.RawMessage `bencode:"e,omitempty"`
+	Q string               `bencode:"q,omitempty"`
+	R response             `bencode:"r,omitempty"`
+	T string               `bencode:"t"`
+	Y string               `bencode:"y"`
+}
+
+// queryArgs are the arguments of every method, each one uses some of them
+type queryArgs struct {
+	ID string `bencode:"id"`
+	// ImpliedPort makes announce_peer use the source port of the packet
+	// instead of Port, for peers behind NAT
+	ImpliedPort int    `bencode:"implied_port,omitempty"`
+	InfoHash    string `bencode:"info_hash,omitempty"`
+	Port        int    `bencode:"port,omitempty"`
+	Target      string `bencode:"target,omitempty"`
+	Token       string `bencode:"token,omitempty"`
+}
+
+// response holds the values of every method, each one uses some of them
+type response struct {
+	ID string `bencode:"id"`
+	// Nodes are the closest nodes we know, in compact node info form
+	Nodes string `bencode:"nodes,omitempty"`
+	// Token must be sent back in announce_peer
+	Token string `bencode:"token,omitempty"`
+	// Values are the peers of the info hash, in compact form
+	Values []string `bencode:"values,omitempty"`
+}
+
+// Error is a KRPC error sent by a node
+type Error struct {
+	Code    int
+	Message string
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("dht error %d: %s", e.Code, e.Message)
+}
+
+func newErrorMessage(transactionID string, code int, msg string) message {
+	codeRaw, _ := bencode.Encode(code)
+	msgRaw, _ := bencode.Encode(msg)
+	return message{T: transactionID, Y: "e", E: []bencode.RawMessage{codeRaw, msgRaw}}
+}
+
+// parseError returns the error of an error message
+func parseError(msg *message) error {
+	e := &Error{Code: ErrorGeneric}
+	if len(msg.E) != 2 {
+		return e
+	}
+	bencode.Unmarshal(msg.E[0], &e.Code)
+	bencode.Unmarshal(msg.E[1], &e.Message)
+	return e
+}
+
+// compact node info is 20 bytes of id, 4 of IP and 2 of port
+const compactNodeLength = 26
+
+// formatNodes returns the compact node info of nodes, nodes without an IPv4
+// address are skipped
+func formatNodes(nodes []*node) string {
+	compact := make([]byte, 0, compactNodeLength*len(nodes))
+	for _, n := range nodes {
+		ip := n.addr.IP.To4()
+		if ip == nil {
+			continue
+		}
+		compact = append(compact, n.id[:]...)
+		compact = append(compact, ip...)
+		compact = append(compact, byte(n.addr.Port>>8), byte(n.addr.Port))
+	}
+	return string(compact)
+}
+
+// parseNodes parses compact node info
+func parseNodes(compact string) ([]*node, error) {
+	if len(compact)%compactNodeLength != 0 {
+		return nil, fmt.Errorf("compact nodes length %d is not a multiple of %d", len(compact), compactNodeLength)
+	}
+
+	nodes := make([]*node, 0, len(compact)/compactNodeLength)
+	for i := 0; i < len(compact); i += compactNodeLength {
+		entry := compact[i : i+compactNodeLength]
+		n := &node{
+			id: NodeID([]byte(entry[:20])),
+			addr: &net.UDPAddr{
+				IP:   net.IP([]byte(entry[20:24])),
+				Port: int(entry[24])<<8 | int(entry[25]),
+			},
+		}
+		if n.addr.Port == 0 {
+			continue
+		}
+		nodes = append(nodes, n)
+	}
+	return nodes, nil
+}
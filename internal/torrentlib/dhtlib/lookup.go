@@ -0,0 +1,235 @@
+package dhtlib
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"log/slog"
+	"net"
+	"slices"
+	"sync"
+	"sync/atomic"
+
+	"github.com/codecrafters-io/bittorrent-starter-go/internal/torrentlib/trackerlib"
+)
+
+// Alpha is the amount of queries in flight during a lookup
+const Alpha = 3
+
+// candidate is a node asked (or to ask) during a lookup
+type candidate struct {
+	id   NodeID
+	addr *net.UDPAddr
+	// known is false for bootstrap nodes until they answer with their id
+	known     bool
+	queried   bool
+	responded bool
+	failed    bool
+	// token is the one of the get_peers response, for announce_peer
+	token string
+}
+
+type lookupResult struct {
+	peers []string
+	// closest are up to K nodes closest to the target that answered
+	closest []*candidate
+}
+
+// lookup finds the nodes closest to target, Kademlia style: the closest nodes
+// we know are asked for closer ones (Alpha at once), until the K closest that
+// answer have all been asked. With get_peers, the peers they know are
+// collected too.
+//
+// The routing table is the starting point, the bootstrap nodes are used when
+// it is empty.
+func (d *DHT) lookup(ctx context.Context, target NodeID, method string) (*lookupResult, error) {
+	var candidates []*candidate
+	seen := make(map[string]bool)
+	addCandidate := func(id NodeID, addr *net.UDPAddr, known bool) {
+		if seen[addr.String()] || known && id == d.id {
+			return
+		}
+		seen[addr.String()] = true
+		candidates = append(candidates, &candidate{id: id, addr: addr, known: known})
+	}
+
+	for _, n := range d.table.closest(target, K) {
+		addCandidate(n.id, n.addr, true)
+	}
+	if len(candidates) == 0 {
+		for _, addr := range d.bootstrap {
+			udpAddr, err := net.ResolveUDPAddr("udp4", addr)
+			if err != nil {
+				slog.Warn("could not resolve dht bootstrap node", "node", addr, "error", err)
+				continue
+			}
+			addCandidate(NodeID{}, udpAddr, false)
+		}
+	}
+	if len(candidates) == 0 {
+		return nil, fmt.Errorf("no dht nodes to ask")
+	}
+
+	args := queryArgs{Target: string(target[:])}
+	if method == methodGetPeers {
+		args = queryArgs{InfoHash: string(target[:])}
+	}
+
+	type answer struct {
+		c   *candidate
+		res *response
+		err error
+	}
+	// buffered, so queries in flight don't block when we return early
+	answers := make(chan answer, Alpha)
+	inFlight := 0
+	peers := make(map[string]bool)
+
+	byDistance := func(a, b *candidate) int {
+		if a.known != b.known {
+			if a.known {
+				return -1
+			}
+			return 1
+		}
+		distanceA, distanceB := a.id.xor(target), b.id.xor(target)
+		return bytes.Compare(distanceA[:], distanceB[:])
+	}
+
+	for {
+		slices.SortFunc(candidates, byDistance)
+		active := 0
+		for _, c := range candidates {
+			if active >= K || inFlight >= Alpha {
+				break
+			}
+			if c.failed {
+				continue
+			}
+			active++
+			if c.queried {
+				continue
+			}
+			c.queried = true
+			inFlight++
+			go func(c *candidate) {
+				res, err := d.query(ctx, c.addr, method, args)
+				answers <- answer{c, res, err}
+			}(c)
+		}
+		if inFlight == 0 {
+			break
+		}
+
+		var a answer
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case a = <-answers:
+		}
+		inFlight--
+
+		if a.err != nil {
+			slog.Debug("dht lookup query failed", "node", a.c.addr.String(), "method", method, "error", a.err)
+			a.c.failed = true
+			continue
+		}
+		a.c.responded = true
+		a.c.token = a.res.Token
+		if !a.c.known {
+			a.c.id = NodeID([]byte(a.res.ID))
+			a.c.known = true
+		}
+
+		nodes, err := parseNodes(a.res.Nodes)
+		if err != nil {
+			slog.Debug("ignoring invalid nodes", "node", a.c.addr.String(), "error", err)
+		}
+		for _, n := range nodes {
+			addCandidate(n.id, n.addr, true)
+		}
+		for _, value := range a.res.Values {
+			parse := trackerlib.ParseCompactPeers
+			if len(value) != 6 {
+				parse = trackerlib.ParseCompactPeers6
+			}
+			found, err := parse([]byte(value))
+			if err != nil {
+				slog.Debug("ignoring invalid peer", "node", a.c.addr.String(), "error", err)
+				continue
+			}
+			for _, peer := range found {
+				peers[peer] = true
+			}
+		}
+	}
+
+	var result lookupResult
+	for peer := range peers {
+		result.peers = append(result.peers, peer)
+	}
+	for _, c := range candidates {
+		if c.responded && len(result.closest) < K {
+			result.closest = append(result.closest, c)
+		}
+	}
+	slog.Debug("dht lookup done", "method", method, "target", fmt.Sprintf("%x", target), "asked", len(seen), "peers", len(result.peers))
+
+	return &result, nil
+}
+
+// Bootstrap joins the DHT: our own id is looked up, which fills the routing
+// table and lets the nodes close to us know about us
+func (d *DHT) Bootstrap(ctx context.Context) error {
+	if _, err := d.lookup(ctx, d.id, methodFindNode); err != nil {
+		return err
+	}
+	if d.table.len() == 0 {
+		return fmt.Errorf("no dht node answered")
+	}
+	slog.Info("dht bootstrapped", "nodes", d.table.len())
+	return nil
+}
+
+// GetPeers returns the peers of a torrent the DHT knows
+func (d *DHT) GetPeers(ctx context.Context, infoHash [20]byte) ([]string, error) {
+	res, err := d.lookup(ctx, NodeID(infoHash), methodGetPeers)
+	if err != nil {
+		return nil, err
+	}
+	return res.peers, nil
+}
+
+// Announce tells the nodes closest to a torrent that we are a peer of it,
+// listening on port. The peers they know are returned, as in GetPeers.
+//
+// Announces expire (see PeerTTL), they must be repeated while we are in the
+// swarm
+func (d *DHT) Announce(ctx context.Context, infoHash [20]byte, port int) ([]string, error) {
+	res, err := d.lookup(ctx, NodeID(infoHash), methodGetPeers)
+	if err != nil {
+		return nil, err
+	}
+
+	var announced atomic.Int32
+	var wg sync.WaitGroup
+	for _, c := range res.closest {
+		if c.token == "" {
+			continue
+		}
+		wg.Add(1)
+		go func(c *candidate) {
+			defer wg.Done()
+			args := queryArgs{InfoHash: string(infoHash[:]), Port: port, Token: c.token}
+			if _, err := d.query(ctx, c.addr, methodAnnouncePeer, args); err != nil {
+				slog.Debug("dht announce failed", "node", c.addr.String(), "error", err)
+				return
+			}
+			announced.Add(1)
+		}(c)
+	}
+	wg.Wait()
+
+	slog.Info("announced to dht", "infoHash", fmt.Sprintf("%x", infoHash), "nodes", announced.Load(), "peers", len(res.peers))
+	return res.peers, nil
+}
@@ -0,0 +1,232 @@
+package dhtlib
+
+import (
+	"bytes"
+	"crypto/rand"
+	"math/bits"
+	"net"
+	"slices"
+	"sync"
+	"time"
+)
+
+// K is the size of the buckets, and the amount of nodes returned by find_node
+// and get_peers
+const K = 8
+
+// a node that fails to answer MaxFailures queries in a row is removed
+const MaxFailures = 3
+
+// NodeID identifies a node, and has the same space as info hashes: the nodes
+// closest (by XOR) to an info hash know its peers
+type NodeID [20]byte
+
+// NewNodeID returns a random id
+func NewNodeID() NodeID {
+	var id NodeID
+	rand.Read(id[:])
+	return id
+}
+
+func (id NodeID) xor(other NodeID) NodeID {
+	var distance NodeID
+	for i := range id {
+		distance[i] = id[i] ^ other[i]
+	}
+	return distance
+}
+
+// commonPrefix returns the amount of leading bits id and other share, 160 when
+// they are equal
+func (id NodeID) commonPrefix(other NodeID) int {
+	for i := range id {
+		if x := id[i] ^ other[i]; x != 0 {
+			return i*8 + bits.LeadingZeros8(x)
+		}
+	}
+	return len(id) * 8
+}
+
+// node is a node of the routing table
+type node struct {
+	id       NodeID
+	addr     *net.UDPAddr
+	lastSeen time.Time
+	failures int
+}
+
+// table is the routing table, Kademlia style: bucket i has up to K nodes whose
+// id shares exactly i leading bits with ours. Far buckets cover most of the
+// id space with few nodes, so we know many nodes close to us and a few far
+// away.
+//
+// BEP 5 splits the bucket that holds our id when it fills up, fixed buckets by
+// prefix length hold the same nodes without splitting
+type table struct {
+	id NodeID
+
+	mu      sync.Mutex
+	buckets [160][]*node
+	// replacing marks the full buckets with a node being pinged, to make
+	// room for a new one
+	replacing [160]bool
+}
+
+func newTable(id NodeID) *table {
+	return &table{id: id}
+}
+
+// add adds a node or marks it as seen. When its bucket is full, the node
+// that failed more queries, or else the least recently seen one, is returned:
+// it must be pinged, and replace called with the result (BEP 5). New nodes of
+// the bucket are dropped until then.
+func (t *table) add(id NodeID, addr *net.UDPAddr, seen time.Time) (ping *node) {
+	prefix := t.id.commonPrefix(id)
+	if prefix == len(t.buckets) || addr.IP.To4() == nil {
+		return nil
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	bucket := t.buckets[prefix]
+	for i, n := range bucket {
+		if n.id != id {
+			continue
+		}
+		// the node changed its address, the old one may be someone
+		// pretending to be it, keep the one we know
+		if !n.addr.IP.Equal(addr.IP) || n.addr.Port != addr.Port {
+			return nil
+		}
+		if seen.After(n.lastSeen) {
+			n.lastSeen = seen
+			n.failures = 0
+		}
+		// most recently seen nodes are at the end
+		t.buckets[prefix] = append(slices.Delete(bucket, i, i+1), n)
+		return nil
+	}
+
+	if len(bucket) < K {
+		t.buckets[prefix] = append(bucket, &node{id: id, addr: addr, lastSeen: seen})
+		return nil
+	}
+	if t.replacing[prefix] {
+		return nil
+	}
+	t.replacing[prefix] = true
+	oldest := bucket[0]
+	for _, n := range bucket {
+		if n.failures > oldest.failures {
+			oldest = n
+		}
+	}
+	copied := *oldest
+	return &copied
+}
+
+// replace is called once the node returned by add was pinged. The node is
+// removed when it did not answer, and the new node added if there is room.
+func (t *table) replace(old *node, id NodeID, addr *net.UDPAddr, seen time.Time, answered bool) {
+	prefix := t.id.commonPrefix(id)
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.replacing[prefix] = false
+	bucket := t.buckets[prefix]
+	if !answered {
+		bucket = slices.DeleteFunc(bucket, func(n *node) bool {
+			return n.id == old.id
+		})
+	}
+	known := slices.ContainsFunc(bucket, func(n *node) bool {
+		return n.id == id
+	})
+	if len(bucket) < K && !known {
+		bucket = append(bucket, &node{id: id, addr: addr, lastSeen: seen})
+	}
+	t.buckets[prefix] = bucket
+}
+
+// has returns true when the node is in the routing table
+func (t *table) has(id NodeID) bool {
+	prefix := t.id.commonPrefix(id)
+	if prefix == len(t.buckets) {
+		return false
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return slices.ContainsFunc(t.buckets[prefix], func(n *node) bool {
+		return n.id == id
+	})
+}
+
+// failed counts a query the node at addr did not answer, the node is removed
+// after MaxFailures
+func (t *table) failed(addr *net.UDPAddr) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	for prefix, bucket := range t.buckets {
+		for i, n := range bucket {
+			if !n.addr.IP.Equal(addr.IP) || n.addr.Port != addr.Port {
+				continue
+			}
+			n.failures++
+			if n.failures >= MaxFailures {
+				t.buckets[prefix] = slices.Delete(bucket, i, i+1)
+			}
+			return
+		}
+	}
+}
+
+// closest returns up to n nodes sorted by distance to target
+func (t *table) closest(target NodeID, n int) []*node {
+	nodes := t.nodes()
+	slices.SortFunc(nodes, func(a, b *node) int {
+		distanceA, distanceB := a.id.xor(target), b.id.xor(target)
+		return bytes.Compare(distanceA[:], distanceB[:])
+	})
+	return nodes[:min(n, len(nodes))]
+}
+
+// nodes returns a copy of every node
+func (t *table) nodes() []*node {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	var nodes []*node
+	for _, bucket := range t.buckets {
+		for _, n := range bucket {
+			copied := *n
+			nodes = append(nodes, &copied)
+		}
+	}
+	return nodes
+}
+
+// stale returns the nodes not seen since before
+func (t *table) stale(before time.Time) []*node {
+	var stale []*node
+	for _, n := range t.nodes() {
+		if n.lastSeen.Before(before) {
+			stale = append(stale, n)
+		}
+	}
+	return stale
+}
+
+func (t *table) len() int {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	total := 0
+	for _, bucket := range t.buckets {
+		total += len(bucket)
+	}
+	return total
+}
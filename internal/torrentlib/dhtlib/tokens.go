@@ -0,0 +1,127 @@
+package dhtlib
+
+import (
+	"crypto/rand"
+	"crypto/sha1"
+	"net"
+	"sync"
+	"time"
+)
+
+// TokenRotation is how often the secret of the tokens changes, tokens of the
+// previous secret are accepted too so a token is valid for 5 to 10 minutes
+const TokenRotation = 5 * time.Minute
+
+// PeerTTL is how long announced peers are kept, peers announce again every
+// few minutes while they are in the swarm
+const PeerTTL = 30 * time.Minute
+
+// MaxValues is the maximum amount of peers sent in a get_peers response, so it
+// fits in a datagram
+const MaxValues = 50
+
+// tokens are handed in get_peers responses, a node must send one back to
+// announce_peer. They are the hash of the IP of the node and a secret, so
+// nodes can only announce the IP they queried from.
+type tokens struct {
+	mu       sync.Mutex
+	secret   [16]byte
+	previous [16]byte
+	rotated  time.Time
+}
+
+func newTokens() *tokens {
+	t := &tokens{rotated: time.Now()}
+	rand.Read(t.secret[:])
+	rand.Read(t.previous[:])
+	return t
+}
+
+// rotate changes the secret if it is old enough, t.mu must be held
+func (t *tokens) rotate(now time.Time) {
+	if now.Sub(t.rotated) < TokenRotation {
+		return
+	}
+	t.previous = t.secret
+	rand.Read(t.secret[:])
+	t.rotated = now
+}
+
+func (t *tokens) token(ip net.IP) string {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.rotate(time.Now())
+	return tokenOf(t.secret, ip)
+}
+
+func (t *tokens) valid(token string, ip net.IP) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.rotate(time.Now())
+	return token == tokenOf(t.secret, ip) || token == tokenOf(t.previous, ip)
+}
+
+func tokenOf(secret [16]byte, ip net.IP) string {
+	hash := sha1.New()
+	hash.Write(secret[:])
+	hash.Write(ip.To16())
+	return string(hash.Sum(nil))
+}
+
+// peerStore keeps the peers announced to us, by info hash
+type peerStore struct {
+	mu    sync.Mutex
+	peers map[[20]byte]map[string]time.Time
+}
+
+func newPeerStore() *peerStore {
+	return &peerStore{peers: make(map[[20]byte]map[string]time.Time)}
+}
+
+func (p *peerStore) add(infoHash [20]byte, addr string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.peers[infoHash] == nil {
+		p.peers[infoHash] = make(map[string]time.Time)
+	}
+	p.peers[infoHash][addr] = time.Now()
+}
+
+// get returns up to MaxValues peers of infoHash, expired peers are removed
+func (p *peerStore) get(infoHash [20]byte) []string {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	var peers []string
+	for addr, announced := range p.peers[infoHash] {
+		if time.Since(announced) > PeerTTL {
+			delete(p.peers[infoHash], addr)
+			continue
+		}
+		if len(peers) < MaxValues {
+			peers = append(peers, addr)
+		}
+	}
+	if len(p.peers[infoHash]) == 0 {
+		delete(p.peers, infoHash)
+	}
+	return peers
+}
+
+// expire removes the peers older than PeerTTL of every info hash
+func (p *peerStore) expire() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	for infoHash, peers := range p.peers {
+		for addr, announced := range peers {
+			if time.Since(announced) > PeerTTL {
+				delete(peers, addr)
+			}
+		}
+		if len(peers) == 0 {
+			delete(p.peers, infoHash)
+		}
+	}
+}
@@ -2,329 +2,614 @@ package torrentlib
 
 import (
 	"bytes"
+	"context"
 	"crypto/sha1"
-	"encoding/binary"
 	"fmt"
 	"log/slog"
+	"path/filepath"
+	"slices"
 	"time"
 
+	"github.com/codecrafters-io/bittorrent-starter-go/internal/torrentlib/dhtlib"
 	"github.com/codecrafters-io/bittorrent-starter-go/internal/torrentlib/peerlib"
+	"github.com/codecrafters-io/bittorrent-starter-go/internal/torrentlib/trackerlib"
 )
 
 // NOTE(maolivera): All current implementations use 2^14 (16 kiB),
 // and close connections which request an amount greater than that.
 // It cannot be greater than 2**32 as only 4 bytes are used for the length.
 const BlockSize = 16 * 1024 // 16 kB
-const MaxRetries = 3
-const MaxPendingRequests = 5
 
-// TODO(maolivera): Even if is good that each file has it unique functionality,
-// it may be beneficial to write each piece into disk and not hold the whole
-// downloaded file, maybe this allows to "pause" downloads
+// KeepAliveInterval is how often a keep-alive is sent, peers drop connections
+// silent for two minutes.
+const KeepAliveInterval = 90 * time.Second
+
+// how often pieces that no connected peer has are logged
+const MissingReportInterval = 30 * time.Second
 
 type pieceWork struct {
 	id      int
 	attempt int
 	length  int
+	// single makes a single peer download every block, see picker.blame
+	single bool
 }
 
-type pieceResult struct {
-	id         int
-	length     int
-	data       *[]byte
-	successful bool
+// DownloadOptions configures a download
+type DownloadOptions struct {
+	// MaxConnections is the maximum amount of peers connected at once
+	MaxConnections int
+	// Seed keeps uploading after the download completes, until the context
+	// is cancelled
+	Seed bool
+	// Port is where peers can connect to us, DefaultPort when 0. It is not
+	// used when Listener is set.
+	Port int
+	// Listener is shared by several downloads, they all accept peers on its
+	// port. When nil, the download listens on Port by itself.
+	Listener *Listener
+	// UploadSlots is the amount of peers we upload to at once (besides the
+	// optimistic unchoke), DefaultUploadSlots when 0
+	UploadSlots int
+	// Peers are connected to besides the ones from the trackers, e.g. the
+	// peers of a magnet link. With them, the download goes on when no tracker
+	// answers.
+	Peers []string
+	// DHT finds more peers, the torrent is announced to it during the whole
+	// download. With it, torrents without trackers can be downloaded. It is
+	// not closed when the download ends, so several downloads can share it.
+	// Private torrents don't use it.
+	DHT *dhtlib.DHT
 }
 
-func (torrent *Torrent) Download(desiredConnections int) ([]byte, error) {
-	fileBuffer := make([]byte, torrent.Length)
+type pieceResult struct {
+	id     int
+	length int
+	data   *[]byte
+}
 
+// Download downloads the whole torrent into output. Each verified piece is
+// written to disk as soon as it arrives, so the file is never held in memory.
+//
+// For single-file torrents output is the path of the file, for multi-file
+// torrents output is the directory where the torrent directory is created.
+//
+// Peers are obtained from the trackers (and the DHT, see opts.DHT), which are
+// announced to during the whole download. Cancelling ctx stops the download.
+//
+// Blocks requested by connected peers are uploaded while downloading. With
+// opts.Seed, the torrent keeps being uploaded once complete until ctx is done.
+func (torrent *Torrent) Download(ctx context.Context, output string, opts DownloadOptions) error {
 	startTime := time.Now()
 	slog.Info("starting to download file", "totalPieces", torrent.TotalPieces, "length", torrent.Length)
 
-	// Set number of connections to distinct Peers
-
-	var possibleConnections int
-	if len(torrent.Peers) < desiredConnections {
-		possibleConnections = len(torrent.Peers)
-	} else {
-		possibleConnections = desiredConnections
+	storage, err := torrent.newStorage(output)
+	if err != nil {
+		return err
 	}
+	defer storage.Close()
 
-	// Get actual Peers
-	var peers []*peerlib.Peer
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
 
-	for _, peerStr := range torrent.Peers {
-		// Check if we want to connect to another peer
-		if len(peers) > possibleConnections {
-			break
-		}
+	s := newSession(torrent, storage, opts.MaxConnections, opts.UploadSlots)
+	// private torrents only get peers from their trackers (BEP 27)
+	if !torrent.Private {
+		s.dht = opts.DHT
+	}
 
-		peer, err := peerlib.New(peerStr, torrent.InfoHash)
+	// Accept peers
+	port := opts.Port
+	if port == 0 {
+		port = DefaultPort
+	}
+	listener := opts.Listener
+	if listener == nil {
+		listener, err = Listen(port)
 		if err != nil {
-			slog.Warn("could not connect to peer", "peer", peerStr, "error", err)
-			continue
+			// we can still download connecting to peers ourselves
+			slog.Warn("could not listen for incoming peers", "port", port, "error", err)
+		} else {
+			defer listener.Close()
 		}
-		peers = append(peers, peer)
 	}
-
-	actualConnections := len(peers)
-
-	// If we don't have any peer
-	if actualConnections < 1 {
-		err := fmt.Errorf("couldn't connect to any peer")
-		return nil, err
+	if listener != nil {
+		listener.register(ctx, s)
+		port = listener.Port()
+		s.extensions.Port = port
 	}
 
-	// Set worker pool for downloading pieces
-	piecesChannel := make(chan *pieceWork, torrent.TotalPieces)
-	resultsChannel := make(chan *pieceResult, torrent.TotalPieces)
-
-	for w := 0; w < actualConnections; w++ {
-		go torrent.downloadPieceWorker(w+1, peers[w], piecesChannel, resultsChannel)
+	// Announce and keep announcing until we are done
+	tracker := trackerlib.NewClient(torrent.trackerTiers(), torrent.announceRequest(port), s.stats)
+	peers, err := tracker.Start()
+	if err != nil {
+		if len(opts.Peers) == 0 && s.dht == nil {
+			return err
+		}
+		slog.Warn("could not announce, using the known peers and the dht", "peers", len(opts.Peers), "dht", s.dht != nil, "error", err)
+	}
+	torrent.Peers = slices.Concat(peers, opts.Peers)
+	s.newPeers <- torrent.Peers
+
+	trackerDone := make(chan struct{})
+	go func() {
+		defer close(trackerDone)
+		tracker.Run(ctx, s.newPeers)
+	}()
+	// this runs before the deferred cancel, so the stopped event is sent before
+	// returning
+	defer func() {
+		cancel()
+		<-trackerDone
+	}()
+
+	go s.connectPeers(ctx)
+	go s.runChoker(ctx)
+	if !torrent.Private {
+		go s.runPex(ctx)
+	}
+	if s.dht != nil {
+		go s.runDHT(ctx, s.dht, port)
 	}
 
 	for p := 0; p < torrent.TotalPieces; p++ {
-		length := torrent.PieceLength
-		// last piece can be of smaller
-		if p == torrent.TotalPieces-1 && torrent.Length%torrent.PieceLength != 0 {
-			length = torrent.Length % torrent.PieceLength
-		}
-
-		piecesChannel <- &pieceWork{
-			id:      p,
-			attempt: 1,
-			length:  length,
-		}
+		s.picker.want(p)
 	}
 
 	// Collect results
 
-	// TODO(maolivera): Dive deep into what would happen with others gouroutines
-	// if we break before receiving all pieces, closing the channel, and returning.
-	// Maybe the garbage collector will just take care of it? if that's the case,
-	// is there any way of improving this?
+	missingReport := time.NewTicker(MissingReportInterval)
+	defer missingReport.Stop()
 
-	var err error
-	for r := 0; r < torrent.TotalPieces; r++ {
-		res := <-resultsChannel
-		if !res.successful {
-			err = fmt.Errorf("couldn't download file")
-			break
+	for r := 0; r < torrent.TotalPieces; {
+		var res *pieceResult
+		select {
+		case res = <-s.results:
+		case <-missingReport.C:
+			if missing := s.picker.missing(); len(missing) > 0 {
+				slog.Warn("pieces not available from any connected peer", "total", len(missing), "pieces", missing)
+			}
+			continue
+		case <-ctx.Done():
+			return ctx.Err()
 		}
-		copy(fileBuffer[res.id * torrent.PieceLength:], *res.data)
-	}
-	close(piecesChannel)
+		r++
 
-	// if some piece was not succesful downloaded
-	if err != nil {
-		return nil, err
+		offset := int64(res.id) * int64(torrent.PieceLength)
+		if _, err = storage.WriteAt(*res.data, offset); err != nil {
+			return fmt.Errorf("error writing piece %d to disk: %v", res.id, err)
+		}
+		s.verified.Add(int64(len(*res.data)))
+		s.picker.done(res.id)
+		s.markHave(res.id)
+		slog.Debug("piece written to disk", "pieceID", res.id, "offset", offset)
 	}
 
+	tracker.Completed()
+
 	totalTime := time.Since(startTime)
 	slog.Info("successfully get file", "totalPieces", torrent.TotalPieces, "totalTime", totalTime)
 
-	return fileBuffer, nil
+	if opts.Seed {
+		slog.Info("seeding until interrupted")
+		<-ctx.Done()
+		slog.Info("stopped seeding", "uploaded", s.uploaded.Load())
+	}
+
+	return nil
 }
 
-func (torrent *Torrent) downloadPieceWorker(w int, peer *peerlib.Peer, pieceChannel chan *pieceWork, resultsChannel chan *pieceResult) {
-	// send Interested message
-	peer.Send(&peerlib.Message{
-		Type:    peerlib.Interested,
-		Payload: nil,
-	})
-
-	// wait for Unchoke msg
-	for peer.Choked {
-		slog.Debug("waiting for peer response", "workerID", w, "peer", peer.Peer)
-		msg, err := peer.Read()
-		if err != nil {
-			slog.Error("worker error during piece download", "workerID", w, "error", err)
-			return
+// pieceSize returns the length of a piece, the last one can be smaller
+func (torrent *Torrent) pieceSize(pieceID int) int {
+	if pieceID == torrent.TotalPieces-1 && torrent.Length%torrent.PieceLength != 0 {
+		return torrent.Length % torrent.PieceLength
+	}
+	return torrent.PieceLength
+}
+
+func (torrent *Torrent) newStorage(output string) (*Storage, error) {
+	if torrent.MultiFile {
+		if output == "" {
+			output = "."
 		}
-		slog.Debug("got response from peer", "workerID", w, "peer", peer.Peer, "messageType", msg.Type.String())
+		return NewStorage(output, torrent.Files)
+	}
 
-		switch msg.Type {
-		case peerlib.Choke:
-			peer.Choked = true
-			continue
-		case peerlib.Unchoke:
-			peer.Choked = false
-			break
-		default:
-			err := fmt.Errorf("non-expected type of message while waiting for Unchoke, type received %d %s", msg.Type, msg.Type.String())
-			slog.Error("worker error during piece download", "workerID", w, "error", err)
+	if output == "" {
+		output = torrent.Name
+	}
+	file := File{
+		Path:   filepath.Base(output),
+		Length: torrent.Length,
+		Offset: 0,
+	}
+	return NewStorage(filepath.Dir(output), []File{file})
+}
+
+// downloadPieceWorker downloads blocks of the pieces handed by s.picker using
+// a single peer until ctx is done or the connection fails. Blocks of one piece
+// can come from several peers, each piece is checked by the worker that
+// receives its last block. Requests that were not answered are forgotten, so
+// other workers can request those blocks.
+//
+// Messages from the peer are handled while waiting for pieces too, so requests
+// of the peer are served even when we have nothing left to download.
+func (s *session) downloadPieceWorker(ctx context.Context, w int, peer *peerlib.Peer) {
+	s.addPeer(peer)
+	defer s.removePeer(peer)
+
+	// the peer is added before sending the bitfield, so a piece verified
+	// meanwhile is announced with a have message
+	if err := s.sendBitfield(peer); err != nil {
+		slog.Error("error while sending bitfield", "workerID", w, "peer", peer.Peer, "error", err)
+		return
+	}
+	if err := s.extensions.SendHandshake(peer); err != nil {
+		slog.Error("error while sending extension handshake", "workerID", w, "peer", peer.Peer, "error", err)
+		return
+	}
+	if s.dht != nil && peer.Capabilities.Has(peerlib.CapabilityDHT) {
+		if err := peer.Send(peerlib.FormatPort(s.dht.Addr().Port)); err != nil {
+			slog.Error("error while sending port", "workerID", w, "peer", peer.Peer, "error", err)
 			return
 		}
 	}
 
-pieceLoop:
-	for piece := range pieceChannel {
-		if piece.attempt > MaxRetries {
-			err := fmt.Errorf("ran out of download attempts")
-			slog.Error("couldn't download piece", "error", err)
-			// NOTE(maolivera): Return unsuccessful piece, so results channel do not block
-			resultsChannel <- &pieceResult{
-				id:         piece.id,
-				successful: false,
-				data:       nil,
-			}
+	done := make(chan struct{})
+	defer close(done)
+	messages, readErrors := readMessages(peer, done)
+
+	// send Interested message
+	if !s.isComplete() {
+		if err := peer.Send(&peerlib.Message{Type: peerlib.Interested, Payload: nil}); err != nil {
+			slog.Error("error while sending interested", "workerID", w, "peer", peer.Peer, "error", err)
+			return
 		}
-		slog.Debug("trying to download piece", "workerID", w, "peer", peer.Peer, "pieceID", piece.id)
+	}
 
-		if !peer.HasPiece(piece.id) {
-			// TODO(maolivera): What happens if all peer are missing current piece?
-			slog.Debug("peer does not has piece", "workerID", w, "peer", peer.Peer, "pieceID", piece.id)
-			pieceChannel <- piece
-			continue pieceLoop
+	// the pieces of the peer count for the picker while it is connected
+	s.picker.addBitfield(peer.Bitfield)
+	defer func() { s.picker.removeBitfield(peer.Bitfield) }()
+
+	// requests are the blocks requested to the peer, by piece
+	requests := make(map[*pieceDownload]map[int]bool)
+	pipeline := peerlib.NewPipeline()
+	forgetRequests := func() {
+		for piece, pending := range requests {
+			piece.forget(peer, pending)
+			delete(requests, piece)
 		}
+		pipeline.Forget()
+		s.picker.release(peer)
+		s.picker.blocksFreed()
+	}
+	defer forgetRequests()
 
-		// TODO(maolivera): Research if there is a way of concurrently
-		// download blocks from a single peer
+	keepAlive := time.NewTicker(KeepAliveInterval)
+	defer keepAlive.Stop()
+	dhtPinged := false
 
-		totalBlocks := piece.length / BlockSize
-		if piece.length%BlockSize != 0 {
-			totalBlocks++
+	for {
+		// the channel is taken before picking, so a piece that becomes
+		// available meanwhile wakes us up
+		pickerChanged := s.picker.changed()
+		if err := s.fillRequests(w, peer, pipeline, requests); err != nil {
+			return
 		}
 
-		// DOWNLOAD BLOCKS
-
-		pieceBuffer := make([]byte, piece.length)
-		pendingRequests := 0
-		block := 0
-		blocksDownloaded := 0
-
-		for blocksDownloaded < totalBlocks {
-			if !peer.Choked {
-				// NOTE(maolivera): To improve download speeds, you can consider
-				// pipelining your requests. BitTorrent Economics Paper recommends
-				// having 5 requests pending at once, to avoid a delay between blocks
-				// being sent
-				for pendingRequests < MaxPendingRequests && block < totalBlocks {
-					// Calculate block size
-					actualBlockSize := BlockSize
-					// last block can be smaller
-					if block == totalBlocks-1 && piece.length%BlockSize != 0 {
-						actualBlockSize = piece.length % BlockSize
-					}
-					// - index (u32): zero-based piece index
-					// - begin (u32): zero-based byte offset wihtin the piece
-					// - length (u32): length of the block in bytes (16kB for all block except last)
-					index := uint32(piece.id)
-					begin := uint32(block * BlockSize)
-					length := uint32(actualBlockSize)
-
-					payload := make([]byte, 12)
-
-					binary.BigEndian.PutUint32(payload[:4], index)
-					binary.BigEndian.PutUint32(payload[4:8], begin)
-					binary.BigEndian.PutUint32(payload[8:12], length)
-
-					msg := peerlib.Message{
-						Type:    peerlib.Request,
-						Payload: payload,
-					}
-					if err := peer.Send(&msg); err != nil {
-						slog.Error("error while requesting block", "workerID", w, "pieceID", piece.id, "blockID", block)
-						piece.attempt++
-						pieceChannel <- piece
-						continue pieceLoop
-					}
+		select {
+		case <-ctx.Done():
+			return
 
-					pendingRequests++
-					block++
+		case err := <-readErrors:
+			slog.Error("error while reading message from peer", "workerID", w, "peer", peer.Peer, "error", err)
+			return
 
-					slog.Debug("sent a block request", "workerID", w, "pieceID", piece.id, slog.Group("payload", "index", index, "begin", begin, "length", length))
-				}
+		case <-keepAlive.C:
+			if err := peer.Send(&peerlib.Message{Type: peerlib.KeepAlive, Payload: nil}); err != nil {
+				slog.Error("error while sending keep-alive", "workerID", w, "peer", peer.Peer, "error", err)
+				return
 			}
 
-			msg, err := peer.Read()
-			if err != nil {
-				slog.Error("error while reading message from peer", "error", err)
-				piece.attempt++
-				pieceChannel <- piece
-				continue pieceLoop
-			}
-			if msg == nil { // keep-alive
-				continue
-			}
+		case <-pickerChanged:
+
+		case msg := <-messages:
 			switch msg.Type {
+			case peerlib.KeepAlive:
+
 			case peerlib.Choke:
 				peer.Choked = true
+				forgetRequests()
+
 			case peerlib.Unchoke:
 				peer.Choked = false
-			case peerlib.Piece:
-				// - index (u32): zero-based piece index
-				// - begin (u32): zero-based byte offset within the piece
-				// - block (variable): data for the piece
-				index := binary.BigEndian.Uint32(msg.Payload[0:4])
-				begin := binary.BigEndian.Uint32(msg.Payload[4:8])
-				blockID := begin / BlockSize
-				blockData := msg.Payload[8:]
-
-				// validate len
-
-				if index != uint32(piece.id) {
-					slog.Error("block from different piece", "workerID", w, "requestedPieceID", piece.id, "receivedPieceID", index)
-					piece.attempt++
-					pieceChannel <- piece
-					peer.Conn.Close()
-					continue pieceLoop
+
+			case peerlib.Interested:
+				peer.Interested.Store(true)
+				s.rechoke()
+
+			case peerlib.NotInterested:
+				peer.Interested.Store(false)
+				s.rechoke()
+
+			case peerlib.Have:
+				pieceID, err := peerlib.ParseHave(msg)
+				if err == nil && pieceID >= s.torrent.TotalPieces {
+					err = fmt.Errorf("piece %d out of range, torrent has %d pieces", pieceID, s.torrent.TotalPieces)
+				}
+				if err != nil {
+					slog.Error("invalid have", "workerID", w, "peer", peer.Peer, "error", err)
+					return
+				}
+				if !peer.HasPiece(pieceID) {
+					peer.SetPiece(pieceID)
+					s.picker.addPiece(pieceID)
+				}
+				slog.Debug("peer has a new piece", "workerID", w, "peer", peer.Peer, "pieceID", pieceID)
+
+			case peerlib.Bitfield:
+				// the bitfield should be the first message, but it is read here
+				// so peers that send it late (or never, when they have no
+				// pieces) still work
+				bitfield, err := peerlib.ParseBitfield(msg, s.torrent.TotalPieces)
+				if err != nil {
+					slog.Error("invalid bitfield", "workerID", w, "peer", peer.Peer, "error", err)
+					return
+				}
+				s.picker.removeBitfield(peer.Bitfield)
+				peer.Bitfield = bitfield
+				s.picker.addBitfield(peer.Bitfield)
+
+			case peerlib.Request:
+				if err := s.serveRequest(peer, msg); err != nil {
+					slog.Error("error while serving request", "workerID", w, "peer", peer.Peer, "error", err)
+					return
 				}
 
-				if len(blockData) > BlockSize { // if block larger disconnect
-					slog.Error("peer send larger block size", "expected", BlockSize, "actual", len(blockData))
-					piece.attempt++
-					pieceChannel <- piece
-					peer.Conn.Close()
-					continue pieceLoop
+			case peerlib.Cancel:
+				// requests are answered as soon as they arrive, so there is
+				// nothing left to cancel
+
+			case peerlib.Extended:
+				handshake, err := s.extensions.Handle(peer, msg)
+				if err != nil {
+					slog.Error("invalid extended message", "workerID", w, "peer", peer.Peer, "error", err)
+					return
+				}
+				if handshake != nil {
+					// later handshakes may leave reqq out, the limit is kept
+					// then
+					if handshake.Reqq > 0 {
+						pipeline.SetLimit(handshake.Reqq)
+					}
+					slog.Debug("extension handshake", "workerID", w, "peer", peer.Peer, "client", handshake.V, "extensions", handshake.M, "reqq", handshake.Reqq)
 				}
-				// TODO(maoliera): Maybe check if block fits in piece buffer
-				// TODO(maoliera): Maybe check if last piece has correct length
-				startIndex := int(begin)
-				endIndex := startIndex + len(blockData)
 
-				copy(pieceBuffer[startIndex:endIndex], blockData)
-				pendingRequests--
-				blocksDownloaded++
-				slog.Debug("block downloaded", "workerID", w, "pieceID", piece.id, "blockID", blockID)
+			case peerlib.Port:
+				// a peer could send many, its node is pinged only once
+				if s.dht != nil && !dhtPinged {
+					port, err := peerlib.ParsePort(msg)
+					if err != nil {
+						slog.Error("invalid port message", "workerID", w, "peer", peer.Peer, "error", err)
+						return
+					}
+					dhtPinged = true
+					go s.pingDHTNode(ctx, peer, port)
+				}
+
+			case peerlib.Piece:
+				if err := s.receiveBlock(ctx, w, peer, pipeline, requests, msg); err != nil {
+					slog.Error("invalid block", "workerID", w, "peer", peer.Peer, "error", err)
+					return
+				}
 
 			default:
-				slog.Error("unexpected type message while requesting blocks", "messageType", msg.Type.String())
-				piece.attempt++
-				pieceChannel <- piece
-				continue pieceLoop
+				// unknown messages must be ignored, they may belong to
+				// extensions we don't support
+				slog.Debug("ignoring message", "workerID", w, "peer", peer.Peer, "messageType", msg.Type.String(), "messageTypeID", int(msg.Type))
+			}
+		}
+	}
+}
+
+// readMessages reads messages from the peer until the connection fails or done
+// is closed
+func readMessages(peer *peerlib.Peer, done <-chan struct{}) (<-chan *peerlib.Message, <-chan error) {
+	messages := make(chan *peerlib.Message)
+	readErrors := make(chan error, 1)
+
+	go func() {
+		for {
+			msg, err := peer.Read()
+			if err != nil {
+				readErrors <- err
+				return
+			}
+
+			select {
+			case messages <- msg:
+			case <-done:
+				return
 			}
 		}
+	}()
+
+	return messages, readErrors
+}
+
+// fillRequests requests blocks until the peer has as many pending as the
+// depth of its pipeline. Blocks of the pieces already requested to the peer go
+// first, then the picker hands out other pieces.
+func (s *session) fillRequests(w int, peer *peerlib.Peer, pipeline *peerlib.Pipeline, requests map[*pieceDownload]map[int]bool) error {
+	if peer.Choked {
+		return nil
+	}
+
+	totalPending := 0
+	for piece, pending := range requests {
+		pruned, unfinished := piece.prune(pending)
+		for _, block := range pruned {
+			pipeline.Cancelled(pipelineBlock(piece, block))
+		}
+		if !unfinished || len(pending) == 0 {
+			for block := range pending {
+				pipeline.Cancelled(pipelineBlock(piece, block))
+			}
+			piece.forget(peer, pending)
+			delete(requests, piece)
+			continue
+		}
+		totalPending += len(pending)
+	}
+
+	// requests are pipelined to avoid a delay between blocks being sent, see
+	// peerlib.Pipeline
+	depth := pipeline.Depth()
+	endgame := s.picker.isEndgame()
+	for piece, pending := range requests {
+		if totalPending >= depth {
+			break
+		}
+		blocks := piece.nextBlocks(peer, pending, depth-totalPending, endgame)
+		if err := requestBlocks(w, peer, pipeline, piece, blocks); err != nil {
+			return err
+		}
+		totalPending += len(blocks)
+	}
+
+	held := func(piece *pieceDownload) bool {
+		_, ok := requests[piece]
+		return ok
+	}
+	for totalPending < depth {
+		piece := s.picker.pick(peer, held)
+		if piece == nil {
+			break
+		}
+
+		pending := make(map[int]bool)
+		blocks := piece.nextBlocks(peer, pending, depth-totalPending, s.picker.isEndgame())
+		if len(blocks) == 0 {
+			// another worker took the blocks meanwhile
+			break
+		}
+		requests[piece] = pending
+		slog.Debug("downloading piece", "workerID", w, "peer", peer.Peer, "pieceID", piece.work.id, "attempt", piece.work.attempt)
+
+		if err := requestBlocks(w, peer, pipeline, piece, blocks); err != nil {
+			return err
+		}
+		totalPending += len(blocks)
+	}
 
-		// CHECK HASH
+	return nil
+}
 
-		expectedHash := torrent.PiecesHash[piece.id]
-		h := sha1.New()
-		if _, err := h.Write(pieceBuffer); err != nil {
-			slog.Error("error while trying to calculate hash of downloaded piece", "workerID", w, "pieceID", piece.id, "error", err)
-			piece.attempt++
-			pieceChannel <- piece
-			continue pieceLoop
+func requestBlocks(w int, peer *peerlib.Peer, pipeline *peerlib.Pipeline, piece *pieceDownload, blocks []int) error {
+	for _, block := range blocks {
+		index := piece.work.id
+		begin := block * BlockSize
+		length := piece.blockLength(block)
+
+		if err := peer.Send(peerlib.FormatRequest(index, begin, length)); err != nil {
+			slog.Error("error while requesting block", "workerID", w, "pieceID", piece.work.id, "blockID", block, "error", err)
+			return err
 		}
-		actualHash := h.Sum(nil)
-
-		if !bytes.Equal(expectedHash, actualHash) {
-			expectedHashStr := fmt.Sprintf("%x", expectedHash)
-			actualHashStr := fmt.Sprintf("%x", actualHash)
-			slog.Error("downloaded piece hash do not match", "workerID", w, "pieceID", piece.id, "expectedHash", expectedHashStr, "actualHash", actualHashStr)
-			piece.attempt++
-			pieceChannel <- piece
-			continue pieceLoop
+		pipeline.Requested(pipelineBlock(piece, block), time.Now())
+
+		slog.Debug("sent a block request", "workerID", w, "pieceID", piece.work.id, slog.Group("payload", "index", index, "begin", begin, "length", length))
+	}
+
+	return nil
+}
+
+func pipelineBlock(piece *pieceDownload, block int) peerlib.Block {
+	return peerlib.Block{Index: piece.work.id, Begin: block * BlockSize}
+}
+
+// receiveBlock copies a block into the buffer of its piece and cancels the
+// requests of the same block to other peers. It fails if the block is not
+// valid, blocks of pieces not requested to the peer are ignored. The worker
+// that receives the last block of a piece checks it.
+func (s *session) receiveBlock(ctx context.Context, w int, peer *peerlib.Peer, pipeline *peerlib.Pipeline, requests map[*pieceDownload]map[int]bool, msg *peerlib.Message) error {
+	index, begin, blockData, err := peerlib.ParsePiece(msg)
+	if err != nil {
+		return err
+	}
+
+	var piece *pieceDownload
+	for p := range requests {
+		if p.work.id == index {
+			piece = p
+			break
 		}
+	}
+	if piece == nil {
+		// it may be a block cancelled too late
+		slog.Debug("ignoring block not requested", "workerID", w, "peer", peer.Peer, "pieceID", index, "begin", begin)
+		return nil
+	}
+
+	cancels, complete, err := piece.receive(peer, requests[piece], begin, blockData)
+	if err != nil {
+		return err
+	}
+	s.downloaded.Add(int64(len(blockData)))
+	peer.Downloaded.Add(int64(len(blockData)))
+	slog.Debug("block downloaded", "workerID", w, "pieceID", piece.work.id, "blockID", begin/BlockSize)
 
-		pieceRes := pieceResult{
-			id:         piece.id,
-			data:       &pieceBuffer,
-			successful: true,
+	if pipeline.Received(peerlib.Block{Index: index, Begin: begin}, len(blockData), time.Now()) {
+		slog.Debug("pipeline depth changed", "workerID", w, "peer", peer.Peer, "depth", pipeline.Depth(), "rate", int(pipeline.Rate()), "rtt", pipeline.RTT())
+	}
+
+	for _, other := range cancels {
+		slog.Debug("cancelling block request", "workerID", w, "peer", other.Peer, "pieceID", index, "begin", begin)
+		if err := other.Send(peerlib.FormatCancel(index, begin, len(blockData))); err != nil {
+			// without the cancel the block may still come, it is ignored then
+			slog.Debug("could not send cancel", "peer", other.Peer, "error", err)
 		}
+	}
 
-		resultsChannel <- &pieceRes
+	if complete {
+		// the blocks still pending were received from other peers
+		for block := range requests[piece] {
+			pipeline.Cancelled(pipelineBlock(piece, block))
+		}
+		delete(requests, piece)
+		s.finishPiece(ctx, w, piece)
 	}
+
+	return nil
+}
+
+// finishPiece checks the hash of a downloaded piece and sends it to the
+// results, pieces that do not match are put back
+func (s *session) finishPiece(ctx context.Context, w int, piece *pieceDownload) {
+	// CHECK HASH
+
+	expectedHash := s.torrent.PiecesHash[piece.work.id]
+	actualHash := sha1.Sum(piece.buffer)
+
+	if !bytes.Equal(expectedHash, actualHash[:]) {
+		expectedHashStr := fmt.Sprintf("%x", expectedHash)
+		actualHashStr := fmt.Sprintf("%x", actualHash)
+		slog.Error("downloaded piece hash do not match", "workerID", w, "pieceID", piece.work.id, "expectedHash", expectedHashStr, "actualHash", actualHashStr)
+		// there is no limit of attempts, the peers that sent the piece lose
+		// trust until they are banned
+		shared := s.pieceFailed(piece)
+		s.picker.blame(piece, shared)
+		s.picker.complete(piece, false)
+		return
+	}
+
+	s.piecePassed(piece)
+	s.picker.complete(piece, true)
+	pieceRes := pieceResult{
+		id:   piece.work.id,
+		data: &piece.buffer,
+	}
+
+	s.sendResult(ctx, &pieceRes)
 }
 
 // This is just a (probably inefficient) wrapper in order to pass CodeCrafters challange step
@@ -342,36 +627,34 @@ func (torrent *Torrent) DownloadPiece(pieceNumber int) ([]byte, error) {
 		break
 	}
 
-	length := torrent.PieceLength
-	// last piece can be smaller
-	if pieceNumber == torrent.TotalPieces-1 && torrent.Length%torrent.PieceLength != 0 {
-		length = torrent.Length % torrent.PieceLength
+	if peer == nil {
+		return nil, fmt.Errorf("couldn't connect to any peer")
 	}
+	defer peer.Conn.Close()
+
+	length := torrent.pieceSize(pieceNumber)
 
 	startTime := time.Now()
 	slog.Info("starting to download piece", "piece", pieceNumber, "length", length)
 
 	// Set worker pool for downloading pieces
-	piecesChannel := make(chan *pieceWork, 1)
-	resultsChannel := make(chan *pieceResult, 1)
-
-	go torrent.downloadPieceWorker(1, peer, piecesChannel, resultsChannel)
-
-	piecesChannel <- &pieceWork{
-		id:      pieceNumber,
-		attempt: 1,
-		length:  length,
-	}
-
-	res := <-resultsChannel
-	if !res.successful {
-		err = fmt.Errorf("couldn't download file, check logs")
-	}
-	close(piecesChannel)
-
-	// if some piece was not succesful downloaded
-	if err != nil {
-		return nil, err
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	s := newSession(torrent, nil, 1, 0)
+	workerDone := make(chan struct{})
+	go func() {
+		defer close(workerDone)
+		s.downloadPieceWorker(ctx, 1, peer)
+	}()
+
+	s.picker.want(pieceNumber)
+
+	var res *pieceResult
+	select {
+	case res = <-s.results:
+	case <-workerDone:
+		return nil, fmt.Errorf("connection with peer %s lost, check logs", peer.Peer)
 	}
 
 	totalTime := time.Since(startTime)
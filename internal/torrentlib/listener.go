@@ -0,0 +1,131 @@
+package torrentlib
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/codecrafters-io/bittorrent-starter-go/internal/torrentlib/peerlib"
+)
+
+// a peer that connects must send its handshake in time
+const handshakeTimeout = 10 * time.Second
+
+// Listener accepts connections of remote peers. Several torrents can be
+// downloaded with the same listener, each connection is handed to the
+// download of the info hash in its handshake.
+type Listener struct {
+	listener net.Listener
+
+	mu       sync.Mutex
+	sessions map[[20]byte]*listenerSession
+}
+
+type listenerSession struct {
+	ctx     context.Context
+	session *session
+}
+
+// Listen starts accepting peers on port, on every interface. With port 0 a
+// free port is chosen, see Port.
+func Listen(port int) (*Listener, error) {
+	listener, err := net.Listen("tcp", net.JoinHostPort("", strconv.Itoa(port)))
+	if err != nil {
+		return nil, fmt.Errorf("error listening on port %d: %v", port, err)
+	}
+
+	l := &Listener{
+		listener: listener,
+		sessions: make(map[[20]byte]*listenerSession),
+	}
+	go l.serve()
+
+	slog.Info("listening for peers", "address", listener.Addr().String())
+	return l, nil
+}
+
+// Port returns the port where peers can connect
+func (l *Listener) Port() int {
+	return l.listener.Addr().(*net.TCPAddr).Port
+}
+
+// Close stops accepting peers, connected peers are not affected
+func (l *Listener) Close() error {
+	return l.listener.Close()
+}
+
+func (l *Listener) serve() {
+	for {
+		conn, err := l.listener.Accept()
+		if errors.Is(err, net.ErrClosed) {
+			return
+		}
+		if err != nil {
+			slog.Warn("error accepting peer", "error", err)
+			continue
+		}
+
+		go l.handle(conn)
+	}
+}
+
+// handle completes the handshake of a connection and hands it to the session
+// of its torrent
+func (l *Listener) handle(conn net.Conn) {
+	conn.SetDeadline(time.Now().Add(handshakeTimeout))
+	peer, err := peerlib.Accept(conn, func(infoHash [20]byte) (peerlib.Capabilities, bool) {
+		entry := l.lookup(infoHash)
+		if entry == nil {
+			return peerlib.Capabilities{}, false
+		}
+		return entry.session.capabilities(), true
+	})
+	if err != nil {
+		slog.Debug("rejected incoming peer", "peer", conn.RemoteAddr().String(), "error", err)
+		conn.Close()
+		return
+	}
+	conn.SetDeadline(time.Time{})
+
+	// the download may have finished during the handshake
+	entry := l.lookup(peer.InfoHash())
+	if entry == nil {
+		conn.Close()
+		return
+	}
+
+	select {
+	case entry.session.inbound <- peer:
+		slog.Info("accepted incoming peer", "peer", peer.Peer)
+	case <-entry.ctx.Done():
+		conn.Close()
+	}
+}
+
+func (l *Listener) lookup(infoHash [20]byte) *listenerSession {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.sessions[infoHash]
+}
+
+// register hands incoming peers of the torrent of s to s until ctx is done
+func (l *Listener) register(ctx context.Context, s *session) {
+	infoHash := [20]byte(s.torrent.InfoHash)
+
+	l.mu.Lock()
+	l.sessions[infoHash] = &listenerSession{ctx: ctx, session: s}
+	l.mu.Unlock()
+
+	context.AfterFunc(ctx, func() {
+		l.mu.Lock()
+		defer l.mu.Unlock()
+		if entry, ok := l.sessions[infoHash]; ok && entry.session == s {
+			delete(l.sessions, infoHash)
+		}
+	})
+}
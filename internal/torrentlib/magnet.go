@@ -0,0 +1,273 @@
+package torrentlib
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/base32"
+	"encoding/hex"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/codecrafters-io/bittorrent-starter-go/internal/torrentlib/dhtlib"
+	"github.com/codecrafters-io/bittorrent-starter-go/internal/torrentlib/peerlib"
+	"github.com/codecrafters-io/bittorrent-starter-go/internal/torrentlib/trackerlib"
+)
+
+// MetadataPeerTimeout is how long a peer has to send the info dictionary of a
+// magnet link, before we try another one
+const MetadataPeerTimeout = 30 * time.Second
+
+// Magnet is a magnet link, it identifies a torrent by its info hash. The info
+// dictionary is downloaded from peers, see FetchTorrent.
+//
+// TODO: web seeds (BEP 19) are parsed but not downloaded from
+type Magnet struct {
+	InfoHash [20]byte
+	// Name is the display name (dn), only meant for the user
+	Name string
+	// Trackers are the tr parameters, in order
+	Trackers []string
+	// Peers are the x.pe parameters, addresses of peers to connect to
+	Peers []string
+	// WebSeeds are the ws parameters
+	WebSeeds []string
+}
+
+// IsMagnet returns true if s looks like a magnet link rather than a file
+func IsMagnet(s string) bool {
+	return strings.HasPrefix(s, "magnet:")
+}
+
+// ParseMagnet parses a magnet link, the info hash (xt=urn:btih:) can be hex
+// (40 characters) or base32 (32 characters) encoded
+func ParseMagnet(uri string) (*Magnet, error) {
+	u, err := url.Parse(uri)
+	if err != nil {
+		return nil, fmt.Errorf("error parsing magnet link: %v", err)
+	}
+	if u.Scheme != "magnet" {
+		return nil, fmt.Errorf("expected magnet link but got scheme %q", u.Scheme)
+	}
+	query, err := url.ParseQuery(u.RawQuery)
+	if err != nil {
+		return nil, fmt.Errorf("error parsing magnet link parameters: %v", err)
+	}
+
+	var magnet Magnet
+	found := false
+	for _, xt := range query["xt"] {
+		hash, ok := strings.CutPrefix(xt, "urn:btih:")
+		if !ok {
+			// other topics (e.g. urn:btmh: of v2 torrents) are not supported
+			continue
+		}
+		if magnet.InfoHash, err = parseInfoHash(hash); err != nil {
+			return nil, err
+		}
+		found = true
+		break
+	}
+	if !found {
+		return nil, fmt.Errorf("magnet link has no urn:btih: exact topic")
+	}
+
+	magnet.Name = query.Get("dn")
+	magnet.Trackers = query["tr"]
+	magnet.WebSeeds = query["ws"]
+	for _, peer := range query["x.pe"] {
+		if _, _, err := net.SplitHostPort(peer); err != nil {
+			return nil, fmt.Errorf("invalid peer address %q: %v", peer, err)
+		}
+		magnet.Peers = append(magnet.Peers, peer)
+	}
+
+	return &magnet, nil
+}
+
+func parseInfoHash(hash string) ([20]byte, error) {
+	var infoHash [20]byte
+	var decoded []byte
+	var err error
+	switch len(hash) {
+	case 40:
+		decoded, err = hex.DecodeString(hash)
+	case 32:
+		decoded, err = base32.StdEncoding.DecodeString(strings.ToUpper(hash))
+	default:
+		return infoHash, fmt.Errorf("info hash %q must be 40 hex or 32 base32 characters", hash)
+	}
+	if err != nil {
+		return infoHash, fmt.Errorf("invalid info hash %q: %v", hash, err)
+	}
+	copy(infoHash[:], decoded)
+	return infoHash, nil
+}
+
+// announceList puts each tracker in its own tier, so all of them are tried
+func (magnet *Magnet) announceList() [][]string {
+	announceList := make([][]string, 0, len(magnet.Trackers))
+	for _, tracker := range magnet.Trackers {
+		announceList = append(announceList, []string{tracker})
+	}
+	return announceList
+}
+
+// FetchTorrent downloads the info dictionary from the peers of the magnet
+// link, x.pe ones and the ones the trackers (and dht, when not nil) know, with
+// up to maxConnections peers at once. The torrent returned can be downloaded
+// as any other, its Peers are the ones found.
+func (magnet *Magnet) FetchTorrent(ctx context.Context, maxConnections int, dht *dhtlib.DHT) (*Torrent, error) {
+	peers := magnet.Peers
+	if len(magnet.Trackers) > 0 {
+		req := trackerlib.AnnounceRequest{
+			InfoHash: magnet.InfoHash,
+			Port:     DefaultPort,
+			IPv6:     trackerlib.LocalIPv6(),
+			// the length is not known yet, trackers may not send peers to
+			// someone with nothing left
+			Left: 1,
+		}
+		if _, err := rand.Read(req.PeerID[:]); err != nil {
+			return nil, fmt.Errorf("error generating peer_id: %v", err)
+		}
+
+		res, err := trackerlib.NewTiers(magnet.announceList()).Announce(&req)
+		if err != nil {
+			if len(peers) == 0 && dht == nil {
+				return nil, err
+			}
+			slog.Warn("could not announce, using the peers of the magnet link and the dht", "error", err)
+		} else {
+			peers = append(peers, res.Peers...)
+		}
+	}
+	if dht != nil {
+		found, err := dht.GetPeers(ctx, magnet.InfoHash)
+		if err != nil {
+			slog.Warn("could not get peers from the dht", "error", err)
+		}
+		peers = append(peers, found...)
+	}
+	if len(peers) == 0 {
+		return nil, fmt.Errorf("no peers to fetch the metadata from")
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	metadata := newMetadataExtension(magnet.InfoHash, nil)
+	extensions := peerlib.NewExtensions()
+	extensions.Version = ClientVersion
+	extensions.Register("ut_metadata", metadata)
+
+	queue := make(chan string, len(peers))
+	for _, peer := range peers {
+		queue <- peer
+	}
+	close(queue)
+
+	var wg sync.WaitGroup
+	for i := 0; i < max(maxConnections, 1); i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for peerStr := range queue {
+				if ctx.Err() != nil {
+					return
+				}
+				if err := fetchMetadata(ctx, peerStr, magnet.InfoHash, extensions, metadata); err != nil {
+					slog.Warn("could not fetch metadata from peer", "peer", peerStr, "error", err)
+				}
+			}
+		}()
+	}
+	allTried := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(allTried)
+	}()
+
+	select {
+	case <-metadata.done:
+	case <-allTried:
+		// the last peer may have completed it
+		select {
+		case <-metadata.done:
+		default:
+			return nil, fmt.Errorf("no peer sent the metadata")
+		}
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+
+	data := MetaData{AnnounceList: magnet.announceList(), Info: metadata.metadata()}
+	if len(magnet.Trackers) > 0 {
+		data.Announce = magnet.Trackers[0]
+	}
+	torrent, err := New(data)
+	if err != nil {
+		return nil, err
+	}
+	torrent.Peers = peers
+	slog.Info("got metadata", "name", torrent.Name, "length", torrent.Length, "totalPieces", torrent.TotalPieces)
+
+	return torrent, nil
+}
+
+// fetchMetadata connects to a peer and reads its messages until the metadata
+// is complete, ctx is done or the peer fails
+func fetchMetadata(ctx context.Context, peerStr string, infoHash [20]byte, extensions *peerlib.Extensions, metadata *metadataExtension) error {
+	peer, err := peerlib.NewNoBitfield(peerStr, infoHash[:])
+	if err != nil {
+		return err
+	}
+	defer peer.Conn.Close()
+	stop := context.AfterFunc(ctx, func() { peer.Conn.Close() })
+	defer stop()
+
+	if !peer.Capabilities.Has(peerlib.CapabilityExtensions) {
+		return fmt.Errorf("peer does not support extensions")
+	}
+	defer metadata.remove(peer)
+	if err := extensions.SendHandshake(peer); err != nil {
+		return err
+	}
+
+	timeout := time.NewTimer(MetadataPeerTimeout)
+	defer timeout.Stop()
+
+	done := make(chan struct{})
+	defer close(done)
+	messages, readErrors := readMessages(peer, done)
+
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-metadata.done:
+			return nil
+		case <-timeout.C:
+			return fmt.Errorf("peer did not send the metadata in %v", MetadataPeerTimeout)
+		case err := <-readErrors:
+			return err
+		case msg := <-messages:
+			// we have no pieces to download yet, the other messages (bitfield,
+			// have, ...) are ignored
+			if msg.Type != peerlib.Extended {
+				continue
+			}
+			handshake, err := extensions.Handle(peer, msg)
+			if err != nil {
+				return err
+			}
+			if handshake != nil && (!peer.SupportsExtension("ut_metadata") || handshake.MetadataSize <= 0) {
+				return fmt.Errorf("peer can't send the metadata")
+			}
+		}
+	}
+}
@@ -0,0 +1,251 @@
+package torrentlib
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"fmt"
+	"log/slog"
+	"sync"
+
+	"github.com/codecrafters-io/bittorrent-starter-go/internal/encoding/bencode"
+	"github.com/codecrafters-io/bittorrent-starter-go/internal/torrentlib/peerlib"
+)
+
+// MetadataPieceSize is the length of the pieces the info dictionary is sent
+// in, the last one can be smaller (BEP 9)
+const MetadataPieceSize = 16 * 1024
+
+// MaxMetadataSize is the largest info dictionary accepted from peers, the size
+// comes from them and a huge one would make us allocate it all.
+const MaxMetadataSize = 16 * 1024 * 1024
+
+const (
+	metadataRequest = iota
+	metadataData
+	metadataReject
+)
+
+// metadataMessage is the dictionary of ut_metadata messages, data messages
+// have the piece right after it
+type metadataMessage struct {
+	MsgType   int `bencode:"msg_type"`
+	Piece     int `bencode:"piece"`
+	TotalSize int `bencode:"total_size,omitempty"`
+}
+
+// metadataExtension is the ut_metadata extension (BEP 9), it sends the info
+// dictionary to peers that ask for it, or downloads it when we don't have it
+// yet (magnet links)
+type metadataExtension struct {
+	infoHash [20]byte
+
+	mu sync.Mutex
+	// info is the verified info dictionary, nil while it is downloaded
+	info []byte
+	// size and pieces are the info dictionary being downloaded
+	size   int
+	pieces [][]byte
+	// peers are the connected peers that have the info dictionary, they are
+	// asked again when the one downloaded does not match the info hash
+	peers map[*peerlib.Peer]bool
+	// done is closed once info is known
+	done chan struct{}
+}
+
+func newMetadataExtension(infoHash [20]byte, info []byte) *metadataExtension {
+	m := &metadataExtension{
+		infoHash: infoHash,
+		info:     info,
+		peers:    make(map[*peerlib.Peer]bool),
+		done:     make(chan struct{}),
+	}
+	if info != nil {
+		close(m.done)
+	}
+	return m
+}
+
+// metadata returns the info dictionary, nil while it is not known
+func (m *metadataExtension) metadata() []byte {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.info
+}
+
+// Handshake requests the pieces of the info dictionary we are missing, if the
+// peer has it
+func (m *metadataExtension) Handshake(peer *peerlib.Peer, handshake *peerlib.ExtensionHandshake) error {
+	if !peer.SupportsExtension("ut_metadata") || handshake.MetadataSize <= 0 {
+		return nil
+	}
+
+	m.mu.Lock()
+	if m.info != nil {
+		m.mu.Unlock()
+		return nil
+	}
+	if handshake.MetadataSize > MaxMetadataSize {
+		m.mu.Unlock()
+		return fmt.Errorf("metadata size %d larger than %d", handshake.MetadataSize, MaxMetadataSize)
+	}
+	if m.size == 0 {
+		m.size = handshake.MetadataSize
+		m.pieces = make([][]byte, (m.size+MetadataPieceSize-1)/MetadataPieceSize)
+	}
+	if m.size != handshake.MetadataSize {
+		m.mu.Unlock()
+		return fmt.Errorf("metadata size %d does not match %d of other peers", handshake.MetadataSize, m.size)
+	}
+	m.peers[peer] = true
+	missing := m.missing()
+	m.mu.Unlock()
+
+	// every peer is asked for every piece, the metadata is small and the first
+	// piece to arrive is kept
+	if err := requestMetadata(peer, missing); err != nil {
+		return err
+	}
+	slog.Debug("requested metadata", "peer", peer.Peer, "size", handshake.MetadataSize, "pieces", len(missing))
+
+	return nil
+}
+
+// remove forgets a peer that disconnected
+func (m *metadataExtension) remove(peer *peerlib.Peer) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	delete(m.peers, peer)
+}
+
+// missing returns the pieces not received yet, m.mu must be held
+func (m *metadataExtension) missing() []int {
+	var missing []int
+	for piece, data := range m.pieces {
+		if data == nil {
+			missing = append(missing, piece)
+		}
+	}
+	return missing
+}
+
+func requestMetadata(peer *peerlib.Peer, pieces []int) error {
+	for _, piece := range pieces {
+		if err := sendMetadataMessage(peer, metadataMessage{MsgType: metadataRequest, Piece: piece}, nil); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (m *metadataExtension) Handle(peer *peerlib.Peer, payload []byte) error {
+	// the raw message holds the exact bytes of the dictionary, data messages
+	// have the piece after them
+	var raw bencode.RawMessage
+	if err := bencode.Unmarshal(payload, &raw); err != nil {
+		return fmt.Errorf("error decoding ut_metadata message: %v", err)
+	}
+	var msg metadataMessage
+	if err := bencode.Unmarshal(raw, &msg); err != nil {
+		return fmt.Errorf("error decoding ut_metadata message: %v", err)
+	}
+
+	switch msg.MsgType {
+	case metadataRequest:
+		return m.serve(peer, msg.Piece)
+	case metadataData:
+		return m.receive(peer, msg, payload[len(raw):])
+	case metadataReject:
+		return fmt.Errorf("peer rejected metadata piece %d", msg.Piece)
+	default:
+		slog.Debug("ignoring unknown ut_metadata message", "peer", peer.Peer, "msgType", msg.MsgType)
+		return nil
+	}
+}
+
+// serve sends a piece of the info dictionary, requests are rejected while we
+// don't have it
+func (m *metadataExtension) serve(peer *peerlib.Peer, piece int) error {
+	info := m.metadata()
+	start := piece * MetadataPieceSize
+	if info == nil || piece < 0 || start >= len(info) {
+		return sendMetadataMessage(peer, metadataMessage{MsgType: metadataReject, Piece: piece}, nil)
+	}
+
+	end := min(start+MetadataPieceSize, len(info))
+	msg := metadataMessage{MsgType: metadataData, Piece: piece, TotalSize: len(info)}
+	slog.Debug("sending metadata piece", "peer", peer.Peer, "piece", piece)
+	return sendMetadataMessage(peer, msg, info[start:end])
+}
+
+// receive keeps a piece of the info dictionary, once every piece is received
+// it is checked against the info hash
+func (m *metadataExtension) receive(peer *peerlib.Peer, msg metadataMessage, data []byte) error {
+	m.mu.Lock()
+
+	if m.info != nil || m.pieces == nil {
+		m.mu.Unlock()
+		return nil
+	}
+	if msg.TotalSize != m.size {
+		m.mu.Unlock()
+		return fmt.Errorf("metadata total size %d, expected %d", msg.TotalSize, m.size)
+	}
+	if msg.Piece < 0 || msg.Piece >= len(m.pieces) {
+		m.mu.Unlock()
+		return fmt.Errorf("metadata piece %d out of range, there are %d", msg.Piece, len(m.pieces))
+	}
+	expected := min(MetadataPieceSize, m.size-msg.Piece*MetadataPieceSize)
+	if len(data) != expected {
+		m.mu.Unlock()
+		return fmt.Errorf("metadata piece %d has length %d, expected %d", msg.Piece, len(data), expected)
+	}
+	if m.pieces[msg.Piece] != nil {
+		m.mu.Unlock()
+		return nil
+	}
+	m.pieces[msg.Piece] = bytes.Clone(data)
+
+	if len(m.missing()) > 0 {
+		m.mu.Unlock()
+		return nil
+	}
+
+	info := bytes.Join(m.pieces, nil)
+	if sha1.Sum(info) != m.infoHash {
+		// we can't know which peer sent the bad piece, so every piece is
+		// asked again to every peer
+		clear(m.pieces)
+		missing := m.missing()
+		peers := make([]*peerlib.Peer, 0, len(m.peers))
+		for p := range m.peers {
+			peers = append(peers, p)
+		}
+		m.mu.Unlock()
+
+		slog.Warn("metadata does not match the info hash, downloading it again", "peer", peer.Peer, "peers", len(peers))
+		for _, p := range peers {
+			if err := requestMetadata(p, missing); err != nil {
+				// fetchMetadata of the peer returns once the connection fails
+				slog.Debug("could not request metadata", "peer", p.Peer, "error", err)
+			}
+		}
+		return nil
+	}
+
+	m.info = info
+	m.pieces = nil
+	clear(m.peers)
+	close(m.done)
+	m.mu.Unlock()
+	slog.Info("metadata downloaded", "peer", peer.Peer, "size", len(info))
+
+	return nil
+}
+
+func sendMetadataMessage(peer *peerlib.Peer, msg metadataMessage, data []byte) error {
+	payload, err := bencode.Encode(msg)
+	if err != nil {
+		return fmt.Errorf("error encoding ut_metadata message: %v", err)
+	}
+	return peer.SendExtension("ut_metadata", append(payload, data...))
+}
@@ -1,28 +1,73 @@
 package torrentlib
 
+import (
+	"github.com/codecrafters-io/bittorrent-starter-go/internal/encoding/bencode"
+	"github.com/codecrafters-io/bittorrent-starter-go/internal/torrentlib/trackerlib"
+)
+
 type Torrent struct {
+	Name        string
 	Length      int
 	TotalPieces int
 	PieceLength int
 	InfoHash    []byte
 	TrackerUrl  string
-	Peers       []string
-	PiecesHash  [][]byte
+	// AnnounceList holds the tiers of trackers, BEP 12. When the torrent has
+	// no announce-list it has a single tier with TrackerUrl
+	AnnounceList [][]string
+	Peers        []string
+	PiecesHash   [][]byte
+	// Nodes are "host:port" of DHT nodes given by the torrent, to join the
+	// DHT from when it has no trackers (BEP 5)
+	Nodes []string
+	// Files has a single entry named after the torrent for single-file
+	// torrents, for multi-file torrents paths are under a directory named
+	// after the torrent
+	Files     []File
+	MultiFile bool
+	// Private torrents (BEP 27) only get peers from their trackers, PEX and
+	// the DHT are not used
+	Private bool
+	// PeerID is our peer id, the same one is used with every tracker
+	PeerID [20]byte
+	// info is the raw info dictionary, sent to peers that download the torrent
+	// from a magnet link
+	info bencode.RawMessage
+
+	trackers *trackerlib.Tiers
+}
+
+// File is a file of the torrent, Offset is where it starts inside the
+// concatenation of all files
+type File struct {
+	Path   string
+	Length int
+	Offset int
 }
 
+// MetaData is the content of a torrent file. Info is kept raw, the info hash
+// must be computed over the exact bytes of the torrent file, re-encoding
+// MetaInfo would drop any key we don't model (md5sum, source, ...).
 type MetaData struct {
-	Announce string   `bencode:"announce"`
-	Info     MetaInfo `bencode:"info"`
+	Announce     string             `bencode:"announce"`
+	AnnounceList [][]string         `bencode:"announce-list"`
+	Info         bencode.RawMessage `bencode:"info"`
+	// Nodes are the DHT nodes of trackerless torrents, [host, port] each
+	Nodes [][]bencode.RawMessage `bencode:"nodes,omitempty"`
 }
 
+// MetaInfo is the info dictionary. Single-file torrents have length, multi-file
+// torrents have files, never both.
 type MetaInfo struct {
-	Length      int    `bencode:"length"`
-	Name        string `bencode:"name"`
-	PieceLength int    `bencode:"piece length"`
-	Pieces      string `bencode:"pieces"`
+	Files       []MetaFile `bencode:"files,omitempty"`
+	Length      int        `bencode:"length,omitempty"`
+	Name        string     `bencode:"name"`
+	PieceLength int        `bencode:"piece length"`
+	Pieces      string     `bencode:"pieces"`
+	Private     int        `bencode:"private,omitempty"`
 }
 
-type TrackerResponse struct {
-	Peers    string `bencode:"peers"`
-	Interval int    `bencode:"interval"`
+type MetaFile struct {
+	Length int      `bencode:"length"`
+	Path   []string `bencode:"path"`
 }
@@ -0,0 +1,177 @@
+package peerlib
+
+import (
+	"fmt"
+	"log/slog"
+	"net"
+
+	"github.com/codecrafters-io/bittorrent-starter-go/internal/encoding/bencode"
+)
+
+// ExtensionHandshake is the payload of the extended message 0, sent by both
+// peers to tell which extensions they support (BEP 10)
+//
+// Fields are sorted by key, as bencode dictionaries must be
+type ExtensionHandshake struct {
+	// M maps the names of the extensions supported to the extended id the
+	// sender wants their messages with, 0 disables an extension
+	M map[string]int `bencode:"m"`
+	// MetadataSize is the length of the info dictionary, sent by peers that
+	// have it (BEP 9)
+	MetadataSize int `bencode:"metadata_size,omitempty"`
+	// P is the port the sender listens on
+	P int `bencode:"p,omitempty"`
+	// Reqq is the amount of requests the sender queues without dropping them
+	Reqq int `bencode:"reqq,omitempty"`
+	// V is the client name and version of the sender
+	V string `bencode:"v,omitempty"`
+	// YourIP is the IP of the receiver as seen by the sender, 4 or 16 bytes
+	YourIP string `bencode:"yourip,omitempty"`
+}
+
+// IP returns YourIP, nil when missing or invalid
+func (h *ExtensionHandshake) IP() net.IP {
+	if len(h.YourIP) != net.IPv4len && len(h.YourIP) != net.IPv6len {
+		return nil
+	}
+	return net.IP(h.YourIP)
+}
+
+// Extension handles the messages of an extension protocol
+type Extension interface {
+	// Handshake is called when the peer sends its extension handshake, the
+	// extension may not be supported by the peer (see Peer.SupportsExtension)
+	Handshake(peer *Peer, handshake *ExtensionHandshake) error
+	// Handle is called with the payload of every message of the extension
+	Handle(peer *Peer, payload []byte) error
+}
+
+// Extensions is a registry of extensions by name (e.g. "ut_metadata"). Peers
+// send us their messages with the extended id of the registration order.
+type Extensions struct {
+	// Version, Port, Reqq and MetadataSize are sent in our handshake
+	Version      string
+	Port         int
+	Reqq         int
+	MetadataSize int
+
+	names      []string
+	extensions map[string]Extension
+}
+
+func NewExtensions() *Extensions {
+	return &Extensions{extensions: make(map[string]Extension)}
+}
+
+// Register adds an extension, it must be called before any handshake is sent
+func (e *Extensions) Register(name string, extension Extension) {
+	if _, ok := e.extensions[name]; !ok {
+		e.names = append(e.names, name)
+	}
+	e.extensions[name] = extension
+}
+
+// SendHandshake sends our extension handshake, if the peer supports the
+// extension protocol
+func (e *Extensions) SendHandshake(peer *Peer) error {
+	if !peer.Capabilities.Has(CapabilityExtensions) {
+		return nil
+	}
+
+	handshake := ExtensionHandshake{
+		M:            make(map[string]int, len(e.names)),
+		MetadataSize: e.MetadataSize,
+		P:            e.Port,
+		Reqq:         e.Reqq,
+		V:            e.Version,
+	}
+	for i, name := range e.names {
+		handshake.M[name] = i + 1
+	}
+	if addr, ok := peer.Conn.RemoteAddr().(*net.TCPAddr); ok {
+		if ip := addr.IP.To4(); ip != nil {
+			handshake.YourIP = string(ip)
+		} else {
+			handshake.YourIP = string(addr.IP.To16())
+		}
+	}
+
+	payload, err := bencode.Encode(handshake)
+	if err != nil {
+		return fmt.Errorf("error encoding extension handshake: %v", err)
+	}
+	return peer.Send(FormatExtended(0, payload))
+}
+
+// Handle passes an extended message to its extension. When the message is the
+// handshake of the peer, it is returned after every extension saw it.
+//
+// Messages of extensions we don't know are ignored.
+func (e *Extensions) Handle(peer *Peer, msg *Message) (*ExtensionHandshake, error) {
+	id, payload, err := ParseExtended(msg)
+	if err != nil {
+		return nil, err
+	}
+
+	if id == 0 {
+		var handshake ExtensionHandshake
+		if err := bencode.Unmarshal(payload, &handshake); err != nil {
+			return nil, fmt.Errorf("error decoding extension handshake: %v", err)
+		}
+		peer.updateExtensions(handshake.M)
+		for _, name := range e.names {
+			if err := e.extensions[name].Handshake(peer, &handshake); err != nil {
+				return nil, fmt.Errorf("error in %s handshake: %v", name, err)
+			}
+		}
+		return &handshake, nil
+	}
+
+	if int(id) > len(e.names) {
+		slog.Debug("ignoring unknown extended message", "peer", peer.Peer, "id", id)
+		return nil, nil
+	}
+	name := e.names[id-1]
+	if err := e.extensions[name].Handle(peer, payload); err != nil {
+		return nil, fmt.Errorf("error in %s message: %v", name, err)
+	}
+	return nil, nil
+}
+
+// updateExtensions applies the m dictionary of an extension handshake, later
+// handshakes only change the extensions they name
+func (c *Peer) updateExtensions(m map[string]int) {
+	c.extMu.Lock()
+	defer c.extMu.Unlock()
+
+	if c.extensions == nil {
+		c.extensions = make(map[string]int)
+	}
+	for name, id := range m {
+		if id <= 0 || id > 255 {
+			delete(c.extensions, name)
+			continue
+		}
+		c.extensions[name] = id
+	}
+}
+
+// SupportsExtension returns true if the peer told us it supports an extension
+func (c *Peer) SupportsExtension(name string) bool {
+	c.extMu.Lock()
+	defer c.extMu.Unlock()
+	_, ok := c.extensions[name]
+	return ok
+}
+
+// SendExtension sends a message of an extension, with the extended id the peer
+// gave to it
+func (c *Peer) SendExtension(name string, payload []byte) error {
+	c.extMu.Lock()
+	id, ok := c.extensions[name]
+	c.extMu.Unlock()
+	if !ok {
+		return fmt.Errorf("peer does not support extension %s", name)
+	}
+	return c.Send(FormatExtended(byte(id), payload))
+}
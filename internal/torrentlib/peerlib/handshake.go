@@ -4,18 +4,55 @@ import (
 	"crypto/rand"
 	"encoding/hex"
 	"fmt"
+	"io"
 	"log/slog"
 	"net"
 )
 
 const handshakeSize = 68
+const protocol = "BitTorrent protocol"
 
-// Generate and send a handshake to the connection
-func sendHandshake(conn net.Conn, infoHash []byte) error {
+// Capability is a bit of the reserved bytes of the handshake, numbered from
+// the right as in the BEPs (bit 0 is the last bit of the last byte)
+type Capability uint
+
+const (
+	// CapabilityDHT means the peer runs a DHT node, it tells its port with a
+	// Port message (BEP 5)
+	CapabilityDHT Capability = 0
+	// CapabilityExtensions is the extension protocol (BEP 10)
+	CapabilityExtensions Capability = 20
+)
+
+// Capabilities are the reserved bytes of a handshake
+type Capabilities [8]byte
+
+func (c Capabilities) Has(capability Capability) bool {
+	return c[7-capability/8]>>(capability%8)&1 == 1
+}
+
+func (c *Capabilities) Set(capability Capability) {
+	c[7-capability/8] |= 1 << (capability % 8)
+}
+
+// LocalCapabilities are the capabilities we send in our handshakes, unless the
+// connection chooses others (see NewWithCapabilities and Accept)
+//
+// The DHT bit is set, as these handshakes are sent without knowing whether
+// there is a DHT node. Without one, Port messages are ignored and none is sent.
+var LocalCapabilities = func() Capabilities {
+	var c Capabilities
+	c.Set(CapabilityDHT)
+	c.Set(CapabilityExtensions)
+	return c
+}()
+
+// Generate and send a handshake to the connection, capabilities are its
+// reserved bytes
+func sendHandshake(conn net.Conn, infoHash []byte, capabilities Capabilities) error {
 	// 1. Create message
 	// buff
 	msg := make([]byte, 68)
-	protocol := "BitTorrent protocol"
 
 	// a. protocol length (1 byte)
 	protocolLen := len(protocol)
@@ -39,13 +76,13 @@ func sendHandshake(conn net.Conn, infoHash []byte) error {
 	)
 
 	// c. reserved bytes (8 bytes)
-	reservedBytes := make([]byte, 8)
-	index += copy(msg[index:], reservedBytes)
+	reservedBytes := capabilities
+	index += copy(msg[index:], reservedBytes[:])
 	slog.Debug(
 		"creating message",
 		"fieldLength", len(reservedBytes),
 		"field", "reserved bytes",
-		"value", string(reservedBytes),
+		"value", fmt.Sprintf("%x", reservedBytes),
 	)
 
 	// d. info hash (20 bytes)
@@ -83,7 +120,7 @@ func sendHandshake(conn net.Conn, infoHash []byte) error {
 
 func readHanshake(conn net.Conn) ([]byte, error) {
 	res := make([]byte, handshakeSize)
-	if _, err := conn.Read(res); err != nil {
+	if _, err := io.ReadFull(conn, res); err != nil {
 		return nil, err
 	}
 	slog.Debug("got a handshake",
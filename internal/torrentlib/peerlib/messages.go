@@ -1,5 +1,15 @@
 package peerlib
 
+import (
+	"encoding/binary"
+	"fmt"
+)
+
+// MaxMessageLength is the longest message accepted. The largest message is a
+// bitfield, 1 MiB is enough for torrents with 8 million pieces. Longer messages
+// are treated as an attack.
+const MaxMessageLength = 1 << 20
+
 type Message struct {
 	Type    MessageType
 	Payload []byte
@@ -17,10 +27,22 @@ const (
 	Request
 	Piece
 	Cancel
+	// Port is the UDP port of the DHT node of the peer (BEP 5)
+	Port
 )
 
+// KeepAlive is a message without type nor payload, only the length prefix
+// (zero) is sent
+const KeepAlive MessageType = -1
+
+// Extended messages carry the messages of the extension protocol (BEP 10),
+// see Extensions
+const Extended MessageType = 20
+
 func (msg *MessageType) String() string {
 	switch *msg {
+	case KeepAlive:
+		return "keep-alive"
 	case Choke:
 		return "choke"
 	case Unchoke:
@@ -39,7 +61,200 @@ func (msg *MessageType) String() string {
 		return "piece"
 	case Cancel:
 		return "cancel"
+	case Port:
+		return "port"
+	case Extended:
+		return "extended"
 	default:
 		return "unknown"
 	}
 }
+
+// validate checks the payload length of known messages, unknown messages
+// are left to their handlers
+func (msg *Message) validate() error {
+	expected := -1
+	switch msg.Type {
+	case KeepAlive, Choke, Unchoke, Interested, NotInterested:
+		expected = 0
+	case Have:
+		expected = 4
+	case Request, Cancel:
+		expected = 12
+	case Port:
+		expected = 2
+	case Piece:
+		if len(msg.Payload) < 8 {
+			return fmt.Errorf("piece message too short: %d bytes", len(msg.Payload))
+		}
+	case Extended:
+		if len(msg.Payload) < 1 {
+			return fmt.Errorf("extended message without extended id")
+		}
+	}
+
+	if expected >= 0 && len(msg.Payload) != expected {
+		return fmt.Errorf("%s message payload must be %d bytes but got %d", msg.Type.String(), expected, len(msg.Payload))
+	}
+	return nil
+}
+
+// FormatHave creates a have message
+//
+// - index (u32): zero-based piece index
+func FormatHave(index int) *Message {
+	payload := make([]byte, 4)
+	binary.BigEndian.PutUint32(payload, uint32(index))
+	return &Message{Type: Have, Payload: payload}
+}
+
+// ParseHave returns the piece index of a have message
+func ParseHave(msg *Message) (int, error) {
+	if msg.Type != Have {
+		return 0, fmt.Errorf("expected have but got %s", msg.Type.String())
+	}
+	if len(msg.Payload) != 4 {
+		return 0, fmt.Errorf("have message payload must be 4 bytes but got %d", len(msg.Payload))
+	}
+	return int(binary.BigEndian.Uint32(msg.Payload)), nil
+}
+
+// FormatBitfield creates a bitfield message, the high bit of the first byte is
+// piece 0
+func FormatBitfield(bitfield []byte) *Message {
+	return &Message{Type: Bitfield, Payload: append([]byte(nil), bitfield...)}
+}
+
+// ParseBitfield returns the bitfield of a message. It must have exactly one
+// bit per piece rounded up to bytes, and the spare bits must be cleared.
+func ParseBitfield(msg *Message, totalPieces int) ([]byte, error) {
+	if msg.Type != Bitfield {
+		return nil, fmt.Errorf("expected bitfield but got %s", msg.Type.String())
+	}
+	if len(msg.Payload) != (totalPieces+7)/8 {
+		return nil, fmt.Errorf("bitfield must be %d bytes for %d pieces but got %d", (totalPieces+7)/8, totalPieces, len(msg.Payload))
+	}
+	if spare := totalPieces % 8; spare != 0 && msg.Payload[len(msg.Payload)-1]&(0xFF>>spare) != 0 {
+		return nil, fmt.Errorf("bitfield has spare bits set")
+	}
+	return msg.Payload, nil
+}
+
+// FormatRequest creates a request message
+//
+// - index (u32): zero-based piece index
+// - begin (u32): zero-based byte offset within the piece
+// - length (u32): length of the block in bytes
+func FormatRequest(index, begin, length int) *Message {
+	return &Message{Type: Request, Payload: formatBlock(index, begin, length)}
+}
+
+// ParseRequest returns the block asked by a request message
+func ParseRequest(msg *Message) (index, begin, length int, err error) {
+	if msg.Type != Request {
+		return 0, 0, 0, fmt.Errorf("expected request but got %s", msg.Type.String())
+	}
+	return parseBlock(msg)
+}
+
+// FormatCancel creates a cancel message, its payload is the same as the
+// request it cancels
+func FormatCancel(index, begin, length int) *Message {
+	return &Message{Type: Cancel, Payload: formatBlock(index, begin, length)}
+}
+
+// ParseCancel returns the block of a cancel message
+func ParseCancel(msg *Message) (index, begin, length int, err error) {
+	if msg.Type != Cancel {
+		return 0, 0, 0, fmt.Errorf("expected cancel but got %s", msg.Type.String())
+	}
+	return parseBlock(msg)
+}
+
+// FormatPiece creates a piece message
+//
+// - index (u32): zero-based piece index
+// - begin (u32): zero-based byte offset within the piece
+// - block (variable): data for the piece
+func FormatPiece(index, begin int, block []byte) *Message {
+	payload := make([]byte, 8+len(block))
+	binary.BigEndian.PutUint32(payload[0:4], uint32(index))
+	binary.BigEndian.PutUint32(payload[4:8], uint32(begin))
+	copy(payload[8:], block)
+	return &Message{Type: Piece, Payload: payload}
+}
+
+// ParsePiece returns the block of a piece message, block shares memory with
+// the message
+func ParsePiece(msg *Message) (index, begin int, block []byte, err error) {
+	if msg.Type != Piece {
+		return 0, 0, nil, fmt.Errorf("expected piece but got %s", msg.Type.String())
+	}
+	if len(msg.Payload) < 8 {
+		return 0, 0, nil, fmt.Errorf("piece message too short: %d bytes", len(msg.Payload))
+	}
+	index = int(binary.BigEndian.Uint32(msg.Payload[0:4]))
+	begin = int(binary.BigEndian.Uint32(msg.Payload[4:8]))
+	return index, begin, msg.Payload[8:], nil
+}
+
+// FormatPort creates a port message
+//
+// - port (u16): UDP port of our DHT node
+func FormatPort(port int) *Message {
+	return &Message{Type: Port, Payload: binary.BigEndian.AppendUint16(nil, uint16(port))}
+}
+
+// ParsePort returns the DHT port of a port message
+func ParsePort(msg *Message) (int, error) {
+	if msg.Type != Port {
+		return 0, fmt.Errorf("expected port but got %s", msg.Type.String())
+	}
+	if len(msg.Payload) != 2 {
+		return 0, fmt.Errorf("port message payload must be 2 bytes but got %d", len(msg.Payload))
+	}
+	port := int(binary.BigEndian.Uint16(msg.Payload))
+	if port == 0 {
+		return 0, fmt.Errorf("port message with port 0")
+	}
+	return port, nil
+}
+
+// FormatExtended creates an extended message
+//
+// - extended id (u8): 0 for the handshake, otherwise the ID the receiver
+// gave to the extension
+// - payload (variable): message of the extension
+func FormatExtended(id byte, payload []byte) *Message {
+	return &Message{Type: Extended, Payload: append([]byte{id}, payload...)}
+}
+
+// ParseExtended returns the extended id and payload of an extended message,
+// payload shares memory with the message
+func ParseExtended(msg *Message) (id byte, payload []byte, err error) {
+	if msg.Type != Extended {
+		return 0, nil, fmt.Errorf("expected extended but got %s", msg.Type.String())
+	}
+	if len(msg.Payload) < 1 {
+		return 0, nil, fmt.Errorf("extended message without extended id")
+	}
+	return msg.Payload[0], msg.Payload[1:], nil
+}
+
+func formatBlock(index, begin, length int) []byte {
+	payload := make([]byte, 12)
+	binary.BigEndian.PutUint32(payload[0:4], uint32(index))
+	binary.BigEndian.PutUint32(payload[4:8], uint32(begin))
+	binary.BigEndian.PutUint32(payload[8:12], uint32(length))
+	return payload
+}
+
+func parseBlock(msg *Message) (index, begin, length int, err error) {
+	if len(msg.Payload) != 12 {
+		return 0, 0, 0, fmt.Errorf("%s message payload must be 12 bytes but got %d", msg.Type.String(), len(msg.Payload))
+	}
+	index = int(binary.BigEndian.Uint32(msg.Payload[0:4]))
+	begin = int(binary.BigEndian.Uint32(msg.Payload[4:8]))
+	length = int(binary.BigEndian.Uint32(msg.Payload[8:12]))
+	return index, begin, length, nil
+}
@@ -7,6 +7,8 @@ import (
 	"io"
 	"log/slog"
 	"net"
+	"sync"
+	"sync/atomic"
 	"time"
 )
 
@@ -17,18 +19,41 @@ type Peer struct {
 	infoHash [20]byte
 	Bitfield []byte
 	PeerID   [20]byte
+	// Capabilities are the reserved bytes of the handshake of the peer
+	Capabilities Capabilities
+	// Inbound is true when the peer connected to us, its port is not the one
+	// it listens on then
+	Inbound bool
+
+	// AmChoking is true while we choke the peer, its requests are ignored
+	AmChoking atomic.Bool
+	// Interested is true while the peer wants pieces from us
+	Interested atomic.Bool
+	// Uploaded is the amount of block bytes sent to the peer
+	Uploaded atomic.Int64
+	// Downloaded is the amount of block bytes received from the peer
+	Downloaded atomic.Int64
+
+	// extensions are the message IDs of the extensions the peer supports, by
+	// name, see Extensions
+	extMu      sync.Mutex
+	extensions map[string]int
+
+	// writeMu serializes writes, messages can be sent from other goroutines
+	// (e.g. have messages)
+	writeMu sync.Mutex
 }
 
 // New connects with a peer, completes a handshake, and receives a handshake
 // returns an err if any of those fail.
 func New(peerStr string, infoHash []byte) (*Peer, error) {
-	conn, err := net.DialTimeout("tcp", peerStr, 3*time.Second)
+	conn, err := dial(peerStr)
 	if err != nil {
 		return nil, err
 	}
 
 	// 1. Send Handshake
-	if err = sendHandshake(conn, infoHash); err != nil {
+	if err = sendHandshake(conn, infoHash, LocalCapabilities); err != nil {
 		conn.Close()
 		return nil, fmt.Errorf("error sending handshake: %v", err)
 	}
@@ -47,11 +72,12 @@ func New(peerStr string, infoHash []byte) (*Peer, error) {
 	}
 
 	peer := Peer{
-		Conn:     conn,
-		Choked:   true,
-		Peer:     peerStr,
-		infoHash: [20]byte(res[28:48]),
-		PeerID:   [20]byte(res[48:68]),
+		Conn:         conn,
+		Choked:       true,
+		Peer:         peerStr,
+		infoHash:     [20]byte(res[28:48]),
+		PeerID:       [20]byte(res[48:68]),
+		Capabilities: Capabilities(res[20:28]),
 	}
 
 	// 3. Receive bitfield
@@ -66,19 +92,25 @@ func New(peerStr string, infoHash []byte) (*Peer, error) {
 		return nil, err
 	}
 	peer.Bitfield = msg.Payload
+	peer.AmChoking.Store(true)
 
 	return &peer, nil
 }
 
 // Same as New, but without expecting a Bitfield message
 func NewNoBitfield(peerStr string, infoHash []byte) (*Peer, error) {
-	conn, err := net.DialTimeout("tcp", peerStr, 3*time.Second)
+	return NewWithCapabilities(peerStr, infoHash, LocalCapabilities)
+}
+
+// Same as NewNoBitfield, capabilities are sent instead of LocalCapabilities
+func NewWithCapabilities(peerStr string, infoHash []byte, capabilities Capabilities) (*Peer, error) {
+	conn, err := dial(peerStr)
 	if err != nil {
 		return nil, err
 	}
 
 	// 1. Send Handshake
-	if err = sendHandshake(conn, infoHash); err != nil {
+	if err = sendHandshake(conn, infoHash, capabilities); err != nil {
 		conn.Close()
 		return nil, fmt.Errorf("error sending handshake: %v", err)
 	}
@@ -97,17 +129,82 @@ func NewNoBitfield(peerStr string, infoHash []byte) (*Peer, error) {
 	}
 
 	peer := Peer{
-		Conn:     conn,
-		Choked:   true,
-		Peer:     peerStr,
-		infoHash: [20]byte(res[28:48]),
-		PeerID:   [20]byte(res[48:68]),
+		Conn:         conn,
+		Choked:       true,
+		Peer:         peerStr,
+		infoHash:     [20]byte(res[28:48]),
+		PeerID:       [20]byte(res[48:68]),
+		Capabilities: Capabilities(res[20:28]),
+	}
+	peer.AmChoking.Store(true)
+
+	return &peer, nil
+}
+
+// Accept completes the handshake of an incoming connection. The remote peer
+// sends its handshake first, it is answered only if lookup knows the info
+// hash, with the capabilities it returns. Same as NewNoBitfield, the bitfield
+// is not read.
+//
+// The connection is not closed on errors.
+func Accept(conn net.Conn, lookup func(infoHash [20]byte) (Capabilities, bool)) (*Peer, error) {
+	// 1. Receive Handshake
+	res, err := readHanshake(conn)
+	if err != nil {
+		return nil, fmt.Errorf("error receiving handshake: %v", err)
+	}
+	if int(res[0]) != len(protocol) || string(res[1:20]) != protocol {
+		return nil, fmt.Errorf("unknown protocol %q", res[1:20])
+	}
+
+	// check we have the file
+	infoHash := [20]byte(res[28:48])
+	capabilities, ok := lookup(infoHash)
+	if !ok {
+		return nil, fmt.Errorf("unknown infohash %x", infoHash)
+	}
+
+	// 2. Send Handshake
+	if err = sendHandshake(conn, infoHash[:], capabilities); err != nil {
+		return nil, fmt.Errorf("error sending handshake: %v", err)
+	}
+
+	peer := Peer{
+		Conn:         conn,
+		Choked:       true,
+		Peer:         conn.RemoteAddr().String(),
+		Inbound:      true,
+		infoHash:     infoHash,
+		PeerID:       [20]byte(res[48:68]),
+		Capabilities: Capabilities(res[20:28]),
 	}
+	peer.AmChoking.Store(true)
 
 	return &peer, nil
 }
 
-// Read reads and consumes a message from the connection
+// dial connects to a peer, its address can be IPv4 ("1.2.3.4:6881") or IPv6
+// ("[::1]:6881")
+func dial(peerStr string) (net.Conn, error) {
+	host, port, err := net.SplitHostPort(peerStr)
+	if err != nil {
+		return nil, fmt.Errorf("invalid peer address %q: %v", peerStr, err)
+	}
+
+	network := "tcp"
+	if ip := net.ParseIP(host); ip != nil {
+		if ip.To4() != nil {
+			network = "tcp4"
+		} else {
+			network = "tcp6"
+		}
+	}
+
+	return net.DialTimeout(network, net.JoinHostPort(host, port), 3*time.Second)
+}
+
+// Read reads and consumes a message from the connection. Keep-alives are
+// returned as messages of type KeepAlive.
 func (c *Peer) Read() (*Message, error) {
 	prefixBuf := make([]byte, 4)
 	if _, err := io.ReadFull(c.Conn, prefixBuf); err != nil {
@@ -115,6 +212,14 @@ func (c *Peer) Read() (*Message, error) {
 	}
 	length := binary.BigEndian.Uint32(prefixBuf)
 
+	if length == 0 {
+		slog.Debug("got message", "peer", c.Peer, "messageType", "keep-alive")
+		return &Message{Type: KeepAlive, Payload: nil}, nil
+	}
+	if length > MaxMessageLength {
+		return nil, fmt.Errorf("message too long: %d bytes, maximum %d", length, MaxMessageLength)
+	}
+
 	messageBuf := make([]byte, length)
 	if _, err := io.ReadFull(c.Conn, messageBuf); err != nil {
 		return nil, err
@@ -124,29 +229,55 @@ func (c *Peer) Read() (*Message, error) {
 		Type:    MessageType(messageBuf[0]),
 		Payload: messageBuf[1:],
 	}
+	if err := m.validate(); err != nil {
+		return nil, err
+	}
 
 	slog.Debug("got message", "peer", c.Peer, "messageType", m.Type.String())
 
 	return &m, nil
 }
 
+// Send writes a message to the connection, it is safe to call from several
+// goroutines
 func (c *Peer) Send(msg *Message) error {
-	switch msg.Type {
-	case Interested, Request:
+	var msgBuffer []byte
+	if msg.Type == KeepAlive {
+		msgBuffer = make([]byte, 4)
+	} else {
 		msgLength := uint32(1 + len(msg.Payload))
-		msgBuffer := make([]byte, 4+msgLength)
+		msgBuffer = make([]byte, 4+msgLength)
 
 		binary.BigEndian.PutUint32(msgBuffer[:4], msgLength)
 		msgBuffer[4] = byte(msg.Type)
 
 		copy(msgBuffer[5:], msg.Payload)
-		_, err := c.Conn.Write(msgBuffer)
-		slog.Debug("sending message", "peer", c.Peer, "messageType", msg.Type.String(), "messageTypeID", msg.Type)
-		return err
+	}
+
+	c.writeMu.Lock()
+	_, err := c.Conn.Write(msgBuffer)
+	c.writeMu.Unlock()
+	slog.Debug("sending message", "peer", c.Peer, "messageType", msg.Type.String(), "messageTypeID", msg.Type)
+	return err
+}
 
-	default:
-		return fmt.Errorf("not impleted yet")
+// InfoHash returns the info hash of the torrent shared with the peer
+func (c *Peer) InfoHash() [20]byte {
+	return c.infoHash
+}
+
+// SetPiece marks a piece as available in the bitfield of the peer, e.g. after
+// a have message. The bitfield grows if needed.
+func (c *Peer) SetPiece(pieceID int) {
+	bytePieceID := pieceID / 8
+	bitPieceID := pieceID % 8
+	if bytePieceID < 0 {
+		return
+	}
+	if bytePieceID >= len(c.Bitfield) {
+		c.Bitfield = append(c.Bitfield, make([]byte, bytePieceID+1-len(c.Bitfield))...)
 	}
+	c.Bitfield[bytePieceID] |= 1 << (7 - bitPieceID)
 }
 
 func (c *Peer) HasPiece(pieceID int) bool {
@@ -0,0 +1,151 @@
+package peerlib
+
+import (
+	"math"
+	"time"
+)
+
+const (
+	MinPipelineDepth     = 2
+	InitialPipelineDepth = 5
+	// MaxPipelineDepth is used when the peer does not tell its limit (reqq)
+	MaxPipelineDepth = 250
+)
+
+// pipelineQueueTime is how long, besides the round trip, the requests queued in
+// a peer last, so it always has something to send.
+const pipelineQueueTime = time.Second
+
+// the download rate is measured over windows of this length
+const pipelineRateWindow = time.Second
+
+// Block identifies a block by its piece and offset
+type Block struct {
+	Index int
+	Begin int
+}
+
+// Pipeline adapts how many block requests are kept pending with a peer. A fast
+// peer needs many requests queued to stay busy during a round trip (the
+// bandwidth-delay product), while a slow one would hold blocks that other
+// peers could send sooner.
+//
+// The depth is the download rate times the round trip time (the minimum seen,
+// so requests waiting in the queue of the peer don't inflate it) plus
+// pipelineQueueTime, in blocks.
+type Pipeline struct {
+	depth int
+	limit int
+
+	// rate is the download rate in bytes per second
+	rate   float64
+	minRTT time.Duration
+
+	requested    map[Block]time.Time
+	windowStart  time.Time
+	windowBytes  int
+	windowBlocks int
+}
+
+func NewPipeline() *Pipeline {
+	return &Pipeline{
+		depth:     InitialPipelineDepth,
+		limit:     MaxPipelineDepth,
+		requested: make(map[Block]time.Time),
+	}
+}
+
+// Depth returns how many requests should be pending with the peer
+func (p *Pipeline) Depth() int {
+	return p.depth
+}
+
+// Rate returns the measured download rate, in bytes per second
+func (p *Pipeline) Rate() float64 {
+	return p.rate
+}
+
+// RTT returns the minimum round trip time measured
+func (p *Pipeline) RTT() time.Duration {
+	return p.minRTT
+}
+
+// SetLimit sets the maximum amount of requests the peer accepts (reqq of
+// the extension handshake), 0 means unknown
+func (p *Pipeline) SetLimit(reqq int) {
+	if reqq <= 0 {
+		reqq = MaxPipelineDepth
+	}
+	p.limit = reqq
+	p.depth = min(p.depth, p.limit)
+}
+
+// Requested records when a block was requested
+func (p *Pipeline) Requested(block Block, now time.Time) {
+	if p.windowStart.IsZero() {
+		p.windowStart = now
+	}
+	p.requested[block] = now
+}
+
+// Cancelled drops a request that is no longer pending, because it was
+// cancelled or the block was received from another peer
+func (p *Pipeline) Cancelled(block Block) {
+	delete(p.requested, block)
+}
+
+// Pending returns the amount of requests waiting for their block
+func (p *Pipeline) Pending() int {
+	return len(p.requested)
+}
+
+// Forget drops the pending requests, e.g. when the peer chokes us
+func (p *Pipeline) Forget() {
+	clear(p.requested)
+	// the time choked must not count for the rate
+	p.windowStart = time.Time{}
+	p.windowBytes = 0
+	p.windowBlocks = 0
+}
+
+// Received records a block, length bytes long, arriving at now. It returns
+// true when the depth changed.
+func (p *Pipeline) Received(block Block, length int, now time.Time) bool {
+	if requestedAt, ok := p.requested[block]; ok {
+		delete(p.requested, block)
+		if rtt := now.Sub(requestedAt); p.minRTT == 0 || rtt < p.minRTT {
+			p.minRTT = rtt
+		}
+	}
+
+	if p.windowStart.IsZero() {
+		p.windowStart = now
+	}
+	p.windowBytes += length
+	p.windowBlocks++
+
+	elapsed := now.Sub(p.windowStart)
+	if elapsed < pipelineRateWindow {
+		return false
+	}
+
+	sample := float64(p.windowBytes) / elapsed.Seconds()
+	if p.rate == 0 {
+		p.rate = sample
+	} else {
+		p.rate = 0.7*p.rate + 0.3*sample
+	}
+	blockLength := float64(p.windowBytes) / float64(p.windowBlocks)
+
+	p.windowStart = now
+	p.windowBytes = 0
+	p.windowBlocks = 0
+
+	depth := int(math.Ceil(p.rate * (p.minRTT + pipelineQueueTime).Seconds() / blockLength))
+	depth = min(max(MinPipelineDepth, depth), p.limit)
+	if depth == p.depth {
+		return false
+	}
+	p.depth = depth
+	return true
+}
@@ -0,0 +1,268 @@
+package torrentlib
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/codecrafters-io/bittorrent-starter-go/internal/encoding/bencode"
+	"github.com/codecrafters-io/bittorrent-starter-go/internal/torrentlib/peerlib"
+	"github.com/codecrafters-io/bittorrent-starter-go/internal/torrentlib/trackerlib"
+)
+
+// PexInterval is how often peers are sent PEX messages. BEP 11 asks for at most
+// one message per minute to each peer, messages that arrive much sooner are
+// ignored.
+const PexInterval = time.Minute
+
+// MaxPexPeers is the maximum amount of added (and of dropped) peers in a
+// message, peers beyond it are not sent nor accepted
+const MaxPexPeers = 50
+
+// flags of the added peers
+const pexReachable = 0x10
+
+// pexMessage is the dictionary of ut_pex messages, peers are in compact form
+type pexMessage struct {
+	Added    string `bencode:"added,omitempty"`
+	AddedF   string `bencode:"added.f,omitempty"`
+	Added6   string `bencode:"added6,omitempty"`
+	Added6F  string `bencode:"added6.f,omitempty"`
+	Dropped  string `bencode:"dropped,omitempty"`
+	Dropped6 string `bencode:"dropped6,omitempty"`
+}
+
+// pexPeer is the state of the peer exchange with a connected peer
+type pexPeer struct {
+	// addr is where the peer listens, empty when unknown (peers that
+	// connected to us without telling their port)
+	addr string
+	// sent are the addresses the peer knows from us
+	sent         map[string]bool
+	lastSent     time.Time
+	lastReceived time.Time
+}
+
+// pexExtension is the ut_pex extension (BEP 11): connected peers tell each
+// other which peers they are connected to, so peers are found without asking
+// the trackers
+type pexExtension struct {
+	s *session
+
+	mu    sync.Mutex
+	peers map[*peerlib.Peer]*pexPeer
+	// learned receives the addresses of peers other peers told us about,
+	// they are passed to the connection pool by runPex
+	learned chan []string
+}
+
+func newPexExtension(s *session) *pexExtension {
+	return &pexExtension{
+		s:       s,
+		peers:   make(map[*peerlib.Peer]*pexPeer),
+		learned: make(chan []string, 16),
+	}
+}
+
+// add starts the exchange with a connected peer
+func (p *pexExtension) add(peer *peerlib.Peer) {
+	state := &pexPeer{sent: make(map[string]bool)}
+	if !peer.Inbound {
+		state.addr = peer.Peer
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.peers[peer] = state
+}
+
+// remove forgets a disconnected peer
+func (p *pexExtension) remove(peer *peerlib.Peer) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	delete(p.peers, peer)
+}
+
+// Handshake learns the port the peer listens on, and sends it the peers we
+// are connected to
+func (p *pexExtension) Handshake(peer *peerlib.Peer, handshake *peerlib.ExtensionHandshake) error {
+	p.mu.Lock()
+	state, ok := p.peers[peer]
+	if ok && handshake.P > 0 && handshake.P <= 65535 {
+		host, _, err := net.SplitHostPort(peer.Peer)
+		if err == nil {
+			state.addr = net.JoinHostPort(host, strconv.Itoa(handshake.P))
+		}
+	}
+	p.mu.Unlock()
+
+	if !peer.SupportsExtension("ut_pex") {
+		return nil
+	}
+	return p.send(peer, p.s.connectedPeers())
+}
+
+// send sends the peers added and dropped since the last message, nothing is
+// sent when there are no changes
+func (p *pexExtension) send(peer *peerlib.Peer, connected []*peerlib.Peer) error {
+	p.mu.Lock()
+	state, ok := p.peers[peer]
+	if !ok {
+		p.mu.Unlock()
+		return nil
+	}
+	current := make(map[string]bool)
+	reachable := make(map[string]bool)
+	for _, other := range connected {
+		if other == peer || p.peers[other] == nil {
+			continue
+		}
+		if addr := p.peers[other].addr; addr != "" {
+			current[addr] = true
+			reachable[addr] = !other.Inbound
+		}
+	}
+
+	var msg pexMessage
+	added, dropped := 0, 0
+	for addr := range current {
+		if state.sent[addr] || added >= MaxPexPeers {
+			continue
+		}
+		compact, err := trackerlib.FormatCompactPeer(addr)
+		if err != nil {
+			continue
+		}
+		var flags byte
+		if reachable[addr] {
+			flags |= pexReachable
+		}
+		if len(compact) == 6 {
+			msg.Added += string(compact)
+			msg.AddedF += string(flags)
+		} else {
+			msg.Added6 += string(compact)
+			msg.Added6F += string(flags)
+		}
+		state.sent[addr] = true
+		added++
+	}
+	for addr := range state.sent {
+		if current[addr] || dropped >= MaxPexPeers {
+			continue
+		}
+		delete(state.sent, addr)
+		compact, err := trackerlib.FormatCompactPeer(addr)
+		if err != nil {
+			continue
+		}
+		if len(compact) == 6 {
+			msg.Dropped += string(compact)
+		} else {
+			msg.Dropped6 += string(compact)
+		}
+		dropped++
+	}
+	if added == 0 && dropped == 0 {
+		p.mu.Unlock()
+		return nil
+	}
+	state.lastSent = time.Now()
+	p.mu.Unlock()
+
+	payload, err := bencode.Encode(msg)
+	if err != nil {
+		return fmt.Errorf("error encoding ut_pex message: %v", err)
+	}
+	slog.Debug("sending pex", "peer", peer.Peer, "added", added, "dropped", dropped)
+	return peer.SendExtension("ut_pex", payload)
+}
+
+// Handle passes the peers added by a message to the connection pool, dropped
+// peers are ignored as we may still reach them
+func (p *pexExtension) Handle(peer *peerlib.Peer, payload []byte) error {
+	var msg pexMessage
+	if err := bencode.Unmarshal(payload, &msg); err != nil {
+		return fmt.Errorf("error decoding ut_pex message: %v", err)
+	}
+
+	p.mu.Lock()
+	state, ok := p.peers[peer]
+	tooSoon := !ok || !state.lastReceived.IsZero() && time.Since(state.lastReceived) < PexInterval/2
+	if !tooSoon {
+		state.lastReceived = time.Now()
+	}
+	p.mu.Unlock()
+	if tooSoon {
+		slog.Debug("ignoring pex sent too soon", "peer", peer.Peer)
+		return nil
+	}
+
+	added, err := trackerlib.ParseCompactPeers([]byte(msg.Added))
+	if err != nil {
+		return err
+	}
+	added6, err := trackerlib.ParseCompactPeers6([]byte(msg.Added6))
+	if err != nil {
+		return err
+	}
+	peers := append(added, added6...)
+	if len(peers) > MaxPexPeers {
+		peers = peers[:MaxPexPeers]
+	}
+	if len(peers) == 0 {
+		return nil
+	}
+
+	slog.Debug("got peers from pex", "peer", peer.Peer, "added", len(peers))
+	select {
+	case p.learned <- peers:
+	default:
+		slog.Debug("dropping pex peers, too many pending", "peer", peer.Peer)
+	}
+	return nil
+}
+
+// runPex sends the changes of connected peers to every peer with ut_pex each
+// PexInterval, and passes the peers learned to the connection pool, until ctx
+// is done
+func (s *session) runPex(ctx context.Context) {
+	ticker := time.NewTicker(PexInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case peers := <-s.pex.learned:
+			select {
+			case s.newPeers <- peers:
+			case <-ctx.Done():
+				return
+			}
+		case <-ticker.C:
+			connected := s.connectedPeers()
+			for _, peer := range connected {
+				if !peer.SupportsExtension("ut_pex") || !s.pex.due(peer) {
+					continue
+				}
+				if err := s.pex.send(peer, connected); err != nil {
+					// pex is best effort, the peer may have just disconnected
+					slog.Debug("could not send pex", "peer", peer.Peer, "error", err)
+				}
+			}
+		}
+	}
+}
+
+// due returns true when a message can be sent to the peer
+func (p *pexExtension) due(peer *peerlib.Peer) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	state, ok := p.peers[peer]
+	return ok && time.Since(state.lastSent) >= PexInterval
+}
@@ -0,0 +1,274 @@
+package torrentlib
+
+import (
+	"log/slog"
+	"math/rand"
+	"sync"
+
+	"github.com/codecrafters-io/bittorrent-starter-go/internal/torrentlib/peerlib"
+)
+
+type pieceState int
+
+const (
+	pieceUnwanted pieceState = iota
+	pieceWanted
+	pieceInProgress
+	pieceDone
+)
+
+// picker decides which piece each worker downloads. It counts how many
+// connected peers have each piece and hands out the rarest piece the peer of
+// the worker has, so rare pieces are fetched while their few owners are still
+// around, and pieces spread across the swarm faster.
+//
+// Once every wanted piece is being downloaded, the picker enters endgame mode:
+// blocks already requested are requested again to other peers, so the last
+// pieces don't depend on the slowest peer.
+type picker struct {
+	torrent *Torrent
+
+	mu           sync.Mutex
+	state        []pieceState
+	attempts     []int
+	single       []bool
+	availability []int
+	// wanted is the amount of pieces in pieceWanted state
+	wanted int
+	active map[int]*pieceDownload
+	// endgame is set once there are no wanted pieces left
+	endgame bool
+	// changedCh is closed (and replaced) when a piece may have become
+	// available to some worker
+	changedCh chan struct{}
+}
+
+func newPicker(torrent *Torrent) *picker {
+	return &picker{
+		torrent:      torrent,
+		state:        make([]pieceState, torrent.TotalPieces),
+		attempts:     make([]int, torrent.TotalPieces),
+		single:       make([]bool, torrent.TotalPieces),
+		availability: make([]int, torrent.TotalPieces),
+		active:       make(map[int]*pieceDownload),
+		changedCh:    make(chan struct{}),
+	}
+}
+
+// want adds a piece to download
+func (p *picker) want(pieceID int) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.state[pieceID] == pieceUnwanted {
+		p.setWanted(pieceID)
+	}
+}
+
+// addBitfield counts the pieces of a peer that just connected or sent its
+// bitfield
+func (p *picker) addBitfield(bitfield []byte) {
+	p.updateBitfield(bitfield, 1)
+}
+
+// removeBitfield stops counting the pieces of a peer, e.g. when it disconnects
+func (p *picker) removeBitfield(bitfield []byte) {
+	p.updateBitfield(bitfield, -1)
+}
+
+func (p *picker) updateBitfield(bitfield []byte, delta int) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	for pieceID := range p.availability {
+		if hasBit(bitfield, pieceID) {
+			p.availability[pieceID] += delta
+		}
+	}
+	if delta > 0 {
+		p.notify()
+	}
+}
+
+// addPiece counts a piece announced by a have message
+func (p *picker) addPiece(pieceID int) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.availability[pieceID]++
+	p.notify()
+}
+
+// pick returns a piece with blocks the worker of a peer can request, the
+// peer must have it and the worker must not be downloading it already
+// (held). In order of preference:
+//
+//  1. a piece in progress with blocks nobody requested, the one with more
+//     blocks received, so pieces are finished (and shared) sooner
+//  2. the rarest wanted piece, which is marked in progress
+//  3. in endgame, a piece in progress whose blocks are all requested
+//
+// When there is none, nil is returned.
+func (p *picker) pick(peer *peerlib.Peer, held func(piece *pieceDownload) bool) *pieceDownload {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	var partial *pieceDownload
+	partialReceived := -1
+	var endgame *pieceDownload
+	for pieceID, piece := range p.active {
+		if !peer.HasPiece(pieceID) || held(piece) || !piece.availableTo(peer) {
+			continue
+		}
+		free, received := piece.freeBlocks()
+		if free > 0 && received > partialReceived {
+			partial = piece
+			partialReceived = received
+		}
+		// the last block may have arrived while the hash is checked
+		if free == 0 && received < piece.totalBlocks {
+			endgame = piece
+		}
+	}
+	if partial != nil {
+		return partial
+	}
+
+	if p.wanted == 0 {
+		if endgame != nil && !p.endgame {
+			p.endgame = true
+			slog.Info("entering endgame", "piecesInProgress", len(p.active))
+		}
+		return endgame
+	}
+
+	best := -1
+	// start at a random piece, so peers with the same pieces don't all go
+	// through them in the same order
+	start := rand.Intn(len(p.state))
+	for i := range p.state {
+		pieceID := (start + i) % len(p.state)
+		if p.state[pieceID] != pieceWanted || !peer.HasPiece(pieceID) {
+			continue
+		}
+		if best == -1 || p.availability[pieceID] < p.availability[best] {
+			best = pieceID
+		}
+	}
+
+	if best == -1 {
+		return nil
+	}
+
+	p.state[best] = pieceInProgress
+	p.wanted--
+	p.attempts[best]++
+	piece := newPieceDownload(&pieceWork{
+		id:      best,
+		attempt: p.attempts[best],
+		length:  p.torrent.pieceSize(best),
+		single:  p.single[best],
+	})
+	p.active[best] = piece
+
+	return piece
+}
+
+// isEndgame returns true once every wanted piece is being downloaded
+func (p *picker) isEndgame() bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.wanted == 0
+}
+
+// changed returns a channel that is closed once a piece may have become
+// available to some worker. It must be called before pick, so changes
+// between both are not missed.
+func (p *picker) changed() <-chan struct{} {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.changedCh
+}
+
+// blocksFreed wakes up workers after requests were forgotten, e.g. when a
+// peer chokes us or disconnects, so other peers can request those blocks
+func (p *picker) blocksFreed() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.notify()
+}
+
+// complete is called after checking the hash of a finished piece, a piece
+// that does not match is put back so it can be picked again
+func (p *picker) complete(piece *pieceDownload, valid bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.active[piece.work.id] == piece {
+		delete(p.active, piece.work.id)
+	}
+	if !valid {
+		p.setWanted(piece.work.id)
+	}
+	// workers with requests of the piece (endgame) drop it
+	p.notify()
+}
+
+// blame is called when a piece fails the hash check because of the peers
+// that sent it, they lose trust until they are banned. When several peers
+// sent the piece, the next attempt is downloaded from a single peer, so the
+// one sending bad data is found, see session.piecePassed.
+func (p *picker) blame(piece *pieceDownload, shared bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.single[piece.work.id] = shared
+}
+
+// release lets other peers download the single pieces of a peer that
+// disconnected or choked us
+func (p *picker) release(peer *peerlib.Peer) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for _, piece := range p.active {
+		piece.release(peer)
+	}
+}
+
+// setWanted marks a piece as wanted and wakes up workers, p.mu must be held
+func (p *picker) setWanted(pieceID int) {
+	p.state[pieceID] = pieceWanted
+	p.wanted++
+	p.notify()
+}
+
+// done marks a piece as verified
+func (p *picker) done(pieceID int) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.state[pieceID] = pieceDone
+}
+
+// missing returns the wanted pieces (or in progress) no connected peer has
+func (p *picker) missing() []int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	var missing []int
+	for pieceID, state := range p.state {
+		if (state == pieceWanted || state == pieceInProgress) && p.availability[pieceID] == 0 {
+			missing = append(missing, pieceID)
+		}
+	}
+	return missing
+}
+
+// notify wakes up workers waiting for a piece, p.mu must be held
+func (p *picker) notify() {
+	close(p.changedCh)
+	p.changedCh = make(chan struct{})
+}
+
+func hasBit(bitfield []byte, i int) bool {
+	if i < 0 || i/8 >= len(bitfield) {
+		return false
+	}
+	return bitfield[i/8]>>(7-i%8)&1 == 1
+}
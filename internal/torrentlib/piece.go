@@ -0,0 +1,210 @@
+package torrentlib
+
+import (
+	"fmt"
+	"slices"
+	"sync"
+
+	"github.com/codecrafters-io/bittorrent-starter-go/internal/torrentlib/peerlib"
+)
+
+// pieceDownload is a piece being downloaded. Its blocks are requested by the
+// workers of any peer that has the piece, and assembled in a shared buffer, so
+// the state is guarded by mu. Each block is requested to a single peer, except
+// in endgame mode.
+type pieceDownload struct {
+	work        *pieceWork
+	totalBlocks int
+
+	mu       sync.Mutex
+	buffer   []byte
+	received []bool
+	// requesters are the peers with a pending request of each block
+	requesters [][]*peerlib.Peer
+	// senders are the peers each block was received from
+	senders          []*peerlib.Peer
+	blocksDownloaded int
+	// isFinished is set once every block is received
+	isFinished bool
+	// owner is the only peer that downloads the blocks of a single piece
+	owner *peerlib.Peer
+}
+
+func newPieceDownload(work *pieceWork) *pieceDownload {
+	totalBlocks := work.length / BlockSize
+	if work.length%BlockSize != 0 {
+		totalBlocks++
+	}
+
+	return &pieceDownload{
+		work:        work,
+		totalBlocks: totalBlocks,
+		buffer:      make([]byte, work.length),
+		received:    make([]bool, totalBlocks),
+		requesters:  make([][]*peerlib.Peer, totalBlocks),
+		senders:     make([]*peerlib.Peer, totalBlocks),
+	}
+}
+
+// blockLength returns the length of a block, the last one can be smaller
+func (p *pieceDownload) blockLength(block int) int {
+	if block == p.totalBlocks-1 && p.work.length%BlockSize != 0 {
+		return p.work.length % BlockSize
+	}
+	return BlockSize
+}
+
+// nextBlocks returns up to n more blocks peer should request and records the
+// requests. pending are the blocks peer has requested already.
+//
+// Outside endgame, blocks requested by another peer are skipped.
+func (p *pieceDownload) nextBlocks(peer *peerlib.Peer, pending map[int]bool, n int, endgame bool) []int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.work.single && p.owner != nil && p.owner != peer {
+		return nil
+	}
+
+	var blocks []int
+	for block := 0; block < p.totalBlocks && len(blocks) < n; block++ {
+		if p.received[block] || pending[block] {
+			continue
+		}
+		if !endgame && len(p.requesters[block]) > 0 {
+			continue
+		}
+
+		p.requesters[block] = append(p.requesters[block], peer)
+		pending[block] = true
+		blocks = append(blocks, block)
+	}
+	if p.work.single && len(blocks) > 0 {
+		p.owner = peer
+	}
+
+	return blocks
+}
+
+// availableTo returns false when another peer downloads the blocks of a
+// single piece
+func (p *pieceDownload) availableTo(peer *peerlib.Peer) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return !p.work.single || p.owner == nil || p.owner == peer
+}
+
+// release lets other peers download a single piece that peer was
+// downloading, e.g. when it disconnects. The blocks it sent are dropped, so
+// the piece still comes from a single peer.
+func (p *pieceDownload) release(peer *peerlib.Peer) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.owner != peer || p.isFinished {
+		return
+	}
+	p.owner = nil
+	for block := range p.received {
+		if p.senders[block] == peer {
+			p.received[block] = false
+			p.senders[block] = nil
+			p.blocksDownloaded--
+		}
+	}
+}
+
+// prune removes from pending the blocks already received, e.g. from other
+// peers in endgame, and returns them. unfinished is false once the piece is
+// finished.
+func (p *pieceDownload) prune(pending map[int]bool) (pruned []int, unfinished bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	for block := range pending {
+		if p.received[block] {
+			delete(pending, block)
+			pruned = append(pruned, block)
+		}
+	}
+	return pruned, !p.isFinished
+}
+
+// freeBlocks returns the amount of blocks nobody requested yet, and the
+// amount of blocks received
+func (p *pieceDownload) freeBlocks() (free, received int) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.isFinished {
+		return 0, p.blocksDownloaded
+	}
+	for block := 0; block < p.totalBlocks; block++ {
+		if !p.received[block] && len(p.requesters[block]) == 0 {
+			free++
+		}
+	}
+	return free, p.blocksDownloaded
+}
+
+// forget removes the pending requests of peer, e.g. when it chokes us and
+// discards them
+func (p *pieceDownload) forget(peer *peerlib.Peer, pending map[int]bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	for block := range pending {
+		p.requesters[block] = slices.DeleteFunc(p.requesters[block], func(r *peerlib.Peer) bool {
+			return r == peer
+		})
+		delete(pending, block)
+	}
+}
+
+// blockData returns the data of a block, the piece must be finished
+func (p *pieceDownload) blockData(block int) []byte {
+	begin := block * BlockSize
+	return p.buffer[begin : begin+p.blockLength(block)]
+}
+
+// receive copies a block sent by peer into the buffer. It returns the other
+// peers that requested the same block, so their requests can be cancelled,
+// and whether this block completed the piece. Duplicated blocks are ignored.
+func (p *pieceDownload) receive(peer *peerlib.Peer, pending map[int]bool, begin int, data []byte) (cancels []*peerlib.Peer, complete bool, err error) {
+	if len(data) > BlockSize { // if block larger disconnect
+		return nil, false, fmt.Errorf("peer send larger block size, expected %d actual %d", BlockSize, len(data))
+	}
+	if begin%BlockSize != 0 || begin >= p.work.length {
+		return nil, false, fmt.Errorf("block begin %d is not a block of the piece", begin)
+	}
+	block := begin / BlockSize
+	if len(data) != p.blockLength(block) {
+		return nil, false, fmt.Errorf("block %d has length %d, expected %d", block, len(data), p.blockLength(block))
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	delete(pending, block)
+	if p.received[block] {
+		return nil, false, nil
+	}
+
+	copy(p.buffer[begin:], data)
+	p.received[block] = true
+	p.senders[block] = peer
+	p.blocksDownloaded++
+	for _, r := range p.requesters[block] {
+		if r != peer {
+			cancels = append(cancels, r)
+		}
+	}
+	p.requesters[block] = nil
+
+	if p.blocksDownloaded == p.totalBlocks && !p.isFinished {
+		p.isFinished = true
+		complete = true
+	}
+
+	return cancels, complete, nil
+}
@@ -0,0 +1,62 @@
+package torrentlib
+
+import (
+	"log/slog"
+
+	"github.com/codecrafters-io/bittorrent-starter-go/internal/torrentlib/trackerlib"
+)
+
+// Scrape gets the stats of torrents from their trackers without announcing
+// them. Torrents that share a tracker are scraped with the same requests, and
+// each torrent tries its trackers in tier order until one knows it. Torrents
+// that no tracker knows are missing from the result.
+func Scrape(torrents []*Torrent) map[[20]byte]trackerlib.ScrapeStats {
+	// info hashes to ask every tracker for
+	infoHashes := make(map[string][][20]byte)
+	for _, torrent := range torrents {
+		for _, tier := range torrent.AnnounceList {
+			for _, announce := range tier {
+				infoHashes[announce] = append(infoHashes[announce], [20]byte(torrent.InfoHash))
+			}
+		}
+	}
+
+	// trackers are scraped lazily, so the fallback ones are only asked if
+	// needed
+	responses := make(map[string]map[[20]byte]trackerlib.ScrapeStats)
+	scrape := func(announce string) map[[20]byte]trackerlib.ScrapeStats {
+		if res, ok := responses[announce]; ok {
+			return res
+		}
+
+		tracker, err := trackerlib.New(announce)
+		if err != nil {
+			slog.Warn("skipping tracker", "tracker", announce, "error", err)
+			responses[announce] = nil
+			return nil
+		}
+
+		res, err := tracker.Scrape(infoHashes[announce])
+		if err != nil {
+			slog.Warn("tracker scrape failed", "tracker", announce, "error", err)
+		}
+		responses[announce] = res
+		return res
+	}
+
+	stats := make(map[[20]byte]trackerlib.ScrapeStats, len(torrents))
+	for _, torrent := range torrents {
+		infoHash := [20]byte(torrent.InfoHash)
+	trackersLoop:
+		for _, tier := range torrent.AnnounceList {
+			for _, announce := range tier {
+				if torrentStats, ok := scrape(announce)[infoHash]; ok {
+					stats[infoHash] = torrentStats
+					break trackersLoop
+				}
+			}
+		}
+	}
+
+	return stats
+}
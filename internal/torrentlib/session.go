@@ -0,0 +1,274 @@
+package torrentlib
+
+import (
+	"context"
+	"log/slog"
+	"sync"
+	"sync/atomic"
+
+	"github.com/codecrafters-io/bittorrent-starter-go/internal/torrentlib/dhtlib"
+	"github.com/codecrafters-io/bittorrent-starter-go/internal/torrentlib/peerlib"
+	"github.com/codecrafters-io/bittorrent-starter-go/internal/torrentlib/trackerlib"
+)
+
+// session is the state of a download shared between its workers
+type session struct {
+	torrent *Torrent
+	storage *Storage
+
+	maxConnections int
+
+	picker     *picker
+	choker     *choker
+	extensions *peerlib.Extensions
+	pex        *pexExtension
+	// dht learns the nodes of peers with a DHT, nil without one
+	dht     *dhtlib.DHT
+	results chan *pieceResult
+	// newPeers receives addresses of peers we may connect to
+	newPeers chan []string
+	// inbound receives peers that connected to us, already handshaked
+	inbound chan *peerlib.Peer
+	// rechokeCh wakes up the choker, see rechoke
+	rechokeCh chan struct{}
+
+	// counters reported to the trackers, in bytes
+	downloaded atomic.Int64
+	uploaded   atomic.Int64
+	verified   atomic.Int64
+
+	// mu guards the pieces we have, the connected peers and their trust
+	mu sync.Mutex
+	// have is our bitfield, only verified pieces written to storage are set
+	have      []byte
+	totalHave int
+	peers     map[*peerlib.Peer]bool
+	// trust and banned are by IP, suspects are the blocks of pieces shared by
+	// several peers that failed the hash check, see ban.go
+	trust    map[string]int
+	banned   map[string]bool
+	suspects map[int][]sentBlock
+}
+
+func newSession(torrent *Torrent, storage *Storage, maxConnections int, uploadSlots int) *session {
+	extensions := peerlib.NewExtensions()
+	extensions.Version = ClientVersion
+	// requests are served as soon as they arrive, so we don't drop any, this
+	// only keeps peers from flooding us
+	extensions.Reqq = peerlib.MaxPipelineDepth
+	// peers that got the torrent from a magnet link download the info
+	// dictionary from us
+	if torrent.info != nil {
+		extensions.MetadataSize = len(torrent.info)
+		extensions.Register("ut_metadata", newMetadataExtension([20]byte(torrent.InfoHash), torrent.info))
+	}
+
+	s := &session{
+		torrent:        torrent,
+		storage:        storage,
+		maxConnections: maxConnections,
+		picker:         newPicker(torrent),
+		choker:         newChoker(uploadSlots),
+		extensions:     extensions,
+		// results channel is bounded by the amount of workers, so at most one
+		// finished piece per worker is held in memory while waiting for disk
+		results:  make(chan *pieceResult, maxConnections),
+		newPeers: make(chan []string, 1),
+		inbound:  make(chan *peerlib.Peer),
+		// one pending wake up is enough, the choker looks at every peer
+		rechokeCh: make(chan struct{}, 1),
+		have:      make([]byte, (torrent.TotalPieces+7)/8),
+		peers:     make(map[*peerlib.Peer]bool),
+		trust:     make(map[string]int),
+		banned:    make(map[string]bool),
+		suspects:  make(map[int][]sentBlock),
+	}
+	s.pex = newPexExtension(s)
+	if !torrent.Private {
+		extensions.Register("ut_pex", s.pex)
+	}
+
+	return s
+}
+
+// capabilities are the reserved bytes of our handshakes, the DHT bit is only
+// set when the download uses a DHT node (never for private torrents)
+func (s *session) capabilities() peerlib.Capabilities {
+	var c peerlib.Capabilities
+	c.Set(peerlib.CapabilityExtensions)
+	if s.dht != nil {
+		c.Set(peerlib.CapabilityDHT)
+	}
+	return c
+}
+
+func (s *session) stats() trackerlib.Stats {
+	return trackerlib.Stats{
+		Uploaded:   int(s.uploaded.Load()),
+		Downloaded: int(s.downloaded.Load()),
+		Left:       s.torrent.Length - int(s.verified.Load()),
+	}
+}
+
+// markHave marks a piece as available for other peers and tells every
+// connected peer about it
+func (s *session) markHave(pieceID int) {
+	s.mu.Lock()
+	if s.have[pieceID/8]>>(7-pieceID%8)&1 == 0 {
+		s.have[pieceID/8] |= 1 << (7 - pieceID%8)
+		s.totalHave++
+	}
+	s.mu.Unlock()
+
+	msg := peerlib.FormatHave(pieceID)
+	for _, peer := range s.connectedPeers() {
+		if err := peer.Send(msg); err != nil {
+			// a peer that is gone is cleaned up by its own worker
+			slog.Debug("could not send have", "peer", peer.Peer, "pieceID", pieceID, "error", err)
+		}
+	}
+}
+
+func (s *session) hasPiece(pieceID int) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if pieceID < 0 || pieceID >= s.torrent.TotalPieces {
+		return false
+	}
+	return s.have[pieceID/8]>>(7-pieceID%8)&1 == 1
+}
+
+// isComplete returns true once every piece is verified
+func (s *session) isComplete() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.totalHave == s.torrent.TotalPieces
+}
+
+func (s *session) addPeer(peer *peerlib.Peer) {
+	s.mu.Lock()
+	s.peers[peer] = true
+	s.mu.Unlock()
+	s.pex.add(peer)
+}
+
+func (s *session) removePeer(peer *peerlib.Peer) {
+	s.mu.Lock()
+	delete(s.peers, peer)
+	s.mu.Unlock()
+	s.pex.remove(peer)
+
+	// its upload slot can be given to another peer
+	if !peer.AmChoking.Load() {
+		s.rechoke()
+	}
+}
+
+// connectedPeers returns the peers with a running worker
+func (s *session) connectedPeers() []*peerlib.Peer {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	peers := make([]*peerlib.Peer, 0, len(s.peers))
+	for peer := range s.peers {
+		peers = append(peers, peer)
+	}
+	return peers
+}
+
+func (s *session) sendResult(ctx context.Context, res *pieceResult) {
+	select {
+	case s.results <- res:
+	case <-ctx.Done():
+	}
+}
+
+// connectPeers keeps up to maxConnections peers connected, each one with its
+// own worker. Addresses are received from newPeers, an address is dialed only
+// once per session. Peers from inbound take a connection too, they are
+// disconnected when there is none left. Banned peers are never connected.
+func (s *session) connectPeers(ctx context.Context) {
+	known := make(map[string]bool)
+	var queue []string
+	active := 0
+	workerID := 0
+	done := make(chan struct{})
+
+	for {
+		for active < s.maxConnections && len(queue) > 0 {
+			peerStr := queue[0]
+			queue = queue[1:]
+			if s.isBanned(peerStr) {
+				continue
+			}
+			active++
+			workerID++
+
+			go func(w int, peerStr string) {
+				defer s.peerDone(ctx, done)
+
+				// the bitfield is read by the worker, peers without pieces may
+				// not send one
+				peer, err := peerlib.NewWithCapabilities(peerStr, s.torrent.InfoHash, s.capabilities())
+				if err != nil {
+					slog.Warn("could not connect to peer", "peer", peerStr, "error", err)
+					return
+				}
+				s.runPeer(ctx, w, peer)
+			}(workerID, peerStr)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case peers := <-s.newPeers:
+			for _, peerStr := range peers {
+				if known[peerStr] {
+					continue
+				}
+				known[peerStr] = true
+				queue = append(queue, peerStr)
+			}
+			slog.Debug("peers queued", "queued", len(queue), "active", active)
+		case peer := <-s.inbound:
+			if s.isBanned(peer.Peer) {
+				slog.Debug("rejecting banned peer", "peer", peer.Peer)
+				peer.Conn.Close()
+				continue
+			}
+			if active >= s.maxConnections {
+				slog.Debug("no connections left for incoming peer", "peer", peer.Peer, "active", active)
+				peer.Conn.Close()
+				continue
+			}
+			active++
+			workerID++
+
+			go func(w int) {
+				defer s.peerDone(ctx, done)
+				s.runPeer(ctx, w, peer)
+			}(workerID)
+		case <-done:
+			active--
+		}
+	}
+}
+
+// runPeer runs the worker of a connected peer until the connection is closed
+// or ctx is done
+func (s *session) runPeer(ctx context.Context, w int, peer *peerlib.Peer) {
+	defer peer.Conn.Close()
+	// closing the connection unblocks any pending read
+	stop := context.AfterFunc(ctx, func() { peer.Conn.Close() })
+	defer stop()
+
+	slog.Info("connected to peer", "workerID", w, "peer", peer.Peer)
+	s.downloadPieceWorker(ctx, w, peer)
+	slog.Info("disconnected from peer", "workerID", w, "peer", peer.Peer)
+}
+
+func (s *session) peerDone(ctx context.Context, done chan<- struct{}) {
+	select {
+	case done <- struct{}{}:
+	case <-ctx.Done():
+	}
+}
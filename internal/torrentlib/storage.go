@@ -0,0 +1,146 @@
+package torrentlib
+
+import (
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+)
+
+// Storage is where verified pieces end up. Each piece is written at its
+// offset straight into preallocated files, so memory use is bounded by the
+// pieces in flight and not by the size of the torrent.
+//
+// Offsets are offsets inside the torrent, that is, inside the concatenation of
+// all of its files. A piece that spans a file boundary is split between them.
+type Storage struct {
+	files  []*storageFile
+	length int64
+}
+
+type storageFile struct {
+	file   *os.File
+	offset int64
+	length int64
+}
+
+// NewStorage creates (or opens) every file under root and preallocates them to
+// their length. Missing directories are created. Paths must be relative and
+// stay inside root.
+func NewStorage(root string, files []File) (*Storage, error) {
+	storage := Storage{
+		files: make([]*storageFile, 0, len(files)),
+	}
+
+	for _, f := range files {
+		if !filepath.IsLocal(f.Path) {
+			storage.Close()
+			return nil, fmt.Errorf("error file path %q is outside of the download directory", f.Path)
+		}
+		if f.Length < 0 {
+			storage.Close()
+			return nil, fmt.Errorf("error file %q has negative length %d", f.Path, f.Length)
+		}
+
+		path := filepath.Join(root, f.Path)
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			storage.Close()
+			return nil, fmt.Errorf("error creating directory for %q: %v", path, err)
+		}
+
+		file, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0644)
+		if err != nil {
+			storage.Close()
+			return nil, fmt.Errorf("error opening output file %q: %v", path, err)
+		}
+
+		// Truncate does not write any byte, on most filesystems this creates a
+		// sparse file, so preallocating is cheap even for big torrents
+		if err = file.Truncate(int64(f.Length)); err != nil {
+			file.Close()
+			storage.Close()
+			return nil, fmt.Errorf("error preallocating output file %q: %v", path, err)
+		}
+
+		storage.files = append(storage.files, &storageFile{
+			file:   file,
+			offset: int64(f.Offset),
+			length: int64(f.Length),
+		})
+		storage.length += int64(f.Length)
+
+		slog.Debug("storage file ready", "path", path, "offset", f.Offset, "length", f.Length)
+	}
+
+	return &storage, nil
+}
+
+// WriteAt writes data at offset off of the torrent
+func (s *Storage) WriteAt(data []byte, off int64) (int, error) {
+	if off < 0 || off+int64(len(data)) > s.length {
+		return 0, fmt.Errorf("write out of bounds, offset %d length %d, storage length %d", off, len(data), s.length)
+	}
+
+	written := 0
+	for _, f := range s.files {
+		if len(data) == 0 {
+			break
+		}
+		// file is before the offset
+		if off >= f.offset+f.length {
+			continue
+		}
+
+		fileOffset := off - f.offset
+		n := min(int64(len(data)), f.length-fileOffset)
+		if _, err := f.file.WriteAt(data[:n], fileOffset); err != nil {
+			return written, err
+		}
+
+		data = data[n:]
+		off += n
+		written += int(n)
+	}
+
+	return written, nil
+}
+
+// ReadAt reads len(data) bytes at offset off of the torrent
+func (s *Storage) ReadAt(data []byte, off int64) (int, error) {
+	if off < 0 || off+int64(len(data)) > s.length {
+		return 0, fmt.Errorf("read out of bounds, offset %d length %d, storage length %d", off, len(data), s.length)
+	}
+
+	read := 0
+	for _, f := range s.files {
+		if len(data) == 0 {
+			break
+		}
+		// file is before the offset
+		if off >= f.offset+f.length {
+			continue
+		}
+
+		fileOffset := off - f.offset
+		n := min(int64(len(data)), f.length-fileOffset)
+		if _, err := f.file.ReadAt(data[:n], fileOffset); err != nil {
+			return read, err
+		}
+
+		data = data[n:]
+		off += n
+		read += int(n)
+	}
+
+	return read, nil
+}
+
+func (s *Storage) Close() error {
+	var err error
+	for _, f := range s.files {
+		if closeErr := f.file.Close(); closeErr != nil && err == nil {
+			err = closeErr
+		}
+	}
+	return err
+}
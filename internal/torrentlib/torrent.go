@@ -4,141 +4,224 @@ import (
 	"crypto/rand"
 	"crypto/sha1"
 	"fmt"
-	"io"
 	"log/slog"
 	"net"
-	"net/http"
-	"net/url"
+	"os"
+	"path/filepath"
 	"strconv"
+	"strings"
 
 	"github.com/codecrafters-io/bittorrent-starter-go/internal/encoding/bencode"
+	"github.com/codecrafters-io/bittorrent-starter-go/internal/torrentlib/trackerlib"
 )
 
+// DefaultPort is where we listen for peers, and the port reported to trackers
+// when there is no other
+const DefaultPort = 6881
+
+// ClientVersion is the client name sent to peers in the extension handshake
+const ClientVersion = "go-torrent"
+
+// Open reads and parses a .torrent file, see Parse
+func Open(file string) (*Torrent, error) {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return nil, fmt.Errorf("error during file %q reading: %v", file, err)
+	}
+	return Parse(data)
+}
+
+// Parse parses the content of a .torrent file. It does not contact the
+// tracker, peers are obtained with Announce.
+func Parse(data []byte) (*Torrent, error) {
+	slog.Debug(fmt.Sprintf("starting unmarshalling of: %s", string(data)))
+	var metaData MetaData
+	if err := bencode.Unmarshal(data, &metaData); err != nil {
+		return nil, fmt.Errorf("error during torrent unmarshaling: %v", err)
+	}
+	return New(metaData)
+}
+
+// New builds a Torrent from its metadata. It does not contact the tracker,
+// peers are obtained with Announce.
 func New(data MetaData) (*Torrent, error) {
 	var torrent Torrent
 
-	length := data.Info.Length
-	pieceLength := data.Info.PieceLength
+	if len(data.Info) == 0 {
+		return nil, fmt.Errorf("torrent has no info dictionary")
+	}
+	var info MetaInfo
+	if err := bencode.Unmarshal(data.Info, &info); err != nil {
+		return nil, fmt.Errorf("error unmarshaling info dictionary: %v", err)
+	}
+
+	files, length, err := getFiles(info)
+	if err != nil {
+		return nil, err
+	}
+	pieceLength := info.PieceLength
+	if pieceLength <= 0 {
+		return nil, fmt.Errorf("invalid piece length %d", pieceLength)
+	}
+	if len(info.Pieces)%20 != 0 {
+		return nil, fmt.Errorf("pieces has length %d, not a multiple of 20", len(info.Pieces))
+	}
 
 	// hash pieces
-	totalPieces := len(data.Info.Pieces) / 20
+	totalPieces := len(info.Pieces) / 20
+	if expected := (length + pieceLength - 1) / pieceLength; totalPieces != expected {
+		return nil, fmt.Errorf("torrent has %d piece hashes, expected %d for %d bytes", totalPieces, expected, length)
+	}
 	piecesHash := make([][]byte, totalPieces)
 	for i := 0; i < totalPieces; i++ {
-		piecesHash[i] = []byte(data.Info.Pieces[i*20 : (i+1)*20])
+		piecesHash[i] = []byte(info.Pieces[i*20 : (i+1)*20])
 	}
 
+	torrent.Name = info.Name
+	torrent.Files = files
+	torrent.MultiFile = len(info.Files) > 0
 	torrent.Length = length
 	torrent.TotalPieces = totalPieces
 	torrent.PieceLength = pieceLength
 	torrent.TrackerUrl = data.Announce
+	torrent.AnnounceList = getAnnounceList(data)
+	torrent.Nodes = getNodes(data)
 	torrent.PiecesHash = piecesHash
+	torrent.Private = info.Private == 1
 
-	infoHash, err := getInfoHash(data)
-	if err != nil {
-		return nil, err
-	}
-	torrent.InfoHash = infoHash
-
-	// NOTE(maolivera): Rembember that getPeers needs the infoHash!!!
+	infoHash := sha1.Sum(data.Info)
+	torrent.InfoHash = infoHash[:]
+	torrent.info = data.Info
 
-	peers, err := torrent.getPeers()
-	if err != nil {
-		return nil, err
+	if _, err := rand.Read(torrent.PeerID[:]); err != nil {
+		return nil, fmt.Errorf("error generating peer_id: %v", err)
 	}
-	torrent.Peers = peers
 
 	return &torrent, nil
 }
 
-func getInfoHash(torrentFile MetaData) ([]byte, error) {
-	infoEncoded, err := bencode.Encode(torrentFile.Info)
-	if err != nil {
-		return nil, fmt.Errorf("error encoding info: %v", err)
-	}
-	h := sha1.New()
-	_, err = h.Write(infoEncoded)
+// Announce asks the trackers for peers, they are also stored in torrent.Peers
+func (torrent *Torrent) Announce() ([]string, error) {
+	req := torrent.announceRequest(DefaultPort)
+	req.Left = torrent.Length
+
+	res, err := torrent.trackerTiers().Announce(&req)
 	if err != nil {
-		return nil, fmt.Errorf("error calculating SHA1 hash: %v", err)
+		return nil, err
 	}
-	hashSum := h.Sum(nil)
+	slog.Info("got peers from trackers", "peers", len(res.Peers), "interval", res.Interval)
+	torrent.Peers = res.Peers
 
-	return hashSum, nil
+	return res.Peers, nil
 }
 
-func (torrent *Torrent) getPeers() ([]string, error) {
-	slog.Info("getting peers")
-	// made GET request to tracker url
-	// query params:
-	queryParams := make([]string, 7)
-
-	// info_hash
-	queryParams[0] = "info_hash=" + url.QueryEscape(string(torrent.InfoHash)) + "&"
-
-	// peer_id
-	peerIDBytes := make([]byte, 20)
-	if _, err := rand.Read(peerIDBytes); err != nil {
-		return nil, fmt.Errorf("error generating peer_id: %v", err)
+func (torrent *Torrent) trackerTiers() *trackerlib.Tiers {
+	if torrent.trackers == nil {
+		torrent.trackers = trackerlib.NewTiers(torrent.AnnounceList)
 	}
-	queryParams[1] = "peer_id=" + url.QueryEscape(string(peerIDBytes)) + "&"
-
-	// port (6881)
-	queryParams[2] = "port=6881&"
-
-	// uploaded
-	queryParams[3] = "uploaded=0&"
-
-	// downloaded
-	queryParams[4] = "downloaded=0&"
-
-	// left
-	queryParams[5] = "left=" + strconv.Itoa(torrent.Length) + "&"
-
-	// compact (1)
-	queryParams[6] = "compact=1"
+	return torrent.trackers
+}
 
-	url := torrent.TrackerUrl + "?"
-	for _, param := range queryParams {
-		url += param
+// announceRequest returns the fields of an announce that don't change during
+// a session, port is where we accept peers
+func (torrent *Torrent) announceRequest(port int) trackerlib.AnnounceRequest {
+	return trackerlib.AnnounceRequest{
+		InfoHash: [20]byte(torrent.InfoHash),
+		PeerID:   torrent.PeerID,
+		Port:     port,
+		IPv6:     trackerlib.LocalIPv6(),
 	}
+}
 
-	slog.Info("making url request", "url", url)
-
-	// get request
-	resp, err := http.Get(url)
-	if err != nil {
-		return nil, fmt.Errorf("error making GET request: %v", err)
+// getAnnounceList returns the tiers of trackers, when the torrent has an
+// announce-list the announce key is ignored, as BEP 12 says
+func getAnnounceList(data MetaData) [][]string {
+	announceList := make([][]string, 0, len(data.AnnounceList))
+	for _, tier := range data.AnnounceList {
+		if len(tier) == 0 {
+			continue
+		}
+		announceList = append(announceList, tier)
 	}
-	if resp.StatusCode != http.StatusOK {
-		return nil, fmt.Errorf("tracker responded with non OK status: %d", resp.StatusCode)
+
+	if len(announceList) == 0 && data.Announce != "" {
+		announceList = append(announceList, []string{data.Announce})
 	}
 
-	var body []byte
+	return announceList
+}
 
-	{
-		body, err = io.ReadAll(resp.Body)
-		defer resp.Body.Close()
-		if err != nil {
-			return nil, fmt.Errorf("error reading response body: %v", err)
+// getNodes returns the DHT nodes of the torrent, invalid entries are skipped
+func getNodes(data MetaData) []string {
+	var nodes []string
+	for _, entry := range data.Nodes {
+		var host string
+		var port int
+		if len(entry) != 2 || bencode.Unmarshal(entry[0], &host) != nil || bencode.Unmarshal(entry[1], &port) != nil {
+			slog.Debug("skipping invalid dht node of torrent", "entries", len(entry))
+			continue
 		}
+		if host == "" || port <= 0 || port > 65535 {
+			continue
+		}
+		nodes = append(nodes, net.JoinHostPort(host, strconv.Itoa(port)))
 	}
+	return nodes
+}
 
-	// decode response
-	slog.Debug(fmt.Sprintf("bencoded string to be unmarshal: %s", string(body)))
-	var trackerResponse TrackerResponse
-	if err = bencode.Unmarshal(body, &trackerResponse); err != nil {
-		return nil, fmt.Errorf("error unmarshaling bencoded response: %v", err)
+// getFiles maps the files of the info dictionary into the files of the
+// torrent and returns the total length
+func getFiles(info MetaInfo) ([]File, int, error) {
+	if err := validatePathElement(info.Name); err != nil {
+		return nil, 0, fmt.Errorf("invalid torrent name: %v", err)
 	}
 
-	// store peers
-	peers := make([]string, len(trackerResponse.Peers) / 6)
-	for i := 0; i < len(trackerResponse.Peers); i += 6 {
-		peer := trackerResponse.Peers[i : i+6]
+	// single-file
+	if len(info.Files) == 0 {
+		files := []File{{
+			Path:   info.Name,
+			Length: info.Length,
+			Offset: 0,
+		}}
+		return files, info.Length, nil
+	}
 
-		ip := net.IP(peer[:4])
-		port := (int(peer[4]) << 8) | int(peer[5])
+	// multi-file
+	files := make([]File, len(info.Files))
+	offset := 0
+	for i, file := range info.Files {
+		if len(file.Path) == 0 {
+			return nil, 0, fmt.Errorf("file %d has an empty path", i)
+		}
+		for _, element := range file.Path {
+			if err := validatePathElement(element); err != nil {
+				return nil, 0, fmt.Errorf("invalid path for file %d: %v", i, err)
+			}
+		}
+		if file.Length < 0 {
+			return nil, 0, fmt.Errorf("file %d has negative length %d", i, file.Length)
+		}
 
-		peers[i / 6] = fmt.Sprintf("%v:%d", ip, port)
+		files[i] = File{
+			Path:   filepath.Join(append([]string{info.Name}, file.Path...)...),
+			Length: file.Length,
+			Offset: offset,
+		}
+		offset += file.Length
 	}
 
-	return peers, nil
+	return files, offset, nil
+}
+
+// validatePathElement rejects the path elements that could write outside of the
+// download directory, paths come from the torrent file and a malicious one
+// could try.
+func validatePathElement(element string) error {
+	if element == "" || element == "." || element == ".." {
+		return fmt.Errorf("path element %q not allowed", element)
+	}
+	if strings.ContainsAny(element, "/\\") {
+		return fmt.Errorf("path element %q contains a separator", element)
+	}
+	return nil
 }
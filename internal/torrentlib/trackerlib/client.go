@@ -0,0 +1,185 @@
+package trackerlib
+
+import (
+	"context"
+	"log/slog"
+	"sync"
+	"time"
+)
+
+// defaultInterval is used when the tracker does not send an interval
+const defaultInterval = 30 * time.Minute
+
+// after a failed announce, wait retryInterval * 2^failures (up to the interval)
+const retryInterval = 30 * time.Second
+
+// a stopped announce must not hold the shutdown for long
+const stoppedTimeout = 5 * time.Second
+
+// Stats are the transfer counters reported to trackers
+type Stats struct {
+	Uploaded   int
+	Downloaded int
+	Left       int
+}
+
+// Client keeps a torrent announced to its trackers during a session. It sends
+// the started event, re-announces every interval, sends completed when told
+// so and stopped on shutdown.
+type Client struct {
+	tiers *Tiers
+	// request holds the fields that don't change between announces
+	request AnnounceRequest
+	stats   func() Stats
+
+	completed chan struct{}
+
+	// mu guards the intervals, a final announce that timed out may still be
+	// running while the next one starts
+	mu           sync.Mutex
+	interval     time.Duration
+	minInterval  time.Duration
+	lastAnnounce time.Time
+}
+
+// NewClient creates a client for tiers. request is used as a template for
+// every announce, counters are taken from stats right before announcing.
+func NewClient(tiers *Tiers, request AnnounceRequest, stats func() Stats) *Client {
+	return &Client{
+		tiers:     tiers,
+		request:   request,
+		stats:     stats,
+		completed: make(chan struct{}, 1),
+		interval:  defaultInterval,
+	}
+}
+
+// Start sends the started event and returns the peers of the response.
+func (c *Client) Start() ([]string, error) {
+	res, err := c.announce(EventStarted)
+	if err != nil {
+		return nil, err
+	}
+	return res.Peers, nil
+}
+
+// Completed makes the client send the completed event, it does not block.
+func (c *Client) Completed() {
+	select {
+	case c.completed <- struct{}{}:
+	default:
+	}
+}
+
+// Run re-announces until ctx is done, and then sends the stopped event. Peers
+// from every response are sent to peers. It must be called after Start.
+func (c *Client) Run(ctx context.Context, peers chan<- []string) {
+	failures := 0
+	timer := time.NewTimer(c.nextAnnounce(failures))
+	defer timer.Stop()
+
+	for {
+		event := EventNone
+		select {
+		case <-ctx.Done():
+			// the download may finish and shut down right away, completed must
+			// still be sent before stopped
+			select {
+			case <-c.completed:
+				c.finalAnnounce(EventCompleted)
+			default:
+			}
+			c.finalAnnounce(EventStopped)
+			return
+		case <-c.completed:
+			event = EventCompleted
+			if !timer.Stop() {
+				select {
+				case <-timer.C:
+				default:
+				}
+			}
+		case <-timer.C:
+		}
+
+		res, err := c.announce(event)
+		if err != nil {
+			failures++
+			slog.Warn("re-announce failed", "event", event.String(), "failures", failures, "error", err)
+			if event == EventCompleted {
+				// try again with the next announce
+				c.Completed()
+			}
+		} else {
+			failures = 0
+			select {
+			case peers <- res.Peers:
+			case <-ctx.Done():
+			}
+		}
+
+		timer.Reset(c.nextAnnounce(failures))
+	}
+}
+
+func (c *Client) announce(event Event) (*AnnounceResponse, error) {
+	stats := c.stats()
+	req := c.request
+	req.Uploaded = stats.Uploaded
+	req.Downloaded = stats.Downloaded
+	req.Left = stats.Left
+	req.Event = event
+
+	slog.Info("announcing", "event", event.String(), "uploaded", req.Uploaded, "downloaded", req.Downloaded, "left", req.Left)
+	c.mu.Lock()
+	c.lastAnnounce = time.Now()
+	c.mu.Unlock()
+
+	res, err := c.tiers.Announce(&req)
+	if err != nil {
+		return nil, err
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if res.Interval > 0 {
+		c.interval = time.Duration(res.Interval) * time.Second
+	}
+	c.minInterval = time.Duration(res.MinInterval) * time.Second
+	slog.Debug("announce intervals", "interval", c.interval, "minInterval", c.minInterval, "peers", len(res.Peers))
+
+	return res, nil
+}
+
+// nextAnnounce returns how long to wait until the next announce, never
+// sooner than min interval after the last one
+func (c *Client) nextAnnounce(failures int) time.Duration {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	wait := c.interval
+	if failures > 0 {
+		wait = min(retryInterval*time.Duration(1<<min(failures-1, 10)), c.interval)
+	}
+	wait = max(wait, c.minInterval)
+
+	return wait - time.Since(c.lastAnnounce)
+}
+
+// finalAnnounce announces an event during shutdown, waiting at most
+// stoppedTimeout for the trackers
+func (c *Client) finalAnnounce(event Event) {
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		if _, err := c.announce(event); err != nil {
+			slog.Warn("final announce failed", "event", event.String(), "error", err)
+		}
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(stoppedTimeout):
+		slog.Warn("final announce timed out", "event", event.String(), "timeout", stoppedTimeout)
+	}
+}
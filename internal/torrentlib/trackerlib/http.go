@@ -0,0 +1,212 @@
+package trackerlib
+
+import (
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/codecrafters-io/bittorrent-starter-go/internal/encoding/bencode"
+)
+
+const httpTimeout = 30 * time.Second
+
+type httpTracker struct {
+	announce string
+	client   *http.Client
+
+	// trackerID is sent back on every announce once the tracker gives one
+	mu        sync.Mutex
+	trackerID string
+}
+
+func newHTTPTracker(announce string) *httpTracker {
+	return &httpTracker{
+		announce: announce,
+		client:   &http.Client{Timeout: httpTimeout},
+	}
+}
+
+func (t *httpTracker) URL() string {
+	return t.announce
+}
+
+func (t *httpTracker) Announce(req *AnnounceRequest) (*AnnounceResponse, error) {
+	slog.Info("getting peers", "tracker", t.announce)
+	// made GET request to tracker url
+	// query params:
+	queryParams := make([]string, 7)
+
+	// info_hash
+	queryParams[0] = "info_hash=" + url.QueryEscape(string(req.InfoHash[:])) + "&"
+
+	// peer_id
+	queryParams[1] = "peer_id=" + url.QueryEscape(string(req.PeerID[:])) + "&"
+
+	// port
+	queryParams[2] = "port=" + strconv.Itoa(req.Port) + "&"
+
+	// uploaded
+	queryParams[3] = "uploaded=" + strconv.Itoa(req.Uploaded) + "&"
+
+	// downloaded
+	queryParams[4] = "downloaded=" + strconv.Itoa(req.Downloaded) + "&"
+
+	// left
+	queryParams[5] = "left=" + strconv.Itoa(req.Left) + "&"
+
+	// compact (1)
+	queryParams[6] = "compact=1"
+
+	// event, omitted for regular announces
+	if req.Event != EventNone {
+		queryParams = append(queryParams, "&event="+req.Event.String())
+	}
+
+	// ipv6, BEP 7
+	if req.IPv6 != nil {
+		queryParams = append(queryParams, "&ipv6="+url.QueryEscape(req.IPv6.String()))
+	}
+
+	// trackerid, if a previous announce got one
+	t.mu.Lock()
+	if t.trackerID != "" {
+		queryParams = append(queryParams, "&trackerid="+url.QueryEscape(t.trackerID))
+	}
+	t.mu.Unlock()
+
+	url := t.announce + querySeparator(t.announce)
+	for _, param := range queryParams {
+		url += param
+	}
+
+	slog.Info("making url request", "url", url)
+
+	// get request
+	resp, err := t.client.Get(url)
+	if err != nil {
+		return nil, fmt.Errorf("error making GET request: %v", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("tracker responded with non OK status: %d", resp.StatusCode)
+	}
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("error reading response body: %v", err)
+	}
+
+	// decode response
+	slog.Debug(fmt.Sprintf("bencoded string to be unmarshal: %s", string(body)))
+	var trackerResponse TrackerResponse
+	if err = bencode.Unmarshal(body, &trackerResponse); err != nil {
+		return nil, fmt.Errorf("error unmarshaling bencoded response: %v", err)
+	}
+
+	if trackerResponse.FailureReason != "" {
+		return nil, &FailureError{Tracker: t.announce, Reason: trackerResponse.FailureReason}
+	}
+	if trackerResponse.WarningMessage != "" {
+		slog.Warn("tracker warning", "tracker", t.announce, "warning", trackerResponse.WarningMessage)
+	}
+	if trackerResponse.TrackerID != "" {
+		t.mu.Lock()
+		t.trackerID = trackerResponse.TrackerID
+		t.mu.Unlock()
+	}
+
+	// store peers
+	peers, err := parsePeers(trackerResponse.Peers)
+	if err != nil {
+		return nil, err
+	}
+	peers6, err := ParseCompactPeers6([]byte(trackerResponse.Peers6))
+	if err != nil {
+		return nil, err
+	}
+	peers = append(peers, peers6...)
+
+	return &AnnounceResponse{
+		Interval:    trackerResponse.Interval,
+		MinInterval: trackerResponse.MinInterval,
+		Leechers:    trackerResponse.Incomplete,
+		Seeders:     trackerResponse.Complete,
+		Peers:       peers,
+	}, nil
+}
+
+// querySeparator returns what goes before the params added to a tracker URL,
+// private trackers often have a query already (e.g. ?passkey=...)
+func querySeparator(trackerURL string) string {
+	if strings.Contains(trackerURL, "?") {
+		return "&"
+	}
+	return "?"
+}
+
+// Scrape gets the stats of torrents, 74 per request
+func (t *httpTracker) Scrape(infoHashes [][20]byte) (map[[20]byte]ScrapeStats, error) {
+	scrapeURL, err := ScrapeURL(t.announce)
+	if err != nil {
+		return nil, err
+	}
+
+	return scrapeInChunks(infoHashes, func(chunk [][20]byte) (map[[20]byte]ScrapeStats, error) {
+		return t.scrape(scrapeURL, chunk)
+	})
+}
+
+func (t *httpTracker) scrape(scrapeURL string, infoHashes [][20]byte) (map[[20]byte]ScrapeStats, error) {
+	// one info_hash param per torrent
+	requestURL := scrapeURL
+	separator := querySeparator(scrapeURL)
+	for _, infoHash := range infoHashes {
+		requestURL += separator + "info_hash=" + url.QueryEscape(string(infoHash[:]))
+		separator = "&"
+	}
+
+	slog.Info("making scrape request", "url", requestURL)
+
+	resp, err := t.client.Get(requestURL)
+	if err != nil {
+		return nil, fmt.Errorf("error making GET request: %v", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("tracker responded with non OK status: %d", resp.StatusCode)
+	}
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("error reading response body: %v", err)
+	}
+
+	var scrapeResponse ScrapeResponse
+	if err = bencode.Unmarshal(body, &scrapeResponse); err != nil {
+		return nil, fmt.Errorf("error unmarshaling bencoded scrape response: %v", err)
+	}
+	if scrapeResponse.FailureReason != "" {
+		return nil, &FailureError{Tracker: t.announce, Reason: scrapeResponse.FailureReason}
+	}
+
+	stats := make(map[[20]byte]ScrapeStats, len(scrapeResponse.Files))
+	for infoHash, file := range scrapeResponse.Files {
+		if len(infoHash) != 20 {
+			slog.Debug("skipping scrape entry with invalid info hash", "infoHash", fmt.Sprintf("%x", infoHash))
+			continue
+		}
+		stats[[20]byte([]byte(infoHash))] = ScrapeStats{
+			Seeders:   file.Complete,
+			Completed: file.Downloaded,
+			Leechers:  file.Incomplete,
+		}
+	}
+
+	return stats, nil
+}
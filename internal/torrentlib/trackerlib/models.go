@@ -0,0 +1,39 @@
+package trackerlib
+
+import "github.com/codecrafters-io/bittorrent-starter-go/internal/encoding/bencode"
+
+// TrackerResponse is the response of an HTTP tracker. Peers can be a compact
+// string or a list of dictionaries, so they are kept raw and decoded later, see
+// parsePeers.
+type TrackerResponse struct {
+	FailureReason  string             `bencode:"failure reason"`
+	WarningMessage string             `bencode:"warning message"`
+	Interval       int                `bencode:"interval"`
+	MinInterval    int                `bencode:"min interval"`
+	TrackerID      string             `bencode:"tracker id"`
+	Complete       int                `bencode:"complete"`
+	Incomplete     int                `bencode:"incomplete"`
+	Peers          bencode.RawMessage `bencode:"peers"`
+	Peers6         string             `bencode:"peers6"`
+}
+
+// TrackerPeer is a peer of the dictionary model, used when trackers do not
+// send compact responses
+type TrackerPeer struct {
+	PeerID string `bencode:"peer id"`
+	IP     string `bencode:"ip"`
+	Port   int    `bencode:"port"`
+}
+
+// ScrapeResponse is the response of an HTTP tracker scrape, files are keyed by
+// info hash
+type ScrapeResponse struct {
+	FailureReason string                `bencode:"failure reason"`
+	Files         map[string]ScrapeFile `bencode:"files"`
+}
+
+type ScrapeFile struct {
+	Complete   int `bencode:"complete"`
+	Downloaded int `bencode:"downloaded"`
+	Incomplete int `bencode:"incomplete"`
+}
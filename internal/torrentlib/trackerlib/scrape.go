@@ -0,0 +1,47 @@
+package trackerlib
+
+import (
+	"fmt"
+	"maps"
+	"strings"
+)
+
+// scrapeInChunks splits infoHashes in chunks of MaxScrapeHashes and scrapes
+// each one with scrape
+func scrapeInChunks(infoHashes [][20]byte, scrape func([][20]byte) (map[[20]byte]ScrapeStats, error)) (map[[20]byte]ScrapeStats, error) {
+	if len(infoHashes) == 0 {
+		return nil, fmt.Errorf("no torrent to scrape")
+	}
+
+	stats := make(map[[20]byte]ScrapeStats, len(infoHashes))
+	for start := 0; start < len(infoHashes); start += MaxScrapeHashes {
+		end := min(start+MaxScrapeHashes, len(infoHashes))
+		chunk, err := scrape(infoHashes[start:end])
+		if err != nil {
+			return nil, err
+		}
+		maps.Copy(stats, chunk)
+	}
+
+	return stats, nil
+}
+
+// ScrapeURL derives the scrape URL of an HTTP tracker from its announce URL.
+// The last path element must start with "announce", which is replaced by
+// "scrape", otherwise the tracker does not support scraping.
+//
+// e.g. http://example.com/x/announce.php?a=1 -> http://example.com/x/scrape.php?a=1
+func ScrapeURL(announce string) (string, error) {
+	path, query, _ := strings.Cut(announce, "?")
+
+	slash := strings.LastIndex(path, "/")
+	if slash < 0 || !strings.HasPrefix(path[slash+1:], "announce") {
+		return "", fmt.Errorf("tracker %s does not support scrape", announce)
+	}
+
+	scrape := path[:slash+1] + "scrape" + strings.TrimPrefix(path[slash+1:], "announce")
+	if query != "" {
+		scrape += "?" + query
+	}
+	return scrape, nil
+}
@@ -0,0 +1,204 @@
+package trackerlib
+
+import (
+	"fmt"
+	"log/slog"
+	"math/rand"
+	"slices"
+	"sync"
+	"time"
+)
+
+// TrackerTimeout is how long a tracker has to answer an announce before the
+// next tracker of its tier is tried
+const TrackerTimeout = 15 * time.Second
+
+// Tiers is the announce-list of a torrent, BEP 12
+//
+// Trackers are grouped in tiers, the order of the tiers is kept but trackers
+// are shuffled within each tier. When a tracker responds it is moved to the
+// front of its tier, so it is the first one tried on the next announce.
+type Tiers struct {
+	// Timeout is how long each tracker has to answer, TrackerTimeout by
+	// default
+	Timeout time.Duration
+
+	// mu guards the order of the trackers, it is not held while announcing
+	mu    sync.Mutex
+	tiers [][]Tracker
+}
+
+// NewTiers creates the trackers of every tier. Trackers with unsupported or
+// invalid URLs are skipped, as are tiers left empty.
+func NewTiers(announceList [][]string) *Tiers {
+	tiers := make([][]Tracker, 0, len(announceList))
+	for _, urls := range announceList {
+		tier := make([]Tracker, 0, len(urls))
+		for _, announce := range urls {
+			tracker, err := New(announce)
+			if err != nil {
+				slog.Warn("skipping tracker", "tracker", announce, "error", err)
+				continue
+			}
+			tier = append(tier, tracker)
+		}
+		if len(tier) == 0 {
+			continue
+		}
+
+		rand.Shuffle(len(tier), func(i, j int) {
+			tier[i], tier[j] = tier[j], tier[i]
+		})
+		tiers = append(tiers, tier)
+	}
+
+	return &Tiers{Timeout: TrackerTimeout, tiers: tiers}
+}
+
+// URLs returns the announce URLs of every tier, in the order they are tried
+func (t *Tiers) URLs() [][]string {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	urls := make([][]string, len(t.tiers))
+	for i, tier := range t.tiers {
+		urls[i] = make([]string, len(tier))
+		for j, tracker := range tier {
+			urls[i][j] = tracker.URL()
+		}
+	}
+	return urls
+}
+
+// Announce announces to one tracker of every tier. Tiers are announced to at
+// the same time, trackers of a tier are tried in order until one responds,
+// that one is promoted to the front of its tier.
+//
+// BEP 12 stops at the first tier that responds, but we ask every tier so we get
+// as many peers as possible. Peers of all the successful responses are merged.
+func (t *Tiers) Announce(req *AnnounceRequest) (*AnnounceResponse, error) {
+	// trackers are announced to without holding the lock, on a copy of the
+	// tiers
+	t.mu.Lock()
+	tiers := make([][]Tracker, len(t.tiers))
+	for i, tier := range t.tiers {
+		tiers[i] = slices.Clone(tier)
+	}
+	t.mu.Unlock()
+
+	if len(tiers) == 0 {
+		return nil, fmt.Errorf("torrent has no usable tracker")
+	}
+
+	type tierResult struct {
+		res *AnnounceResponse
+		err error
+	}
+	results := make([]tierResult, len(tiers))
+	var wg sync.WaitGroup
+	for tierID, tier := range tiers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			res, err := t.announceTier(tierID, tier, req)
+			results[tierID] = tierResult{res, err}
+		}()
+	}
+	wg.Wait()
+
+	var merged *AnnounceResponse
+	seen := make(map[string]bool)
+	var lastErr error
+	for _, result := range results {
+		if result.err != nil {
+			lastErr = result.err
+			continue
+		}
+		if merged == nil {
+			merged = &AnnounceResponse{}
+		}
+		mergeResponse(merged, result.res, seen)
+	}
+
+	if merged == nil {
+		return nil, fmt.Errorf("every tracker failed, last error: %w", lastErr)
+	}
+
+	return merged, nil
+}
+
+// announceTier tries the trackers of a tier in order, and returns the first
+// response
+func (t *Tiers) announceTier(tierID int, tier []Tracker, req *AnnounceRequest) (*AnnounceResponse, error) {
+	var lastErr error
+	for _, tracker := range tier {
+		res, err := t.announceTracker(tracker, req)
+		if err != nil {
+			slog.Warn("tracker announce failed", "tier", tierID, "tracker", tracker.URL(), "error", err)
+			lastErr = err
+			continue
+		}
+		t.promote(tierID, tracker)
+		return res, nil
+	}
+	return nil, lastErr
+}
+
+// announceTracker announces to tracker, giving up after t.Timeout. The
+// announce of a tracker that times out goes on in the background, and its
+// response is dropped.
+func (t *Tiers) announceTracker(tracker Tracker, req *AnnounceRequest) (*AnnounceResponse, error) {
+	type result struct {
+		res *AnnounceResponse
+		err error
+	}
+	done := make(chan result, 1)
+	go func() {
+		res, err := tracker.Announce(req)
+		done <- result{res, err}
+	}()
+
+	timer := time.NewTimer(t.Timeout)
+	defer timer.Stop()
+
+	select {
+	case r := <-done:
+		return r.res, r.err
+	case <-timer.C:
+		return nil, fmt.Errorf("tracker %s did not answer in %v", tracker.URL(), t.Timeout)
+	}
+}
+
+// promote moves tracker to the front of its tier
+func (t *Tiers) promote(tierID int, tracker Tracker) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	tier := t.tiers[tierID]
+	i := slices.Index(tier, tracker)
+	if i < 0 {
+		return
+	}
+	copy(tier[1:i+1], tier[:i])
+	tier[0] = tracker
+}
+
+// mergeResponse adds the peers of res not yet seen into merged. The shortest
+// interval is kept, so no tracker is announced later than it asked, and the
+// longest min interval, so no tracker is announced sooner than it allows.
+func mergeResponse(merged, res *AnnounceResponse, seen map[string]bool) {
+	if res.Interval > 0 && (merged.Interval <= 0 || res.Interval < merged.Interval) {
+		merged.Interval = res.Interval
+	}
+	merged.MinInterval = max(merged.MinInterval, res.MinInterval)
+	merged.Seeders = max(merged.Seeders, res.Seeders)
+	merged.Leechers = max(merged.Leechers, res.Leechers)
+
+	for _, peer := range res.Peers {
+		if seen[peer] {
+			continue
+		}
+		seen[peer] = true
+		merged.Peers = append(merged.Peers, peer)
+	}
+}
@@ -0,0 +1,219 @@
+package trackerlib
+
+import (
+	"fmt"
+	"log/slog"
+	"net"
+	"net/url"
+	"strconv"
+
+	"github.com/codecrafters-io/bittorrent-starter-go/internal/encoding/bencode"
+)
+
+// Tracker is a tracker of a single announce URL. Implementations keep state
+// between announces (e.g. the connection ID of UDP trackers), so the same
+// Tracker should be reused for the whole session.
+type Tracker interface {
+	Announce(req *AnnounceRequest) (*AnnounceResponse, error)
+	Scraper
+	URL() string
+}
+
+// Scraper reports the stats of torrents without announcing them, BEP 48.
+// Torrents the tracker does not know are missing from the result.
+type Scraper interface {
+	Scrape(infoHashes [][20]byte) (map[[20]byte]ScrapeStats, error)
+}
+
+// MaxScrapeHashes is the amount of torrents scraped with a single request,
+// more are split into several requests
+const MaxScrapeHashes = 74
+
+type AnnounceRequest struct {
+	InfoHash   [20]byte
+	PeerID     [20]byte
+	Port       int
+	Uploaded   int
+	Downloaded int
+	Left       int
+	Event      Event
+	// IPv6 is our IPv6 address, sent to HTTP trackers so they can hand it to
+	// IPv6 peers even if we announce over IPv4
+	IPv6 net.IP
+}
+
+type AnnounceResponse struct {
+	// Interval is the amount of seconds to wait between announces
+	Interval int
+	// MinInterval is the minimum amount of seconds between announces, 0 if
+	// the tracker did not send it
+	MinInterval int
+	Leechers    int
+	Seeders     int
+	Peers       []string
+}
+
+type Event int
+
+// Event values match the ones used by UDP trackers
+const (
+	EventNone Event = iota
+	EventCompleted
+	EventStarted
+	EventStopped
+)
+
+// String returns the value of the event query param of HTTP trackers, empty
+// for EventNone
+func (event Event) String() string {
+	switch event {
+	case EventCompleted:
+		return "completed"
+	case EventStarted:
+		return "started"
+	case EventStopped:
+		return "stopped"
+	default:
+		return ""
+	}
+}
+
+// FailureError is returned when a tracker refuses an announce, Reason is the
+// human readable reason sent by the tracker
+type FailureError struct {
+	Tracker string
+	Reason  string
+}
+
+func (err *FailureError) Error() string {
+	return fmt.Sprintf("tracker %s failure: %s", err.Tracker, err.Reason)
+}
+
+type ScrapeStats struct {
+	Seeders   int
+	Completed int
+	Leechers  int
+}
+
+// New returns a Tracker for the announce URL, the protocol is selected by the
+// scheme of the URL.
+func New(announce string) (Tracker, error) {
+	u, err := url.Parse(announce)
+	if err != nil {
+		return nil, fmt.Errorf("error parsing announce url %q: %v", announce, err)
+	}
+
+	switch u.Scheme {
+	case "http", "https":
+		return newHTTPTracker(announce), nil
+	case "udp":
+		if u.Port() == "" {
+			return nil, fmt.Errorf("udp announce url %q has no port", announce)
+		}
+		return newUDPTracker(announce, u.Host), nil
+	default:
+		return nil, fmt.Errorf("unsupported tracker protocol %q", u.Scheme)
+	}
+}
+
+// parsePeers parses the peers of an HTTP tracker response, which can be
+// either compact or a list of dictionaries
+func parsePeers(raw bencode.RawMessage) ([]string, error) {
+	if len(raw) == 0 {
+		return nil, nil
+	}
+
+	// list of dictionaries
+	if raw[0] == 'l' {
+		var trackerPeers []TrackerPeer
+		if err := bencode.Unmarshal(raw, &trackerPeers); err != nil {
+			return nil, fmt.Errorf("error unmarshaling peers list: %v", err)
+		}
+		peers := make([]string, 0, len(trackerPeers))
+		for _, peer := range trackerPeers {
+			if peer.IP == "" || peer.Port <= 0 || peer.Port > 65535 {
+				slog.Debug("skipping invalid peer", "ip", peer.IP, "port", peer.Port)
+				continue
+			}
+			peers = append(peers, net.JoinHostPort(peer.IP, strconv.Itoa(peer.Port)))
+		}
+		return peers, nil
+	}
+
+	// compact
+	var compact string
+	if err := bencode.Unmarshal(raw, &compact); err != nil {
+		return nil, fmt.Errorf("error unmarshaling compact peers: %v", err)
+	}
+	return ParseCompactPeers([]byte(compact))
+}
+
+// compact peers are 4 (IPv4) or 16 (IPv6, BEP 7) bytes of IP followed by 2
+// bytes of port (big endian)
+const compactPeerLength = 6
+const compactPeer6Length = 18
+
+// ParseCompactPeers parses IPv4 peers in compact form
+func ParseCompactPeers(data []byte) ([]string, error) {
+	return parseCompact(data, compactPeerLength)
+}
+
+// ParseCompactPeers6 parses IPv6 peers in compact form, BEP 7
+func ParseCompactPeers6(data []byte) ([]string, error) {
+	return parseCompact(data, compactPeer6Length)
+}
+
+// FormatCompactPeer returns the compact form of a peer address, 6 bytes for
+// IPv4 and 18 for IPv6
+func FormatCompactPeer(addr string) ([]byte, error) {
+	host, portStr, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, fmt.Errorf("invalid peer address %q: %v", addr, err)
+	}
+	ip := net.ParseIP(host)
+	port, err := strconv.Atoi(portStr)
+	if ip == nil || err != nil || port <= 0 || port > 65535 {
+		return nil, fmt.Errorf("invalid peer address %q", addr)
+	}
+
+	if ip4 := ip.To4(); ip4 != nil {
+		ip = ip4
+	}
+	return append(ip, byte(port>>8), byte(port)), nil
+}
+
+func parseCompact(data []byte, entryLength int) ([]string, error) {
+	if len(data)%entryLength != 0 {
+		return nil, fmt.Errorf("compact peers length %d is not a multiple of %d", len(data), entryLength)
+	}
+
+	peers := make([]string, len(data)/entryLength)
+	for i := 0; i < len(data); i += entryLength {
+		peer := data[i : i+entryLength]
+		ipLength := entryLength - 2
+
+		ip := net.IP(peer[:ipLength])
+		port := (int(peer[ipLength]) << 8) | int(peer[ipLength+1])
+
+		// JoinHostPort adds the brackets IPv6 addresses need
+		peers[i/entryLength] = net.JoinHostPort(ip.String(), strconv.Itoa(port))
+	}
+
+	return peers, nil
+}
+
+// LocalIPv6 returns our global IPv6 address, nil if we have none. No packet is
+// sent, it only asks the OS which address would be used to reach the internet.
+func LocalIPv6() net.IP {
+	conn, err := net.Dial("udp6", "[2001:4860:4860::8888]:53")
+	if err != nil {
+		return nil
+	}
+	defer conn.Close()
+
+	ip := conn.LocalAddr().(*net.UDPAddr).IP
+	if !ip.IsGlobalUnicast() || ip.IsPrivate() {
+		return nil
+	}
+	return ip
+}
@@ -0,0 +1,344 @@
+package trackerlib
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+// UDP tracker protocol, BEP 15
+//
+// Every exchange is a single datagram each way, requests are matched with
+// responses by a random transaction ID. Before announcing or scraping, the
+// client must get a connection ID from the tracker, it can be reused for a
+// minute.
+
+const udpProtocolID = 0x41727101980
+
+const (
+	actionConnect uint32 = iota
+	actionAnnounce
+	actionScrape
+	actionError
+)
+
+// BEP 15 says to wait 15 * 2^n seconds for a response before retransmitting,
+// with n going up to 8, over two hours for a dead tracker. We keep the
+// exponential backoff with shorter timeouts, and give up after
+// udpRequestTimeout so the next tracker gets its turn.
+const udpBaseTimeout = 2 * time.Second
+const udpMaxRetransmissions = 3
+const udpRequestTimeout = 15 * time.Second
+const udpConnectionIDTTL = time.Minute
+
+// udpMaxPacketSize is large enough for an announce response with ~1500 peers
+const udpMaxPacketSize = 8192
+
+var errUDPTimeout = errors.New("udp tracker did not respond in time")
+
+type udpTracker struct {
+	announce string
+	host     string
+	key      uint32
+
+	// mu serializes the exchanges, there is only one request in flight
+	mu             sync.Mutex
+	conn           *net.UDPConn
+	connectionID   uint64
+	connectionTime time.Time
+}
+
+func newUDPTracker(announce, host string) *udpTracker {
+	keyBytes := make([]byte, 4)
+	rand.Read(keyBytes)
+
+	return &udpTracker{
+		announce: announce,
+		host:     host,
+		key:      binary.BigEndian.Uint32(keyBytes),
+	}
+}
+
+func (t *udpTracker) URL() string {
+	return t.announce
+}
+
+// Announce announces the torrent to the tracker
+//
+// Request (98 bytes):
+// - connection_id (u64)
+// - action (u32): 1
+// - transaction_id (u32)
+// - info_hash (20 bytes)
+// - peer_id (20 bytes)
+// - downloaded (u64)
+// - left (u64)
+// - uploaded (u64)
+// - event (u32): 0 none, 1 completed, 2 started, 3 stopped
+// - IP address (u32): 0 to use the sender address
+// - key (u32)
+// - num_want (i32): -1 for default
+// - port (u16)
+//
+// Response (20 + 6n bytes):
+// - action (u32): 1
+// - transaction_id (u32)
+// - interval (u32)
+// - leechers (u32)
+// - seeders (u32)
+// - n peers, 4 bytes of IP (16 for IPv6 trackers) and 2 of port each
+func (t *udpTracker) Announce(req *AnnounceRequest) (*AnnounceResponse, error) {
+	slog.Info("getting peers", "tracker", t.announce)
+
+	build := func(connectionID uint64, transactionID uint32) []byte {
+		packet := make([]byte, 98)
+		binary.BigEndian.PutUint64(packet[0:8], connectionID)
+		binary.BigEndian.PutUint32(packet[8:12], actionAnnounce)
+		binary.BigEndian.PutUint32(packet[12:16], transactionID)
+		copy(packet[16:36], req.InfoHash[:])
+		copy(packet[36:56], req.PeerID[:])
+		binary.BigEndian.PutUint64(packet[56:64], uint64(req.Downloaded))
+		binary.BigEndian.PutUint64(packet[64:72], uint64(req.Left))
+		binary.BigEndian.PutUint64(packet[72:80], uint64(req.Uploaded))
+		binary.BigEndian.PutUint32(packet[80:84], uint32(req.Event))
+		binary.BigEndian.PutUint32(packet[84:88], 0)
+		binary.BigEndian.PutUint32(packet[88:92], t.key)
+		binary.BigEndian.PutUint32(packet[92:96], 0xFFFFFFFF) // -1
+		binary.BigEndian.PutUint16(packet[96:98], uint16(req.Port))
+		return packet
+	}
+
+	res, err := t.request(actionAnnounce, build)
+	if err != nil {
+		return nil, err
+	}
+	if len(res) < 20 {
+		return nil, fmt.Errorf("announce response too short: %d bytes", len(res))
+	}
+
+	// when the tracker is reached over IPv6, peers are 18 bytes long (16 of IP)
+	parse := ParseCompactPeers
+	if t.conn.RemoteAddr().(*net.UDPAddr).IP.To4() == nil {
+		parse = ParseCompactPeers6
+	}
+	peers, err := parse(res[20:])
+	if err != nil {
+		return nil, err
+	}
+
+	return &AnnounceResponse{
+		Interval: int(binary.BigEndian.Uint32(res[8:12])),
+		Leechers: int(binary.BigEndian.Uint32(res[12:16])),
+		Seeders:  int(binary.BigEndian.Uint32(res[16:20])),
+		Peers:    peers,
+	}, nil
+}
+
+// Scrape gets the stats of torrents, 74 per request
+func (t *udpTracker) Scrape(infoHashes [][20]byte) (map[[20]byte]ScrapeStats, error) {
+	return scrapeInChunks(infoHashes, t.scrape)
+}
+
+// scrape gets the stats of up to 74 torrents
+//
+// Request (16 + 20n bytes):
+// - connection_id (u64)
+// - action (u32): 2
+// - transaction_id (u32)
+// - n info hashes (20 bytes each)
+//
+// Response (8 + 12n bytes):
+// - action (u32): 2
+// - transaction_id (u32)
+// - n times seeders (u32), completed (u32), leechers (u32), in request order
+func (t *udpTracker) scrape(infoHashes [][20]byte) (map[[20]byte]ScrapeStats, error) {
+
+	build := func(connectionID uint64, transactionID uint32) []byte {
+		packet := make([]byte, 16+20*len(infoHashes))
+		binary.BigEndian.PutUint64(packet[0:8], connectionID)
+		binary.BigEndian.PutUint32(packet[8:12], actionScrape)
+		binary.BigEndian.PutUint32(packet[12:16], transactionID)
+		for i, infoHash := range infoHashes {
+			copy(packet[16+20*i:], infoHash[:])
+		}
+		return packet
+	}
+
+	res, err := t.request(actionScrape, build)
+	if err != nil {
+		return nil, err
+	}
+	if len(res) < 8+12*len(infoHashes) {
+		return nil, fmt.Errorf("scrape response too short: %d bytes for %d torrents", len(res), len(infoHashes))
+	}
+
+	stats := make(map[[20]byte]ScrapeStats, len(infoHashes))
+	for i, infoHash := range infoHashes {
+		entry := res[8+12*i : 8+12*(i+1)]
+		stats[infoHash] = ScrapeStats{
+			Seeders:   int(binary.BigEndian.Uint32(entry[0:4])),
+			Completed: int(binary.BigEndian.Uint32(entry[4:8])),
+			Leechers:  int(binary.BigEndian.Uint32(entry[8:12])),
+		}
+	}
+
+	return stats, nil
+}
+
+// request sends the packet built by build, getting a connection ID first if
+// needed, and retransmits it until a response arrives or we run out of
+// retransmissions. The response is returned with its header.
+func (t *udpTracker) request(action uint32, build func(connectionID uint64, transactionID uint32) []byte) ([]byte, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if err := t.dial(); err != nil {
+		return nil, err
+	}
+
+	deadline := time.Now().Add(udpRequestTimeout)
+	for n := 0; n <= udpMaxRetransmissions; n++ {
+		timeout := min(udpBaseTimeout*time.Duration(1<<n), time.Until(deadline))
+		if timeout <= 0 {
+			break
+		}
+
+		// the connection ID could expire while we were retransmitting, so check
+		// it on every try
+		if time.Since(t.connectionTime) > udpConnectionIDTTL {
+			if err := t.connect(timeout); err != nil {
+				if errors.Is(err, errUDPTimeout) {
+					slog.Warn("udp tracker connect timed out", "tracker", t.announce, "try", n, "timeout", timeout)
+					continue
+				}
+				return nil, err
+			}
+			// connecting used part of the time left
+			if timeout = min(timeout, time.Until(deadline)); timeout <= 0 {
+				break
+			}
+		}
+
+		transactionID := newTransactionID()
+		res, err := t.exchange(build(t.connectionID, transactionID), action, transactionID, timeout)
+		if errors.Is(err, errUDPTimeout) {
+			slog.Warn("udp tracker request timed out", "tracker", t.announce, "action", action, "try", n, "timeout", timeout)
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		return res, nil
+	}
+
+	return nil, fmt.Errorf("udp tracker %s: %v after %v", t.announce, errUDPTimeout, udpRequestTimeout)
+}
+
+// connect gets a new connection ID
+//
+// Request (16 bytes):
+// - protocol_id (u64): 0x41727101980
+// - action (u32): 0
+// - transaction_id (u32)
+//
+// Response (16 bytes):
+// - action (u32): 0
+// - transaction_id (u32)
+// - connection_id (u64)
+func (t *udpTracker) connect(timeout time.Duration) error {
+	transactionID := newTransactionID()
+
+	packet := make([]byte, 16)
+	binary.BigEndian.PutUint64(packet[0:8], udpProtocolID)
+	binary.BigEndian.PutUint32(packet[8:12], actionConnect)
+	binary.BigEndian.PutUint32(packet[12:16], transactionID)
+
+	res, err := t.exchange(packet, actionConnect, transactionID, timeout)
+	if err != nil {
+		return err
+	}
+	if len(res) < 16 {
+		return fmt.Errorf("connect response too short: %d bytes", len(res))
+	}
+
+	t.connectionID = binary.BigEndian.Uint64(res[8:16])
+	t.connectionTime = time.Now()
+	slog.Debug("got udp tracker connection id", "tracker", t.announce, "connectionID", t.connectionID)
+
+	return nil
+}
+
+// exchange writes a packet and waits for the response with the same
+// transaction ID. Responses of other transactions (e.g. late responses of a
+// previous try) are ignored.
+func (t *udpTracker) exchange(packet []byte, action, transactionID uint32, timeout time.Duration) ([]byte, error) {
+	if _, err := t.conn.Write(packet); err != nil {
+		return nil, fmt.Errorf("error writing to udp tracker: %v", err)
+	}
+
+	if err := t.conn.SetReadDeadline(time.Now().Add(timeout)); err != nil {
+		return nil, err
+	}
+
+	buf := make([]byte, udpMaxPacketSize)
+	for {
+		n, err := t.conn.Read(buf)
+		if errors.Is(err, os.ErrDeadlineExceeded) {
+			return nil, errUDPTimeout
+		}
+		if err != nil {
+			return nil, fmt.Errorf("error reading from udp tracker: %v", err)
+		}
+		if n < 8 {
+			slog.Debug("ignoring short udp tracker packet", "length", n)
+			continue
+		}
+
+		res := buf[:n]
+		resAction := binary.BigEndian.Uint32(res[0:4])
+		resTransactionID := binary.BigEndian.Uint32(res[4:8])
+		if resTransactionID != transactionID {
+			slog.Debug("ignoring udp tracker packet of another transaction", "expected", transactionID, "actual", resTransactionID)
+			continue
+		}
+
+		if resAction == actionError {
+			return nil, &FailureError{Tracker: t.announce, Reason: string(res[8:])}
+		}
+		if resAction != action {
+			return nil, fmt.Errorf("expected udp tracker action %d but got %d", action, resAction)
+		}
+
+		return append([]byte(nil), res...), nil
+	}
+}
+
+func (t *udpTracker) dial() error {
+	if t.conn != nil {
+		return nil
+	}
+
+	addr, err := net.ResolveUDPAddr("udp", t.host)
+	if err != nil {
+		return fmt.Errorf("error resolving udp tracker %q: %v", t.host, err)
+	}
+	conn, err := net.DialUDP("udp", nil, addr)
+	if err != nil {
+		return fmt.Errorf("error dialing udp tracker %q: %v", t.host, err)
+	}
+	t.conn = conn
+
+	return nil
+}
+
+func newTransactionID() uint32 {
+	buf := make([]byte, 4)
+	rand.Read(buf)
+	return binary.BigEndian.Uint32(buf)
+}
@@ -0,0 +1,64 @@
+package torrentlib
+
+import (
+	"fmt"
+	"log/slog"
+
+	"github.com/codecrafters-io/bittorrent-starter-go/internal/torrentlib/peerlib"
+)
+
+// serveRequest answers a block request of the peer with a Piece message. The
+// request is ignored while we choke the peer or if we don't have the piece yet.
+func (s *session) serveRequest(peer *peerlib.Peer, msg *peerlib.Message) error {
+	index, begin, length, err := peerlib.ParseRequest(msg)
+	if err != nil {
+		return err
+	}
+
+	// same as the peers we download from, requests of more than a block close
+	// the connection
+	if length > BlockSize {
+		return fmt.Errorf("requested block too large, maximum %d actual %d", BlockSize, length)
+	}
+
+	if peer.AmChoking.Load() {
+		slog.Debug("ignoring request from choked peer", "peer", peer.Peer, "pieceID", index)
+		return nil
+	}
+	if s.storage == nil || !s.hasPiece(index) {
+		slog.Debug("ignoring request of a piece we don't have", "peer", peer.Peer, "pieceID", index)
+		return nil
+	}
+	if length == 0 || begin+length > s.torrent.pieceSize(index) {
+		return fmt.Errorf("request out of piece %d bounds, begin %d length %d", index, begin, length)
+	}
+
+	block := make([]byte, length)
+	offset := int64(index)*int64(s.torrent.PieceLength) + int64(begin)
+	if _, err := s.storage.ReadAt(block, offset); err != nil {
+		return fmt.Errorf("error reading block from disk: %v", err)
+	}
+
+	if err := peer.Send(peerlib.FormatPiece(index, begin, block)); err != nil {
+		return err
+	}
+	peer.Uploaded.Add(int64(length))
+	s.uploaded.Add(int64(length))
+	slog.Debug("block uploaded", "peer", peer.Peer, "pieceID", index, "begin", begin, "length", length)
+
+	return nil
+}
+
+// sendBitfield tells a newly connected peer which pieces we have, it is not
+// sent when we have none
+func (s *session) sendBitfield(peer *peerlib.Peer) error {
+	s.mu.Lock()
+	if s.totalHave == 0 {
+		s.mu.Unlock()
+		return nil
+	}
+	msg := peerlib.FormatBitfield(s.have)
+	s.mu.Unlock()
+
+	return peer.Send(msg)
+}
@@ -35,7 +35,7 @@ func TestEncodeString(t *testing.T) {
 func TestEncodeList(t *testing.T) {
 	encodeAndAssert(t, "li1ei2ei3ee", []any{1, 2, 3})
 	encodeAndAssert(t, "le", []any{})
-	encodeAndAssert(t, "lli1eel9:test testeleee", []any{[]any{1}, []any{"test test"}, []any{}})
+	encodeAndAssert(t, "lli1eel9:test testelee", []any{[]any{1}, []any{"test test"}, []any{}})
 }
 
 func TestEncodeDictionary(t *testing.T) {
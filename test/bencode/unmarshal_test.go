@@ -0,0 +1,118 @@
+package bencode_test
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/codecrafters-io/bittorrent-starter-go/internal/encoding/bencode"
+)
+
+type rawHolder struct {
+	Before string             `bencode:"before"`
+	Raw    bencode.RawMessage `bencode:"raw"`
+	After  int                `bencode:"after"`
+}
+
+func TestUnmarshalRawMessage(t *testing.T) {
+	// keys not modeled by any struct must be kept verbatim
+	raw := "d7:privatei1e6:sourcel1:a1:bee"
+	input := "d6:before3:abc3:raw" + raw + "5:afteri42ee"
+
+	var holder rawHolder
+	if err := bencode.Unmarshal([]byte(input), &holder); err != nil {
+		t.Fatalf("Failed to unmarshal input %q: %v", input, err)
+	}
+
+	if string(holder.Raw) != raw {
+		t.Errorf("Expected raw %q but got %q", raw, string(holder.Raw))
+	}
+	if holder.Before != "abc" || holder.After != 42 {
+		t.Errorf("Expected fields around raw value to be decoded, got %+v", holder)
+	}
+}
+
+func TestUnmarshalRawMessageScalars(t *testing.T) {
+	var holder rawHolder
+	if err := bencode.Unmarshal([]byte("d3:rawi-7ee"), &holder); err != nil {
+		t.Fatalf("Failed to unmarshal: %v", err)
+	}
+	if string(holder.Raw) != "i-7e" {
+		t.Errorf("Expected raw %q but got %q", "i-7e", string(holder.Raw))
+	}
+
+	if err := bencode.Unmarshal([]byte("d3:raw4:spame"), &holder); err != nil {
+		t.Fatalf("Failed to unmarshal: %v", err)
+	}
+	if string(holder.Raw) != "4:spam" {
+		t.Errorf("Expected raw %q but got %q", "4:spam", string(holder.Raw))
+	}
+}
+
+func TestEncodeRawMessage(t *testing.T) {
+	encodeAndAssert(t, "d4:infod1:xi1eee", map[string]any{
+		"info": bencode.RawMessage("d1:xi1ee"),
+	})
+}
+
+type scrapeFile struct {
+	Complete   int `bencode:"complete"`
+	Incomplete int `bencode:"incomplete"`
+}
+
+func TestUnmarshalMap(t *testing.T) {
+	var files map[string]scrapeFile
+	input := "d3:aaad8:completei5e10:incompletei2ee3:bbbd8:completei0eee"
+	if err := bencode.Unmarshal([]byte(input), &files); err != nil {
+		t.Fatalf("Failed to unmarshal input %q: %v", input, err)
+	}
+
+	expected := map[string]scrapeFile{
+		"aaa": {Complete: 5, Incomplete: 2},
+		"bbb": {Complete: 0},
+	}
+	if !reflect.DeepEqual(files, expected) {
+		t.Errorf("Expected %v but got %v", expected, files)
+	}
+}
+
+func TestUnmarshalTypeMismatch(t *testing.T) {
+	var number int
+	if err := bencode.Unmarshal([]byte("4:spam"), &number); err == nil {
+		t.Errorf("Expected error unmarshaling a string into an int, got nil")
+	}
+}
+
+func TestUnmarshalInvalidStringLength(t *testing.T) {
+	for _, input := range []string{
+		"-1:a",
+		"d1:v-1:ae",
+		"99999999999999:a",
+		"5:abc",
+		"l5:abe",
+	} {
+		var v any
+		if err := bencode.Unmarshal([]byte(input), &v); err == nil {
+			t.Errorf("Expected error unmarshaling %q", input)
+		}
+		if _, err := bencode.Decode([]byte(input)); err == nil {
+			t.Errorf("Expected error decoding %q", input)
+		}
+	}
+}
+
+func TestUnmarshalRawMessageBadLengths(t *testing.T) {
+	// raw values are skipped without being decoded, their strings must be
+	// checked all the same
+	for _, input := range []string{
+		"d3:raw-1:ae",
+		"d3:rawl-1:aee",
+		"d3:rawd1:k-1:aee",
+		"d3:raw99999999999999:ae",
+		"d3:rawd99999999999999:k1:vee",
+	} {
+		var holder rawHolder
+		if err := bencode.Unmarshal([]byte(input), &holder); err == nil {
+			t.Errorf("Expected error unmarshaling %q but got raw %q", input, holder.Raw)
+		}
+	}
+}
@@ -0,0 +1,420 @@
+package dhtlib_test
+
+import (
+	"context"
+	"crypto/rand"
+	"net"
+	"path/filepath"
+	"slices"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/codecrafters-io/bittorrent-starter-go/internal/encoding/bencode"
+	"github.com/codecrafters-io/bittorrent-starter-go/internal/torrentlib/dhtlib"
+)
+
+// newNode starts a node on loopback, bootstrapping from the given nodes
+func newNode(t *testing.T, bootstrap ...*dhtlib.DHT) *dhtlib.DHT {
+	opts := dhtlib.Options{Host: "127.0.0.1"}
+	for _, node := range bootstrap {
+		opts.Bootstrap = append(opts.Bootstrap, node.Addr().String())
+	}
+	node, err := dhtlib.Listen(opts)
+	if err != nil {
+		t.Fatalf("Failed to start node: %v", err)
+	}
+	t.Cleanup(func() { node.Close() })
+	return node
+}
+
+// newNetwork starts n nodes, every one bootstrapped from the first one
+func newNetwork(t *testing.T, ctx context.Context, n int) []*dhtlib.DHT {
+	nodes := []*dhtlib.DHT{newNode(t)}
+	for i := 1; i < n; i++ {
+		node := newNode(t, nodes[0])
+		if err := node.Bootstrap(ctx); err != nil {
+			t.Fatalf("Failed to bootstrap node %d: %v", i, err)
+		}
+		waitForNode(t, ctx, nodes[0], node.Addr().String())
+		nodes = append(nodes, node)
+	}
+	return nodes
+}
+
+// waitForNode waits until addr is in the routing table of node, nodes that
+// query it are added once they answer its ping
+func waitForNode(t *testing.T, ctx context.Context, node *dhtlib.DHT, addr string) {
+	for !slices.Contains(node.Nodes(), addr) {
+		if ctx.Err() != nil {
+			t.Fatalf("Expected %s in the routing table but got %v", addr, node.Nodes())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestBootstrap(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	nodes := newNetwork(t, ctx, 3)
+
+	// the last node learns the second one from the first
+	known := nodes[2].Nodes()
+	for _, node := range nodes[:2] {
+		if !slices.Contains(known, node.Addr().String()) {
+			t.Errorf("Expected %s in the routing table but got %v", node.Addr(), known)
+		}
+	}
+	// nodes that query us are added too, once they answer our ping
+	if !slices.Contains(nodes[0].Nodes(), nodes[2].Addr().String()) {
+		t.Errorf("Expected the bootstrap node to know %s but got %v", nodes[2].Addr(), nodes[0].Nodes())
+	}
+}
+
+func TestBootstrapNoNodes(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	if err := newNode(t).Bootstrap(ctx); err == nil {
+		t.Errorf("Expected error bootstrapping without nodes")
+	}
+}
+
+func TestAnnounceGetPeers(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	nodes := newNetwork(t, ctx, 8)
+	infoHash := [20]byte{1, 2, 3}
+
+	peers, err := nodes[3].Announce(ctx, infoHash, 6881)
+	if err != nil {
+		t.Fatalf("Failed to announce: %v", err)
+	}
+	if len(peers) != 0 {
+		t.Errorf("Expected no peers before announcing but got %v", peers)
+	}
+
+	peers, err = nodes[7].GetPeers(ctx, infoHash)
+	if err != nil {
+		t.Fatalf("Failed to get peers: %v", err)
+	}
+	if !slices.Equal(peers, []string{"127.0.0.1:6881"}) {
+		t.Errorf("Expected the announced peer but got %v", peers)
+	}
+
+	peers, err = nodes[5].GetPeers(ctx, [20]byte{4, 5, 6})
+	if err != nil {
+		t.Fatalf("Failed to get peers: %v", err)
+	}
+	if len(peers) != 0 {
+		t.Errorf("Expected no peers of another torrent but got %v", peers)
+	}
+}
+
+func TestPing(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	a, b := newNode(t), newNode(t)
+	if err := a.Ping(ctx, b.Addr().String()); err != nil {
+		t.Fatalf("Failed to ping: %v", err)
+	}
+	if !slices.Equal(a.Nodes(), []string{b.Addr().String()}) {
+		t.Errorf("Expected the pinged node in the routing table but got %v", a.Nodes())
+	}
+
+	b.Close()
+	if err := a.Ping(ctx, b.Addr().String()); err == nil {
+		t.Errorf("Expected error pinging a closed node")
+	}
+}
+
+// fakeNode is a dht node on a raw socket, its ids share prefix bits with the
+// id of a node. It answers pings while answer is set.
+type fakeNode struct {
+	conn   *net.UDPConn
+	id     [20]byte
+	answer atomic.Bool
+	pinged chan struct{}
+}
+
+func newFakeNode(t *testing.T, of *dhtlib.DHT, prefix int, answer bool) *fakeNode {
+	conn, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	t.Cleanup(func() { conn.Close() })
+
+	// the id differs from ours at bit prefix, the rest is random
+	n := &fakeNode{conn: conn, pinged: make(chan struct{}, 16)}
+	rand.Read(n.id[:])
+	ours := of.ID()
+	for bit := 0; bit <= prefix; bit++ {
+		mask := byte(0x80 >> (bit % 8))
+		n.id[bit/8] = n.id[bit/8]&^mask | ours[bit/8]&mask
+		if bit == prefix {
+			n.id[bit/8] ^= mask
+		}
+	}
+	n.answer.Store(answer)
+
+	go func() {
+		buf := make([]byte, 8192)
+		for {
+			size, addr, err := conn.ReadFromUDP(buf)
+			if err != nil {
+				return
+			}
+			var msg map[string]bencode.RawMessage
+			if err := bencode.Unmarshal(buf[:size], &msg); err != nil || string(msg["y"]) != "1:q" {
+				continue
+			}
+			select {
+			case n.pinged <- struct{}{}:
+			default:
+			}
+			if !n.answer.Load() {
+				continue
+			}
+			var transactionID string
+			bencode.Unmarshal(msg["t"], &transactionID)
+			res, _ := bencode.Encode(map[string]any{"t": transactionID, "y": "r", "r": map[string]any{"id": string(n.id[:])}})
+			conn.WriteToUDP(res, addr)
+		}
+	}()
+	return n
+}
+
+func (n *fakeNode) addr() string {
+	return n.conn.LocalAddr().String()
+}
+
+func TestQueryingNodeVerified(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	node := newNode(t)
+	fake := newFakeNode(t, node, 0, false)
+
+	// a node that queries us is pinged, and only added once it answers
+	query, _ := bencode.Encode(map[string]any{"t": "aa", "y": "q", "q": "ping", "a": map[string]any{"id": string(fake.id[:])}})
+	if _, err := fake.conn.WriteToUDP(query, node.Addr()); err != nil {
+		t.Fatalf("Failed to send query: %v", err)
+	}
+	select {
+	case <-fake.pinged:
+	case <-ctx.Done():
+		t.Fatalf("Expected the querying node to be pinged")
+	}
+	if len(node.Nodes()) != 0 {
+		t.Errorf("Expected no nodes before the ping is answered but got %v", node.Nodes())
+	}
+
+	// the next query is pinged once the first ping times out
+	fake.answer.Store(true)
+	for !slices.Contains(node.Nodes(), fake.addr()) {
+		if ctx.Err() != nil {
+			t.Fatalf("Expected %s in the routing table but got %v", fake.addr(), node.Nodes())
+		}
+		if _, err := fake.conn.WriteToUDP(query, node.Addr()); err != nil {
+			t.Fatalf("Failed to send query: %v", err)
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+}
+
+func TestFullBucketEviction(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	node := newNode(t)
+	var bucket []*fakeNode
+	for range dhtlib.K {
+		fake := newFakeNode(t, node, 0, true)
+		if err := node.Ping(ctx, fake.addr()); err != nil {
+			t.Fatalf("Failed to ping: %v", err)
+		}
+		bucket = append(bucket, fake)
+	}
+
+	// the least recently seen node answers, the new one is dropped
+	extra := newFakeNode(t, node, 0, true)
+	if err := node.Ping(ctx, extra.addr()); err != nil {
+		t.Fatalf("Failed to ping: %v", err)
+	}
+	for len(bucket[0].pinged) < 2 {
+		if ctx.Err() != nil {
+			t.Fatalf("Expected the oldest node to be pinged")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	time.Sleep(100 * time.Millisecond)
+	if slices.Contains(node.Nodes(), extra.addr()) || len(node.Nodes()) != dhtlib.K {
+		t.Errorf("Expected the full bucket to be kept but got %v", node.Nodes())
+	}
+
+	// now the least recently seen node is bucket[1], it does not answer and
+	// is replaced
+	bucket[1].answer.Store(false)
+	if err := node.Ping(ctx, extra.addr()); err != nil {
+		t.Fatalf("Failed to ping: %v", err)
+	}
+	waitForNode(t, ctx, node, extra.addr())
+	if slices.Contains(node.Nodes(), bucket[1].addr()) || len(node.Nodes()) != dhtlib.K {
+		t.Errorf("Expected %s to be replaced but got %v", bucket[1].addr(), node.Nodes())
+	}
+}
+
+// krpc sends a raw query to a node and returns the response dictionary
+func krpc(t *testing.T, node *dhtlib.DHT, query map[string]any) map[string]bencode.RawMessage {
+	conn, err := net.DialUDP("udp4", nil, node.Addr())
+	if err != nil {
+		t.Fatalf("Failed to dial node: %v", err)
+	}
+	defer conn.Close()
+
+	packet, err := bencode.Encode(query)
+	if err != nil {
+		t.Fatalf("Failed to encode query: %v", err)
+	}
+	if _, err := conn.Write(packet); err != nil {
+		t.Fatalf("Failed to send query: %v", err)
+	}
+
+	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	buf := make([]byte, 8192)
+	n, err := conn.Read(buf)
+	if err != nil {
+		t.Fatalf("Failed to read response: %v", err)
+	}
+	var res map[string]bencode.RawMessage
+	if err := bencode.Unmarshal(buf[:n], &res); err != nil {
+		t.Fatalf("Failed to decode response: %v", err)
+	}
+	return res
+}
+
+func TestMalformedPackets(t *testing.T) {
+	node := newNode(t)
+	conn, err := net.DialUDP("udp4", nil, node.Addr())
+	if err != nil {
+		t.Fatalf("Failed to dial node: %v", err)
+	}
+	defer conn.Close()
+
+	// anyone can send these, the node must drop them and keep answering
+	for _, packet := range []string{
+		"d1:v-1:ae",
+		"d1:y1:q1:td-1:ee",
+		"d1:t99999999999999:aa1:y1:qe",
+		"d1:y1:q1:a",
+		"5:abc",
+		"",
+	} {
+		if _, err := conn.Write([]byte(packet)); err != nil {
+			t.Fatalf("Failed to send packet %q: %v", packet, err)
+		}
+	}
+
+	res := krpc(t, node, map[string]any{
+		"t": "ac",
+		"y": "q",
+		"q": "ping",
+		"a": map[string]any{"id": string(make([]byte, 20))},
+	})
+	if string(res["y"]) != "1:r" {
+		t.Errorf("Expected ping response after malformed packets but got %s", res["y"])
+	}
+}
+
+func TestAnnounceInvalidToken(t *testing.T) {
+	node := newNode(t)
+	id := string(make([]byte, 20))
+
+	res := krpc(t, node, map[string]any{
+		"t": "aa",
+		"y": "q",
+		"q": "announce_peer",
+		"a": map[string]any{"id": id, "info_hash": id, "port": 6881, "token": "wrong"},
+	})
+	if string(res["y"]) != "1:e" {
+		t.Fatalf("Expected error response but got %s", res["y"])
+	}
+	var e []bencode.RawMessage
+	bencode.Unmarshal(res["e"], &e)
+	if len(e) != 2 || string(e[0]) != "i203e" {
+		t.Errorf("Expected protocol error but got %s", res["e"])
+	}
+	if string(res["t"]) != "2:aa" {
+		t.Errorf("Expected transaction id aa but got %s", res["t"])
+	}
+}
+
+func TestUnknownMethod(t *testing.T) {
+	node := newNode(t)
+
+	res := krpc(t, node, map[string]any{
+		"t": "ab",
+		"y": "q",
+		"q": "vote",
+		"a": map[string]any{"id": string(make([]byte, 20))},
+	})
+	if string(res["y"]) != "1:e" || string(res["e"]) != "li204e14:method unknowne" {
+		t.Errorf("Expected method unknown error but got %s %s", res["y"], res["e"])
+	}
+}
+
+func TestGetPeersNoNodes(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	if _, err := newNode(t).GetPeers(ctx, [20]byte{}); err == nil {
+		t.Errorf("Expected error without nodes to ask")
+	}
+}
+
+func TestStateFile(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	stateFile := filepath.Join(t.TempDir(), "dht", "state")
+	bootstrap := newNode(t)
+	other := newNode(t, bootstrap)
+	if err := other.Bootstrap(ctx); err != nil {
+		t.Fatalf("Failed to bootstrap: %v", err)
+	}
+	waitForNode(t, ctx, bootstrap, other.Addr().String())
+
+	node, err := dhtlib.Listen(dhtlib.Options{Host: "127.0.0.1", Bootstrap: []string{bootstrap.Addr().String()}, StateFile: stateFile})
+	if err != nil {
+		t.Fatalf("Failed to start node: %v", err)
+	}
+	if err := node.Bootstrap(ctx); err != nil {
+		t.Fatalf("Failed to bootstrap: %v", err)
+	}
+	id, nodes := node.ID(), node.Nodes()
+	if err := node.Close(); err != nil {
+		t.Fatalf("Failed to save state: %v", err)
+	}
+
+	// without bootstrap nodes, the saved routing table is used
+	node, err = dhtlib.Listen(dhtlib.Options{Host: "127.0.0.1", StateFile: stateFile})
+	if err != nil {
+		t.Fatalf("Failed to start node: %v", err)
+	}
+	defer node.Close()
+	if node.ID() != id {
+		t.Errorf("Expected id %x but got %x", id, node.ID())
+	}
+	restored := node.Nodes()
+	slices.Sort(nodes)
+	slices.Sort(restored)
+	if len(nodes) != 2 || !slices.Equal(nodes, restored) {
+		t.Errorf("Expected nodes %v but got %v", nodes, restored)
+	}
+	if err := node.Bootstrap(ctx); err != nil {
+		t.Errorf("Failed to bootstrap from the saved nodes: %v", err)
+	}
+}
@@ -0,0 +1,195 @@
+package peerlib_test
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"testing"
+
+	"github.com/codecrafters-io/bittorrent-starter-go/internal/torrentlib/peerlib"
+)
+
+// recorder is an extension that keeps what it receives
+type recorder struct {
+	handshakes []*peerlib.ExtensionHandshake
+	payloads   [][]byte
+}
+
+func (r *recorder) Handshake(peer *peerlib.Peer, handshake *peerlib.ExtensionHandshake) error {
+	r.handshakes = append(r.handshakes, handshake)
+	return nil
+}
+
+func (r *recorder) Handle(peer *peerlib.Peer, payload []byte) error {
+	r.payloads = append(r.payloads, bytes.Clone(payload))
+	return nil
+}
+
+func TestCapabilities(t *testing.T) {
+	var c peerlib.Capabilities
+	c.Set(peerlib.CapabilityExtensions)
+	if c != (peerlib.Capabilities{0, 0, 0, 0, 0, 0x10, 0, 0}) {
+		t.Errorf("Expected extension bit in byte 5 but got %x", c)
+	}
+	if !c.Has(peerlib.CapabilityExtensions) {
+		t.Errorf("Expected extension capability")
+	}
+	if !peerlib.LocalCapabilities.Has(peerlib.CapabilityExtensions) {
+		t.Errorf("Expected extension capability in our handshakes")
+	}
+
+	c.Set(peerlib.CapabilityDHT)
+	if c != (peerlib.Capabilities{0, 0, 0, 0, 0, 0x10, 0, 0x01}) {
+		t.Errorf("Expected dht bit in byte 7 but got %x", c)
+	}
+	if !peerlib.LocalCapabilities.Has(peerlib.CapabilityDHT) {
+		t.Errorf("Expected dht capability in our handshakes")
+	}
+}
+
+func TestAcceptCapabilities(t *testing.T) {
+	a, b := net.Pipe()
+	defer a.Close()
+	defer b.Close()
+
+	handshake := make([]byte, 68)
+	handshake[0] = 19
+	copy(handshake[1:20], "BitTorrent protocol")
+	handshake[25] = 0x10
+	go a.Write(handshake)
+
+	answer := make([]byte, 68)
+	answered := make(chan error, 1)
+	go func() {
+		_, err := io.ReadFull(a, answer)
+		answered <- err
+	}()
+
+	// the torrent decides our capabilities, e.g. no DHT for private ones
+	var ours peerlib.Capabilities
+	ours.Set(peerlib.CapabilityExtensions)
+	peer, err := peerlib.Accept(b, func(infoHash [20]byte) (peerlib.Capabilities, bool) {
+		return ours, true
+	})
+	if err != nil {
+		t.Fatalf("Failed to accept: %v", err)
+	}
+	if !peer.Capabilities.Has(peerlib.CapabilityExtensions) {
+		t.Errorf("Expected peer to support extensions, reserved bytes %x", peer.Capabilities)
+	}
+	if err := <-answered; err != nil {
+		t.Fatalf("Failed to read handshake: %v", err)
+	}
+	if peerlib.Capabilities(answer[20:28]) != ours {
+		t.Errorf("Expected reserved bytes %x in our handshake but got %x", ours, answer[20:28])
+	}
+}
+
+func TestExtensions(t *testing.T) {
+	a, b := newPipe(t)
+	a.Capabilities.Set(peerlib.CapabilityExtensions)
+	b.Capabilities.Set(peerlib.CapabilityExtensions)
+
+	ours := peerlib.NewExtensions()
+	ours.Version = "test 1.0"
+	ours.Reqq = 100
+	ours.Port = 6882
+	ours.Register("ut_first", &recorder{})
+	ours.Register("ut_test", &recorder{})
+
+	theirs := peerlib.NewExtensions()
+	received := &recorder{}
+	theirs.Register("ut_test", received)
+
+	// b sends its handshake to a
+	errs := make(chan error, 1)
+	go func() { errs <- theirs.SendHandshake(b) }()
+	msg, err := a.Read()
+	if err != nil {
+		t.Fatalf("Failed to read handshake: %v", err)
+	}
+	if err := <-errs; err != nil {
+		t.Fatalf("Failed to send handshake: %v", err)
+	}
+	if _, err := ours.Handle(a, msg); err != nil {
+		t.Fatalf("Failed to handle handshake: %v", err)
+	}
+	if !a.SupportsExtension("ut_test") || a.SupportsExtension("ut_first") {
+		t.Errorf("Expected peer to support only ut_test")
+	}
+
+	// a sends its handshake to b
+	go func() { errs <- ours.SendHandshake(a) }()
+	msg, err = b.Read()
+	if err != nil {
+		t.Fatalf("Failed to read handshake: %v", err)
+	}
+	<-errs
+	handshake, err := theirs.Handle(b, msg)
+	if err != nil {
+		t.Fatalf("Failed to handle handshake: %v", err)
+	}
+	if handshake == nil || handshake.V != "test 1.0" || handshake.Reqq != 100 || handshake.P != 6882 {
+		t.Fatalf("Unexpected handshake %+v", handshake)
+	}
+	if handshake.M["ut_first"] != 1 || handshake.M["ut_test"] != 2 {
+		t.Errorf("Expected extended ids by registration order but got %v", handshake.M)
+	}
+	if len(received.handshakes) != 1 {
+		t.Errorf("Expected the extension to see the handshake")
+	}
+
+	// b sends a ut_test message with the id a gave it
+	go func() { errs <- b.SendExtension("ut_test", []byte("hello")) }()
+	msg, err = a.Read()
+	if err != nil {
+		t.Fatalf("Failed to read message: %v", err)
+	}
+	<-errs
+	id, payload, err := peerlib.ParseExtended(msg)
+	if err != nil || id != 2 || string(payload) != "hello" {
+		t.Errorf("Expected message 2 hello but got %d %q %v", id, payload, err)
+	}
+
+	if err := b.SendExtension("ut_unknown", nil); err == nil {
+		t.Errorf("Expected error sending an extension the peer does not support")
+	}
+}
+
+func TestExtensionHandle(t *testing.T) {
+	extensions := peerlib.NewExtensions()
+	received := &recorder{}
+	extensions.Register("ut_test", received)
+	peer := &peerlib.Peer{Peer: "test"}
+
+	if _, err := extensions.Handle(peer, peerlib.FormatExtended(1, []byte("data"))); err != nil {
+		t.Fatalf("Failed to handle message: %v", err)
+	}
+	if len(received.payloads) != 1 || string(received.payloads[0]) != "data" {
+		t.Errorf("Expected payload data but got %q", received.payloads)
+	}
+
+	if _, err := extensions.Handle(peer, peerlib.FormatExtended(9, nil)); err != nil {
+		t.Errorf("Expected unknown extensions to be ignored but got %v", err)
+	}
+	if _, err := extensions.Handle(peer, peerlib.FormatExtended(0, []byte("not bencode"))); err == nil {
+		t.Errorf("Expected error for an invalid handshake")
+	}
+}
+
+func TestExtensionHandleBadLengths(t *testing.T) {
+	extensions := peerlib.NewExtensions()
+	extensions.Register("ut_test", &recorder{})
+	peer := &peerlib.Peer{Peer: "test"}
+
+	// the lengths come from the peer, they must not crash us
+	for _, payload := range []string{
+		"d1:v-1:ae",
+		"d1:md7:ut_test-1:ee",
+		"d1:v99999999999999:ae",
+	} {
+		if _, err := extensions.Handle(peer, peerlib.FormatExtended(0, []byte(payload))); err == nil {
+			t.Errorf("Expected error for handshake %q", payload)
+		}
+	}
+}
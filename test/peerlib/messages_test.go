@@ -0,0 +1,154 @@
+package peerlib_test
+
+import (
+	"bytes"
+	"net"
+	"testing"
+
+	"github.com/codecrafters-io/bittorrent-starter-go/internal/torrentlib/peerlib"
+)
+
+// newPipe returns two peers connected to each other
+func newPipe(t *testing.T) (*peerlib.Peer, *peerlib.Peer) {
+	a, b := net.Pipe()
+	t.Cleanup(func() {
+		a.Close()
+		b.Close()
+	})
+	return &peerlib.Peer{Conn: a, Peer: "a"}, &peerlib.Peer{Conn: b, Peer: "b"}
+}
+
+// roundTrip sends msg from one peer and reads it from the other
+func roundTrip(t *testing.T, msg *peerlib.Message) *peerlib.Message {
+	sender, receiver := newPipe(t)
+	errs := make(chan error, 1)
+	go func() { errs <- sender.Send(msg) }()
+
+	got, err := receiver.Read()
+	if err != nil {
+		t.Fatalf("Failed to read %s: %v", msg.Type.String(), err)
+	}
+	if err := <-errs; err != nil {
+		t.Fatalf("Failed to send %s: %v", msg.Type.String(), err)
+	}
+	return got
+}
+
+func TestRequestRoundTrip(t *testing.T) {
+	for _, format := range []struct {
+		format func(index, begin, length int) *peerlib.Message
+		parse  func(msg *peerlib.Message) (int, int, int, error)
+	}{
+		{peerlib.FormatRequest, peerlib.ParseRequest},
+		{peerlib.FormatCancel, peerlib.ParseCancel},
+	} {
+		msg := roundTrip(t, format.format(7, 16384, 1000))
+		index, begin, length, err := format.parse(msg)
+		if err != nil {
+			t.Fatalf("Failed to parse %s: %v", msg.Type.String(), err)
+		}
+		if index != 7 || begin != 16384 || length != 1000 {
+			t.Errorf("Expected 7 16384 1000 but got %d %d %d", index, begin, length)
+		}
+	}
+}
+
+func TestPieceRoundTrip(t *testing.T) {
+	block := []byte("some block data")
+	msg := roundTrip(t, peerlib.FormatPiece(3, 32768, block))
+
+	index, begin, got, err := peerlib.ParsePiece(msg)
+	if err != nil {
+		t.Fatalf("Failed to parse piece: %v", err)
+	}
+	if index != 3 || begin != 32768 || !bytes.Equal(got, block) {
+		t.Errorf("Expected 3 32768 %q but got %d %d %q", block, index, begin, got)
+	}
+}
+
+func TestHaveRoundTrip(t *testing.T) {
+	index, err := peerlib.ParseHave(roundTrip(t, peerlib.FormatHave(42)))
+	if err != nil {
+		t.Fatalf("Failed to parse have: %v", err)
+	}
+	if index != 42 {
+		t.Errorf("Expected 42 but got %d", index)
+	}
+}
+
+func TestPortRoundTrip(t *testing.T) {
+	msg := roundTrip(t, peerlib.FormatPort(6881))
+	if msg.Type != peerlib.Port || !bytes.Equal(msg.Payload, []byte{0x1A, 0xE1}) {
+		t.Fatalf("Expected port 1ae1 but got %s %x", msg.Type.String(), msg.Payload)
+	}
+	port, err := peerlib.ParsePort(msg)
+	if err != nil {
+		t.Fatalf("Failed to parse port: %v", err)
+	}
+	if port != 6881 {
+		t.Errorf("Expected 6881 but got %d", port)
+	}
+
+	if _, err := peerlib.ParsePort(peerlib.FormatPort(0)); err == nil {
+		t.Errorf("Expected error parsing port 0")
+	}
+}
+
+func TestParseBitfield(t *testing.T) {
+	msg := roundTrip(t, peerlib.FormatBitfield([]byte{0xFF, 0xE0}))
+	bitfield, err := peerlib.ParseBitfield(msg, 11)
+	if err != nil {
+		t.Fatalf("Failed to parse bitfield: %v", err)
+	}
+	if !bytes.Equal(bitfield, []byte{0xFF, 0xE0}) {
+		t.Errorf("Expected ffe0 but got %x", bitfield)
+	}
+
+	if _, err := peerlib.ParseBitfield(msg, 10); err == nil {
+		t.Errorf("Expected error for spare bits set")
+	}
+	if _, err := peerlib.ParseBitfield(msg, 20); err == nil {
+		t.Errorf("Expected error for wrong length")
+	}
+}
+
+func TestKeepAlive(t *testing.T) {
+	msg := roundTrip(t, &peerlib.Message{Type: peerlib.KeepAlive})
+	if msg.Type != peerlib.KeepAlive || len(msg.Payload) != 0 {
+		t.Errorf("Expected keep-alive but got %s with %d bytes", msg.Type.String(), len(msg.Payload))
+	}
+}
+
+func TestReadMalformed(t *testing.T) {
+	tests := map[string][]byte{
+		"short have":    {0, 0, 0, 3, 4, 0, 0},
+		"long request":  {0, 0, 0, 14, 6, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0},
+		"short piece":   {0, 0, 0, 5, 7, 0, 0, 0, 0},
+		"choke payload": {0, 0, 0, 2, 0, 1},
+		"short port":    {0, 0, 0, 2, 9, 1},
+		"too long":      {0xFF, 0xFF, 0xFF, 0xFF, 7},
+	}
+
+	for name, raw := range tests {
+		t.Run(name, func(t *testing.T) {
+			a, b := net.Pipe()
+			defer a.Close()
+			defer b.Close()
+			go a.Write(raw)
+
+			peer := peerlib.Peer{Conn: b}
+			if _, err := peer.Read(); err == nil {
+				t.Errorf("Expected error reading %x", raw)
+			}
+		})
+	}
+}
+
+func TestParseWrongType(t *testing.T) {
+	if _, _, _, err := peerlib.ParseRequest(peerlib.FormatCancel(0, 0, 1)); err == nil {
+		t.Errorf("Expected error parsing a cancel as a request")
+	}
+	if _, err := peerlib.ParseHave(&peerlib.Message{Type: peerlib.Have, Payload: []byte{1}}); err == nil {
+		t.Errorf("Expected error parsing a short have")
+	}
+}
@@ -0,0 +1,99 @@
+package peerlib_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/codecrafters-io/bittorrent-starter-go/internal/torrentlib/peerlib"
+)
+
+const blockLength = 16 * 1024
+
+// download simulates a peer sending a block every interval, each arriving rtt
+// after being requested, for the given duration
+func download(p *peerlib.Pipeline, start time.Time, interval, rtt, duration time.Duration) time.Time {
+	now := start
+	for i := 0; now.Sub(start) < duration; i++ {
+		block := peerlib.Block{Index: i / 16, Begin: i % 16 * blockLength}
+		p.Requested(block, now.Add(interval-rtt))
+		now = now.Add(interval)
+		p.Received(block, blockLength, now)
+	}
+	return now
+}
+
+func TestPipelineFastPeer(t *testing.T) {
+	p := peerlib.NewPipeline()
+	if p.Depth() != peerlib.InitialPipelineDepth {
+		t.Fatalf("Expected initial depth %d but got %d", peerlib.InitialPipelineDepth, p.Depth())
+	}
+
+	// 1000 blocks per second (~16MB/s) with a 100ms round trip
+	download(p, time.Unix(0, 0), time.Millisecond, 100*time.Millisecond, 5*time.Second)
+
+	if p.Depth() <= peerlib.InitialPipelineDepth*10 {
+		t.Errorf("Expected depth to grow for a fast peer but got %d", p.Depth())
+	}
+	if p.Depth() > peerlib.MaxPipelineDepth {
+		t.Errorf("Expected depth at most %d but got %d", peerlib.MaxPipelineDepth, p.Depth())
+	}
+	if p.RTT() != 100*time.Millisecond {
+		t.Errorf("Expected rtt 100ms but got %v", p.RTT())
+	}
+}
+
+func TestPipelineSlowPeer(t *testing.T) {
+	p := peerlib.NewPipeline()
+
+	// a block every two seconds
+	download(p, time.Unix(0, 0), 2*time.Second, 50*time.Millisecond, 20*time.Second)
+
+	if p.Depth() != peerlib.MinPipelineDepth {
+		t.Errorf("Expected depth %d for a slow peer but got %d", peerlib.MinPipelineDepth, p.Depth())
+	}
+}
+
+func TestPipelineLimit(t *testing.T) {
+	p := peerlib.NewPipeline()
+	p.SetLimit(20)
+
+	download(p, time.Unix(0, 0), time.Millisecond, 100*time.Millisecond, 5*time.Second)
+
+	if p.Depth() != 20 {
+		t.Errorf("Expected depth limited to 20 but got %d", p.Depth())
+	}
+
+	p.SetLimit(1)
+	if p.Depth() != 1 {
+		t.Errorf("Expected depth limited to 1 but got %d", p.Depth())
+	}
+}
+
+func TestPipelineCancelled(t *testing.T) {
+	p := peerlib.NewPipeline()
+	start := time.Unix(0, 0)
+
+	for i := 0; i < 4; i++ {
+		p.Requested(peerlib.Block{Index: 0, Begin: i * blockLength}, start)
+	}
+	for i := 0; i < 3; i++ {
+		p.Cancelled(peerlib.Block{Index: 0, Begin: i * blockLength})
+	}
+	if p.Pending() != 1 {
+		t.Errorf("Expected 1 pending request after cancelling but got %d", p.Pending())
+	}
+
+	// a cancelled block that still arrives is not a round trip sample
+	p.Received(peerlib.Block{Index: 0, Begin: 0}, blockLength, start.Add(10*time.Second))
+	if p.RTT() != 0 {
+		t.Errorf("Expected no rtt sample from a cancelled block but got %v", p.RTT())
+	}
+
+	p.Received(peerlib.Block{Index: 0, Begin: 3 * blockLength}, blockLength, start.Add(50*time.Millisecond))
+	if p.RTT() != 50*time.Millisecond {
+		t.Errorf("Expected rtt 50ms but got %v", p.RTT())
+	}
+	if p.Pending() != 0 {
+		t.Errorf("Expected no pending requests but got %d", p.Pending())
+	}
+}
@@ -0,0 +1,222 @@
+package torrentlib_test
+
+import (
+	"bytes"
+	"context"
+	"net"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/codecrafters-io/bittorrent-starter-go/internal/encoding/bencode"
+	"github.com/codecrafters-io/bittorrent-starter-go/internal/torrentlib"
+	"github.com/codecrafters-io/bittorrent-starter-go/internal/torrentlib/dhtlib"
+	"github.com/codecrafters-io/bittorrent-starter-go/internal/torrentlib/peerlib"
+)
+
+func newDHTNode(t *testing.T, bootstrap ...string) *dhtlib.DHT {
+	node, err := dhtlib.Listen(dhtlib.Options{Host: "127.0.0.1", Bootstrap: bootstrap})
+	if err != nil {
+		t.Fatalf("Failed to start dht node: %v", err)
+	}
+	t.Cleanup(func() { node.Close() })
+	return node
+}
+
+func TestDownloadTrackerless(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	// the seeder is only known by the dht
+	swarm := newSwarm(t, 3*testPieceLength, 0)
+	seeder, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	defer seeder.Close()
+	go swarm.serveSeeder(seeder, 0)
+
+	router := newDHTNode(t)
+	seederNode := newDHTNode(t, router.Addr().String())
+	if err := seederNode.Bootstrap(ctx); err != nil {
+		t.Fatalf("Failed to bootstrap: %v", err)
+	}
+
+	// a torrent without trackers, with the router as node
+	data, err := bencode.Encode(map[string]any{
+		"info":  swarm.infoDict("dht.bin"),
+		"nodes": []any{[]any{"127.0.0.1", router.Addr().Port}},
+	})
+	if err != nil {
+		t.Fatalf("Failed to encode torrent: %v", err)
+	}
+	torrent, err := torrentlib.Parse(data)
+	if err != nil {
+		t.Fatalf("Failed to parse torrent: %v", err)
+	}
+	if !slices.Equal(torrent.Nodes, []string{router.Addr().String()}) {
+		t.Errorf("Expected nodes %v but got %v", []string{router.Addr().String()}, torrent.Nodes)
+	}
+
+	if _, err := seederNode.Announce(ctx, [20]byte(torrent.InfoHash), seeder.Addr().(*net.TCPAddr).Port); err != nil {
+		t.Fatalf("Failed to announce the seeder: %v", err)
+	}
+
+	listener, err := torrentlib.Listen(0)
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	defer listener.Close()
+
+	// the routing table starts empty, the node of the torrent is the way in
+	node := newDHTNode(t)
+	output := filepath.Join(t.TempDir(), "dht.bin")
+	if err := torrent.Download(ctx, output, torrentlib.DownloadOptions{MaxConnections: 2, Listener: listener, DHT: node}); err != nil {
+		t.Fatalf("Failed to download: %v", err)
+	}
+	content, err := os.ReadFile(output)
+	if err != nil {
+		t.Fatalf("Failed to read output: %v", err)
+	}
+	if !bytes.Equal(content, swarm.content) {
+		t.Errorf("Downloaded content does not match")
+	}
+
+	// the download announced itself
+	peers, err := seederNode.GetPeers(ctx, [20]byte(torrent.InfoHash))
+	if err != nil {
+		t.Fatalf("Failed to get peers: %v", err)
+	}
+	if !slices.Contains(peers, net.JoinHostPort("127.0.0.1", strconv.Itoa(listener.Port()))) {
+		t.Errorf("Expected the download among the peers but got %v", peers)
+	}
+}
+
+func TestDownloadDHTPort(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	// the seeder runs a dht node, the download learns it from a port message
+	remote := newDHTNode(t)
+	swarm := newSwarm(t, 2*testPieceLength, 1)
+	swarm.dhtPort = remote.Addr().Port
+	torrent := swarm.torrent(swarm.infoDict("port.bin"))
+
+	listener, err := torrentlib.Listen(0)
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	defer listener.Close()
+
+	node := newDHTNode(t)
+	output := filepath.Join(t.TempDir(), "port.bin")
+	if err := torrent.Download(ctx, output, torrentlib.DownloadOptions{MaxConnections: 2, Listener: listener, DHT: node}); err != nil {
+		t.Fatalf("Failed to download: %v", err)
+	}
+
+	swarm.mu.Lock()
+	ports := slices.Clone(swarm.ports)
+	reserved := slices.Clone(swarm.reserved)
+	swarm.mu.Unlock()
+	if !slices.Equal(ports, []int{node.Addr().Port}) {
+		t.Errorf("Expected port %d to be sent but got %v", node.Addr().Port, ports)
+	}
+	for _, c := range reserved {
+		if !c.Has(peerlib.CapabilityDHT) {
+			t.Errorf("Expected dht bit in our handshake but got %x", c)
+		}
+	}
+
+	// NOTE: the node is pinged in the background
+	for !slices.Contains(node.Nodes(), remote.Addr().String()) {
+		if ctx.Err() != nil {
+			t.Fatalf("Expected %s in the routing table but got %v", remote.Addr(), node.Nodes())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestDownloadPrivateNoDHT(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	// the seeder runs a dht node, private torrents must not use it
+	remote := newDHTNode(t)
+	swarm := newSwarm(t, 2*testPieceLength, 1)
+	swarm.dhtPort = remote.Addr().Port
+	info := swarm.infoDict("private.bin")
+	info["private"] = 1
+	torrent := swarm.torrent(info)
+
+	listener, err := torrentlib.Listen(0)
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	defer listener.Close()
+
+	node := newDHTNode(t)
+	output := filepath.Join(t.TempDir(), "private.bin")
+	if err := torrent.Download(ctx, output, torrentlib.DownloadOptions{MaxConnections: 2, Listener: listener, DHT: node}); err != nil {
+		t.Fatalf("Failed to download: %v", err)
+	}
+
+	swarm.mu.Lock()
+	ports := slices.Clone(swarm.ports)
+	reserved := slices.Clone(swarm.reserved)
+	swarm.mu.Unlock()
+	if len(ports) != 0 {
+		t.Errorf("Expected no port message but got %v", ports)
+	}
+	if len(reserved) == 0 {
+		t.Errorf("Expected a handshake from the download")
+	}
+	for _, c := range reserved {
+		if c.Has(peerlib.CapabilityDHT) {
+			t.Errorf("Expected no dht bit in our handshake but got %x", c)
+		}
+	}
+	if nodes := node.Nodes(); len(nodes) != 0 {
+		t.Errorf("Expected an empty routing table but got %v", nodes)
+	}
+}
+
+func TestDownloadPrivateTrackerless(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	// a private torrent without trackers has no way to find peers, its nodes
+	// are not used
+	swarm := newSwarm(t, testPieceLength, 0)
+	router := newDHTNode(t)
+	info := swarm.infoDict("private.bin")
+	info["private"] = 1
+	data, err := bencode.Encode(map[string]any{
+		"info":  info,
+		"nodes": []any{[]any{"127.0.0.1", router.Addr().Port}},
+	})
+	if err != nil {
+		t.Fatalf("Failed to encode torrent: %v", err)
+	}
+	torrent, err := torrentlib.Parse(data)
+	if err != nil {
+		t.Fatalf("Failed to parse torrent: %v", err)
+	}
+
+	listener, err := torrentlib.Listen(0)
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	defer listener.Close()
+
+	node := newDHTNode(t)
+	output := filepath.Join(t.TempDir(), "private.bin")
+	if err := torrent.Download(ctx, output, torrentlib.DownloadOptions{MaxConnections: 2, Listener: listener, DHT: node}); err == nil {
+		t.Errorf("Expected error for a private torrent without trackers, got nil")
+	}
+	if nodes := node.Nodes(); len(nodes) != 0 {
+		t.Errorf("Expected the nodes of the torrent not to be used but got %v", nodes)
+	}
+}
@@ -0,0 +1,1056 @@
+package torrentlib_test
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/sha1"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"maps"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/codecrafters-io/bittorrent-starter-go/internal/encoding/bencode"
+	"github.com/codecrafters-io/bittorrent-starter-go/internal/torrentlib"
+	"github.com/codecrafters-io/bittorrent-starter-go/internal/torrentlib/peerlib"
+)
+
+const testPieceLength = 32 * 1024
+
+// swarm is a local tracker with fake seeders, so downloads can be tested
+// without network access
+type swarm struct {
+	t           *testing.T
+	content     []byte
+	pieceLength int
+	tracker     *httptest.Server
+	seeders     []net.Listener
+	// leechers are announced with the seeders, see addLeecher
+	leechers []net.Listener
+	// haveOnly makes seeders announce their pieces with have messages
+	// instead of a bitfield, as if they had just downloaded them
+	haveOnly bool
+	// split makes seeder n have only the pieces i with i%len(seeders) == n
+	split bool
+	// stall makes seeder 0 answer no request, the others wait a bit before
+	// unchoking so it gets some piece
+	stall   bool
+	cancels int
+	// interested counts the interested messages received by seeders
+	interested int
+	// blockDelay delays every block sent by seeders
+	blockDelay time.Duration
+	// corrupt makes the last seeder send wrong data
+	corrupt bool
+	// corruptBlocks limits corrupt to the first blocks sent, every block is
+	// wrong when 0
+	corruptBlocks int
+	corrupted     int
+	// served counts the blocks sent by each seeder
+	served map[int]int
+	// dhtPort makes seeders tell it as the port of their DHT node
+	dhtPort int
+	// ports are the DHT ports seeders were told with port messages
+	ports []int
+	// reserved are the reserved bytes of the handshakes seeders received
+	reserved []peerlib.Capabilities
+
+	mu        sync.Mutex
+	events    []string
+	lastQuery url.Values
+}
+
+func newSwarm(t *testing.T, length, totalSeeders int) *swarm {
+	addrs := make([]string, totalSeeders)
+	for i := range addrs {
+		addrs[i] = "127.0.0.1:0"
+	}
+	return newSwarmAt(t, length, addrs...)
+}
+
+// newSwarmAt creates a swarm with a seeder listening on each address
+func newSwarmAt(t *testing.T, length int, addrs ...string) *swarm {
+	content := make([]byte, length)
+	rand.Read(content)
+
+	s := &swarm{t: t, content: content, pieceLength: testPieceLength}
+	for _, addr := range addrs {
+		listener, err := net.Listen("tcp", addr)
+		if err != nil {
+			t.Fatalf("Failed to listen: %v", err)
+		}
+		t.Cleanup(func() { listener.Close() })
+		s.seeders = append(s.seeders, listener)
+		go s.serveSeeder(listener, len(s.seeders)-1)
+	}
+
+	s.tracker = httptest.NewServer(http.HandlerFunc(s.announce))
+	t.Cleanup(s.tracker.Close)
+
+	return s
+}
+
+func (s *swarm) announce(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	s.events = append(s.events, r.URL.Query().Get("event"))
+	s.lastQuery = r.URL.Query()
+	s.mu.Unlock()
+
+	var peers, peers6 []byte
+	s.mu.Lock()
+	listeners := slices.Concat(s.seeders, s.leechers)
+	s.mu.Unlock()
+	for _, listener := range listeners {
+		addr := listener.Addr().(*net.TCPAddr)
+		if ip := addr.IP.To4(); ip != nil {
+			peers = append(peers, ip...)
+			peers = binary.BigEndian.AppendUint16(peers, uint16(addr.Port))
+		} else {
+			peers6 = append(peers6, addr.IP.To16()...)
+			peers6 = binary.BigEndian.AppendUint16(peers6, uint16(addr.Port))
+		}
+	}
+
+	body, _ := bencode.Encode(map[string]any{
+		"interval": 1800,
+		"peers":    string(peers),
+		"peers6":   string(peers6),
+	})
+	w.Write(body)
+}
+
+func (s *swarm) Events() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]string(nil), s.events...)
+}
+
+// Query returns the query of the last announce
+func (s *swarm) Query() url.Values {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.lastQuery
+}
+
+func (s *swarm) infoDict(name string) map[string]any {
+	var pieces []byte
+	for offset := 0; offset < len(s.content); offset += s.pieceLength {
+		end := min(offset+s.pieceLength, len(s.content))
+		hash := sha1.Sum(s.content[offset:end])
+		pieces = append(pieces, hash[:]...)
+	}
+
+	return map[string]any{
+		"length":       len(s.content),
+		"name":         name,
+		"piece length": s.pieceLength,
+		"pieces":       string(pieces),
+	}
+}
+
+func (s *swarm) torrent(info map[string]any) *torrentlib.Torrent {
+	data, err := bencode.Encode(map[string]any{
+		"announce": s.tracker.URL + "/announce",
+		"info":     info,
+	})
+	if err != nil {
+		s.t.Fatalf("Failed to encode torrent: %v", err)
+	}
+	torrent, err := torrentlib.Parse(data)
+	if err != nil {
+		s.t.Fatalf("Failed to parse torrent: %v", err)
+	}
+	return torrent
+}
+
+func (s *swarm) serveSeeder(listener net.Listener, n int) {
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		go s.serveConn(conn, n)
+	}
+}
+
+// serveConn is a minimal seeder: it has every piece, unchokes whoever is
+// interested and answers every request
+func (s *swarm) serveConn(conn net.Conn, n int) {
+	defer conn.Close()
+
+	handshake := make([]byte, 68)
+	if _, err := io.ReadFull(conn, handshake); err != nil {
+		return
+	}
+	copy(handshake[48:68], bytes.Repeat([]byte{'S'}, 20))
+	s.mu.Lock()
+	s.reserved = append(s.reserved, peerlib.Capabilities(handshake[20:28]))
+	dhtPort := s.dhtPort
+	s.mu.Unlock()
+	clear(handshake[20:28])
+	if dhtPort != 0 {
+		handshake[27] = 0x01
+	}
+	if _, err := conn.Write(handshake); err != nil {
+		return
+	}
+	if dhtPort != 0 {
+		writeMessage(conn, 9, binary.BigEndian.AppendUint16(nil, uint16(dhtPort)))
+	}
+
+	totalPieces := (len(s.content) + s.pieceLength - 1) / s.pieceLength
+	s.mu.Lock()
+	stalled := s.stall && n == 0
+	slowUnchoke := s.stall && n != 0
+	haveOnly := s.haveOnly
+	corrupt := s.corrupt && n == len(s.seeders)-1
+	has := func(i int) bool { return !s.split || i%len(s.seeders) == n }
+	s.mu.Unlock()
+	if haveOnly {
+		conn.Write([]byte{0, 0, 0, 0}) // keep-alive
+		for i := 0; i < totalPieces; i++ {
+			if has(i) {
+				writeMessage(conn, 4, binary.BigEndian.AppendUint32(nil, uint32(i)))
+			}
+		}
+	} else {
+		bitfield := make([]byte, (totalPieces+7)/8)
+		for i := 0; i < totalPieces; i++ {
+			if has(i) {
+				bitfield[i/8] |= 1 << (7 - i%8)
+			}
+		}
+		writeMessage(conn, 5, bitfield)
+	}
+
+	for {
+		prefix := make([]byte, 4)
+		if _, err := io.ReadFull(conn, prefix); err != nil {
+			return
+		}
+		msg := make([]byte, binary.BigEndian.Uint32(prefix))
+		if _, err := io.ReadFull(conn, msg); err != nil {
+			return
+		}
+		if len(msg) == 0 {
+			continue
+		}
+
+		switch msg[0] {
+		case 2: // interested
+			s.mu.Lock()
+			s.interested++
+			s.mu.Unlock()
+			if slowUnchoke {
+				time.Sleep(200 * time.Millisecond)
+			}
+			writeMessage(conn, 1, nil)
+		case 8: // cancel
+			s.mu.Lock()
+			s.cancels++
+			s.mu.Unlock()
+		case 9: // port
+			s.mu.Lock()
+			s.ports = append(s.ports, int(binary.BigEndian.Uint16(msg[1:3])))
+			s.mu.Unlock()
+		case 6: // request
+			if stalled {
+				continue
+			}
+			s.mu.Lock()
+			if s.served == nil {
+				s.served = make(map[int]int)
+			}
+			s.served[n]++
+			blockDelay := s.blockDelay
+			s.mu.Unlock()
+			time.Sleep(blockDelay)
+			index := binary.BigEndian.Uint32(msg[1:5])
+			begin := binary.BigEndian.Uint32(msg[5:9])
+			length := binary.BigEndian.Uint32(msg[9:13])
+			offset := int(index)*s.pieceLength + int(begin)
+
+			payload := make([]byte, 8, 8+length)
+			copy(payload, msg[1:9])
+			payload = append(payload, s.content[offset:offset+int(length)]...)
+			s.mu.Lock()
+			if corrupt && (s.corruptBlocks == 0 || s.corrupted < s.corruptBlocks) {
+				payload[8] ^= 0xFF
+				s.corrupted++
+			}
+			s.mu.Unlock()
+			writeMessage(conn, 7, payload)
+		}
+	}
+}
+
+// addLeecher adds a peer that has no pieces and requests every block once it
+// knows we have them. The content it received is sent to the returned channel,
+// the leecher stays connected until we disconnect.
+func (s *swarm) addLeecher() <-chan []byte {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		s.t.Fatalf("Failed to listen: %v", err)
+	}
+	s.t.Cleanup(func() { listener.Close() })
+	s.mu.Lock()
+	s.leechers = append(s.leechers, listener)
+	s.mu.Unlock()
+
+	received := make(chan []byte, 1)
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		if err := answerHandshake(conn, 'L'); err != nil {
+			s.t.Logf("Leecher failed: %v", err)
+			return
+		}
+		data, err := s.leech(conn)
+		if err != nil {
+			s.t.Logf("Leecher failed: %v", err)
+			return
+		}
+		received <- data
+		io.Copy(io.Discard, conn)
+	}()
+
+	return received
+}
+
+// answerHandshake reads the handshake of a peer that connected to us and
+// answers with a peer id full of id
+func answerHandshake(conn net.Conn, id byte) error {
+	handshake := make([]byte, 68)
+	if _, err := io.ReadFull(conn, handshake); err != nil {
+		return err
+	}
+	copy(handshake[48:68], bytes.Repeat([]byte{id}, 20))
+	clear(handshake[20:28])
+	_, err := conn.Write(handshake)
+	return err
+}
+
+// dialHandshake connects to addr and exchanges handshakes for infoHash
+func dialHandshake(addr string, infoHash []byte) (net.Conn, error) {
+	return dialHandshakeFrom(nil, peerlib.Capabilities{}, addr, infoHash)
+}
+
+// dialHandshakeFrom is dialHandshake from a local address, with reserved as
+// our capabilities
+func dialHandshakeFrom(local net.Addr, reserved peerlib.Capabilities, addr string, infoHash []byte) (net.Conn, error) {
+	dialer := net.Dialer{Timeout: time.Second, LocalAddr: local}
+	conn, err := dialer.Dial("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+
+	handshake := make([]byte, 68)
+	handshake[0] = 19
+	copy(handshake[1:20], "BitTorrent protocol")
+	copy(handshake[20:28], reserved[:])
+	copy(handshake[28:48], infoHash)
+	copy(handshake[48:68], bytes.Repeat([]byte{'D'}, 20))
+	if _, err := conn.Write(handshake); err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	if _, err := io.ReadFull(conn, handshake); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	if !bytes.Equal(handshake[28:48], infoHash) {
+		conn.Close()
+		return nil, fmt.Errorf("expected infohash %x but got %x", infoHash, handshake[28:48])
+	}
+
+	return conn, nil
+}
+
+// leech requests every block from a peer after the handshake, once the peer
+// has them all, and returns the content
+func (s *swarm) leech(conn net.Conn) ([]byte, error) {
+	totalPieces := (len(s.content) + s.pieceLength - 1) / s.pieceLength
+	writeMessage(conn, 5, make([]byte, (totalPieces+7)/8))
+
+	data := make([]byte, len(s.content))
+	have := 0
+	interested := false
+	received := 0
+	for received < len(data) {
+		prefix := make([]byte, 4)
+		if _, err := io.ReadFull(conn, prefix); err != nil {
+			return nil, err
+		}
+		msg := make([]byte, binary.BigEndian.Uint32(prefix))
+		if _, err := io.ReadFull(conn, msg); err != nil {
+			return nil, err
+		}
+		if len(msg) == 0 {
+			continue
+		}
+
+		switch msg[0] {
+		case 4: // have
+			have++
+		case 5: // bitfield
+			for i := 0; i < totalPieces; i++ {
+				if msg[1+i/8]>>(7-i%8)&1 == 1 {
+					have++
+				}
+			}
+		case 1: // unchoke
+			for offset := 0; offset < len(data); offset += 16 * 1024 {
+				request := make([]byte, 12)
+				binary.BigEndian.PutUint32(request[0:4], uint32(offset/s.pieceLength))
+				binary.BigEndian.PutUint32(request[4:8], uint32(offset%s.pieceLength))
+				binary.BigEndian.PutUint32(request[8:12], uint32(min(16*1024, len(data)-offset)))
+				writeMessage(conn, 6, request)
+			}
+		case 7: // piece
+			index := binary.BigEndian.Uint32(msg[1:5])
+			begin := binary.BigEndian.Uint32(msg[5:9])
+			received += copy(data[int(index)*s.pieceLength+int(begin):], msg[9:])
+		}
+
+		// only ask once every piece is available
+		if have == totalPieces && !interested {
+			writeMessage(conn, 2, nil)
+			interested = true
+		}
+	}
+
+	return data, nil
+}
+
+func writeMessage(conn net.Conn, id byte, payload []byte) {
+	buf := make([]byte, 5, 5+len(payload))
+	binary.BigEndian.PutUint32(buf, uint32(1+len(payload)))
+	buf[4] = id
+	conn.Write(append(buf, payload...))
+}
+
+func TestDownloadSingleFile(t *testing.T) {
+	swarm := newSwarm(t, 3*testPieceLength+1234, 2)
+	torrent := swarm.torrent(swarm.infoDict("single.bin"))
+
+	output := filepath.Join(t.TempDir(), "single.bin")
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	if err := torrent.Download(ctx, output, torrentlib.DownloadOptions{MaxConnections: 2}); err != nil {
+		t.Fatalf("Failed to download: %v", err)
+	}
+
+	data, err := os.ReadFile(output)
+	if err != nil {
+		t.Fatalf("Failed to read output: %v", err)
+	}
+	if !bytes.Equal(data, swarm.content) {
+		t.Errorf("Downloaded content does not match")
+	}
+
+	events := swarm.Events()
+	if len(events) < 3 || events[0] != "started" || events[len(events)-2] != "completed" || events[len(events)-1] != "stopped" {
+		t.Errorf("Expected started, completed and stopped events but got %q", events)
+	}
+}
+
+func TestDownloadHaveMessages(t *testing.T) {
+	swarm := newSwarm(t, 3*testPieceLength, 1)
+	swarm.mu.Lock()
+	swarm.haveOnly = true
+	swarm.mu.Unlock()
+	torrent := swarm.torrent(swarm.infoDict("have.bin"))
+
+	output := filepath.Join(t.TempDir(), "have.bin")
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	if err := torrent.Download(ctx, output, torrentlib.DownloadOptions{MaxConnections: 1}); err != nil {
+		t.Fatalf("Failed to download: %v", err)
+	}
+
+	data, err := os.ReadFile(output)
+	if err != nil {
+		t.Fatalf("Failed to read output: %v", err)
+	}
+	if !bytes.Equal(data, swarm.content) {
+		t.Errorf("Downloaded content does not match")
+	}
+}
+
+func TestDownloadSplitPieces(t *testing.T) {
+	swarm := newSwarm(t, 7*testPieceLength+5, 3)
+	swarm.mu.Lock()
+	swarm.split = true
+	swarm.mu.Unlock()
+	torrent := swarm.torrent(swarm.infoDict("split.bin"))
+
+	output := filepath.Join(t.TempDir(), "split.bin")
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	if err := torrent.Download(ctx, output, torrentlib.DownloadOptions{MaxConnections: 3}); err != nil {
+		t.Fatalf("Failed to download: %v", err)
+	}
+
+	data, err := os.ReadFile(output)
+	if err != nil {
+		t.Fatalf("Failed to read output: %v", err)
+	}
+	if !bytes.Equal(data, swarm.content) {
+		t.Errorf("Downloaded content does not match")
+	}
+}
+
+func TestDownloadBlocksFromSeveralPeers(t *testing.T) {
+	// a single piece, its blocks are shared between both seeders
+	swarm := newSwarm(t, 16*torrentlib.BlockSize, 2)
+	swarm.mu.Lock()
+	swarm.pieceLength = 16 * torrentlib.BlockSize
+	swarm.blockDelay = 20 * time.Millisecond
+	swarm.mu.Unlock()
+	torrent := swarm.torrent(swarm.infoDict("blocks.bin"))
+
+	output := filepath.Join(t.TempDir(), "blocks.bin")
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	if err := torrent.Download(ctx, output, torrentlib.DownloadOptions{MaxConnections: 2}); err != nil {
+		t.Fatalf("Failed to download: %v", err)
+	}
+
+	data, err := os.ReadFile(output)
+	if err != nil {
+		t.Fatalf("Failed to read output: %v", err)
+	}
+	if !bytes.Equal(data, swarm.content) {
+		t.Errorf("Downloaded content does not match")
+	}
+
+	swarm.mu.Lock()
+	defer swarm.mu.Unlock()
+	if swarm.served[0] == 0 || swarm.served[1] == 0 {
+		t.Errorf("Expected blocks from both seeders but got %v", swarm.served)
+	}
+}
+
+func TestDownloadEndgame(t *testing.T) {
+	swarm := newSwarm(t, 3*testPieceLength, 2)
+	swarm.mu.Lock()
+	swarm.stall = true
+	swarm.mu.Unlock()
+	torrent := swarm.torrent(swarm.infoDict("endgame.bin"))
+
+	output := filepath.Join(t.TempDir(), "endgame.bin")
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	if err := torrent.Download(ctx, output, torrentlib.DownloadOptions{MaxConnections: 2}); err != nil {
+		t.Fatalf("Failed to download: %v", err)
+	}
+
+	data, err := os.ReadFile(output)
+	if err != nil {
+		t.Fatalf("Failed to read output: %v", err)
+	}
+	if !bytes.Equal(data, swarm.content) {
+		t.Errorf("Downloaded content does not match")
+	}
+
+	// NOTE: the cancel may still be on its way
+	deadline := time.Now().Add(time.Second)
+	for {
+		swarm.mu.Lock()
+		cancels := swarm.cancels
+		swarm.mu.Unlock()
+		if cancels > 0 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("Expected the stalled seeder to get cancel messages")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestDownloadMissingPiece(t *testing.T) {
+	// the only seeder lacks piece 1
+	swarm := newSwarm(t, 3*testPieceLength, 2)
+	swarm.mu.Lock()
+	swarm.split = true
+	swarm.seeders[1].Close()
+	swarm.mu.Unlock()
+	torrent := swarm.torrent(swarm.infoDict("missing.bin"))
+
+	output := filepath.Join(t.TempDir(), "missing.bin")
+	ctx, cancel := context.WithTimeout(context.Background(), 500*time.Millisecond)
+	defer cancel()
+
+	err := torrent.Download(ctx, output, torrentlib.DownloadOptions{MaxConnections: 2})
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("Expected the download to wait for the missing piece but got %v", err)
+	}
+
+	data, err := os.ReadFile(output)
+	if err != nil {
+		t.Fatalf("Failed to read output: %v", err)
+	}
+	for _, piece := range []int{0, 2} {
+		offset := piece * testPieceLength
+		if !bytes.Equal(data[offset:offset+testPieceLength], swarm.content[offset:offset+testPieceLength]) {
+			t.Errorf("Piece %d does not match", piece)
+		}
+	}
+}
+
+func TestDownloadBanCorruptPeer(t *testing.T) {
+	// NOTE: peers are banned by IP, the bad one needs its own
+	probe, err := net.Listen("tcp", "127.0.0.2:0")
+	if err != nil {
+		t.Skipf("127.0.0.2 not available: %v", err)
+	}
+	probe.Close()
+
+	listener, err := torrentlib.Listen(0)
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	defer listener.Close()
+
+	swarm := newSwarmAt(t, 8*testPieceLength, "127.0.0.1:0", "127.0.0.2:0")
+	swarm.mu.Lock()
+	swarm.corrupt = true
+	swarm.mu.Unlock()
+	torrent := swarm.torrent(swarm.infoDict("ban.bin"))
+
+	output := filepath.Join(t.TempDir(), "ban.bin")
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	downloaded := make(chan struct{})
+	downloadErr := make(chan error, 1)
+	go func() {
+		defer close(downloaded)
+		downloadErr <- torrent.Download(ctx, output, torrentlib.DownloadOptions{MaxConnections: 2, Seed: true, Listener: listener})
+	}()
+
+	// the download keeps seeding, wait until the file is complete
+	for {
+		data, _ := os.ReadFile(output)
+		if bytes.Equal(data, swarm.content) {
+			break
+		}
+		select {
+		case <-downloaded:
+			t.Fatalf("Download returned: %v", <-downloadErr)
+		case <-ctx.Done():
+			t.Fatalf("Downloaded content does not match")
+		case <-time.After(10 * time.Millisecond):
+		}
+	}
+
+	// the banned peer can't connect to us either
+	addr := net.JoinHostPort("127.0.0.1", strconv.Itoa(listener.Port()))
+	conn, err := dialHandshakeFrom(&net.TCPAddr{IP: net.ParseIP("127.0.0.2")}, peerlib.Capabilities{}, addr, torrent.InfoHash)
+	if err != nil {
+		t.Fatalf("Failed to connect from the banned peer: %v", err)
+	}
+	defer conn.Close()
+	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	if _, err := conn.Read(make([]byte, 1)); err != io.EOF {
+		t.Errorf("Expected banned peer to be disconnected but got %v", err)
+	}
+
+	cancel()
+	if err := <-downloadErr; err != nil {
+		t.Errorf("Expected no error after seeding but got %v", err)
+	}
+}
+
+func TestDownloadBanCorruptPeerSharedPiece(t *testing.T) {
+	probe, err := net.Listen("tcp", "127.0.0.2:0")
+	if err != nil {
+		t.Skipf("127.0.0.2 not available: %v", err)
+	}
+	probe.Close()
+
+	listener, err := torrentlib.Listen(0)
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	defer listener.Close()
+
+	// the blocks of every attempt are shared between the honest seeder and
+	// the bad one, which is banned once it poisoned a few pieces
+	swarm := newSwarmAt(t, 6*16*torrentlib.BlockSize, "127.0.0.1:0", "127.0.0.2:0")
+	swarm.mu.Lock()
+	swarm.pieceLength = 16 * torrentlib.BlockSize
+	swarm.blockDelay = 5 * time.Millisecond
+	swarm.corrupt = true
+	swarm.mu.Unlock()
+	torrent := swarm.torrent(swarm.infoDict("shared.bin"))
+
+	output := filepath.Join(t.TempDir(), "shared.bin")
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	downloaded := make(chan struct{})
+	downloadErr := make(chan error, 1)
+	go func() {
+		defer close(downloaded)
+		downloadErr <- torrent.Download(ctx, output, torrentlib.DownloadOptions{MaxConnections: 2, Seed: true, Listener: listener})
+	}()
+
+	for {
+		data, _ := os.ReadFile(output)
+		if bytes.Equal(data, swarm.content) {
+			break
+		}
+		select {
+		case <-downloaded:
+			t.Fatalf("Download returned: %v", <-downloadErr)
+		case <-ctx.Done():
+			t.Fatalf("Downloaded content does not match")
+		case <-time.After(10 * time.Millisecond):
+		}
+	}
+
+	swarm.mu.Lock()
+	served := maps.Clone(swarm.served)
+	swarm.mu.Unlock()
+	if served[1] == 0 {
+		t.Fatalf("Expected the bad seeder to send blocks but got %v", served)
+	}
+
+	// the bad peer is banned, the honest one is not
+	addr := net.JoinHostPort("127.0.0.1", strconv.Itoa(listener.Port()))
+	conn, err := dialHandshakeFrom(&net.TCPAddr{IP: net.ParseIP("127.0.0.2")}, peerlib.Capabilities{}, addr, torrent.InfoHash)
+	if err != nil {
+		t.Fatalf("Failed to connect from the banned peer: %v", err)
+	}
+	defer conn.Close()
+	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	if _, err := conn.Read(make([]byte, 1)); err != io.EOF {
+		t.Errorf("Expected banned peer to be disconnected but got %v", err)
+	}
+
+	honest, err := dialHandshakeFrom(&net.TCPAddr{IP: net.ParseIP("127.0.0.1")}, peerlib.Capabilities{}, addr, torrent.InfoHash)
+	if err != nil {
+		t.Fatalf("Failed to connect from the honest peer: %v", err)
+	}
+	defer honest.Close()
+	honest.SetReadDeadline(time.Now().Add(500 * time.Millisecond))
+	if _, err := honest.Read(make([]byte, 1)); err == io.EOF {
+		t.Errorf("Expected honest peer to stay connected")
+	}
+
+	cancel()
+	if err := <-downloadErr; err != nil {
+		t.Errorf("Expected no error after seeding but got %v", err)
+	}
+}
+
+func TestDownloadOneBadPiece(t *testing.T) {
+	listener, err := torrentlib.Listen(0)
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	defer listener.Close()
+
+	// the only seeder sends a single bad block, it loses trust but is not
+	// banned, so the download can finish
+	swarm := newSwarm(t, 4*testPieceLength, 1)
+	swarm.mu.Lock()
+	swarm.corrupt = true
+	swarm.corruptBlocks = 1
+	swarm.mu.Unlock()
+	torrent := swarm.torrent(swarm.infoDict("once.bin"))
+
+	output := filepath.Join(t.TempDir(), "once.bin")
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	if err := torrent.Download(ctx, output, torrentlib.DownloadOptions{MaxConnections: 1, Listener: listener}); err != nil {
+		t.Fatalf("Failed to download: %v", err)
+	}
+	data, err := os.ReadFile(output)
+	if err != nil {
+		t.Fatalf("Failed to read output: %v", err)
+	}
+	if !bytes.Equal(data, swarm.content) {
+		t.Errorf("Downloaded content does not match")
+	}
+	swarm.mu.Lock()
+	defer swarm.mu.Unlock()
+	if swarm.corrupted != 1 {
+		t.Errorf("Expected a bad block to be sent but got %d", swarm.corrupted)
+	}
+}
+
+func TestDownloadPieceFailsRepeatedly(t *testing.T) {
+	listener, err := torrentlib.Listen(0)
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	defer listener.Close()
+
+	// a piece of a single block, every attempt of it is bad until the seeder
+	// stops corrupting blocks. There is no limit of attempts, the seeder is
+	// not banned yet after three.
+	swarm := newSwarm(t, torrentlib.BlockSize, 1)
+	swarm.mu.Lock()
+	swarm.pieceLength = torrentlib.BlockSize
+	swarm.corrupt = true
+	swarm.corruptBlocks = 3
+	swarm.mu.Unlock()
+	torrent := swarm.torrent(swarm.infoDict("retry.bin"))
+
+	output := filepath.Join(t.TempDir(), "retry.bin")
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	if err := torrent.Download(ctx, output, torrentlib.DownloadOptions{MaxConnections: 1, Listener: listener}); err != nil {
+		t.Fatalf("Failed to download: %v", err)
+	}
+	data, err := os.ReadFile(output)
+	if err != nil {
+		t.Fatalf("Failed to read output: %v", err)
+	}
+	if !bytes.Equal(data, swarm.content) {
+		t.Errorf("Downloaded content does not match")
+	}
+	swarm.mu.Lock()
+	defer swarm.mu.Unlock()
+	if swarm.corrupted != 3 {
+		t.Errorf("Expected 3 bad attempts but got %d", swarm.corrupted)
+	}
+}
+
+func TestDownloadMultiFile(t *testing.T) {
+	swarm := newSwarm(t, 2*testPieceLength+100, 1)
+
+	// file boundaries fall in the middle of pieces
+	info := swarm.infoDict("root")
+	delete(info, "length")
+	info["files"] = []any{
+		map[string]any{"length": 1000, "path": []any{"a.bin"}},
+		map[string]any{"length": testPieceLength, "path": []any{"sub", "b.bin"}},
+		map[string]any{"length": 0, "path": []any{"empty"}},
+		map[string]any{"length": testPieceLength - 900, "path": []any{"c.bin"}},
+	}
+	torrent := swarm.torrent(info)
+
+	output := t.TempDir()
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	if err := torrent.Download(ctx, output, torrentlib.DownloadOptions{MaxConnections: 1}); err != nil {
+		t.Fatalf("Failed to download: %v", err)
+	}
+
+	var downloaded []byte
+	for _, path := range []string{"a.bin", filepath.Join("sub", "b.bin"), "empty", "c.bin"} {
+		data, err := os.ReadFile(filepath.Join(output, "root", path))
+		if err != nil {
+			t.Fatalf("Failed to read output file %s: %v", path, err)
+		}
+		downloaded = append(downloaded, data...)
+	}
+	if !bytes.Equal(downloaded, swarm.content) {
+		t.Errorf("Downloaded content does not match")
+	}
+}
+
+func TestDownloadIPv6Peer(t *testing.T) {
+	probe, err := net.Listen("tcp6", "[::1]:0")
+	if err != nil {
+		t.Skipf("IPv6 loopback not available: %v", err)
+	}
+	probe.Close()
+
+	swarm := newSwarmAt(t, testPieceLength+10, "[::1]:0")
+	torrent := swarm.torrent(swarm.infoDict("v6.bin"))
+
+	output := filepath.Join(t.TempDir(), "v6.bin")
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	if err := torrent.Download(ctx, output, torrentlib.DownloadOptions{MaxConnections: 1}); err != nil {
+		t.Fatalf("Failed to download: %v", err)
+	}
+	if torrent.Peers[0] != swarm.seeders[0].Addr().String() {
+		t.Errorf("Expected peer %s but got %s", swarm.seeders[0].Addr(), torrent.Peers[0])
+	}
+
+	data, err := os.ReadFile(output)
+	if err != nil {
+		t.Fatalf("Failed to read output: %v", err)
+	}
+	if !bytes.Equal(data, swarm.content) {
+		t.Errorf("Downloaded content does not match")
+	}
+}
+
+func TestDownloadSeed(t *testing.T) {
+	swarm := newSwarm(t, 2*testPieceLength+4321, 1)
+	received := swarm.addLeecher()
+	torrent := swarm.torrent(swarm.infoDict("seed.bin"))
+
+	output := filepath.Join(t.TempDir(), "seed.bin")
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	downloadErr := make(chan error, 1)
+	go func() {
+		downloadErr <- torrent.Download(ctx, output, torrentlib.DownloadOptions{MaxConnections: 2, Seed: true})
+	}()
+
+	select {
+	case data := <-received:
+		if !bytes.Equal(data, swarm.content) {
+			t.Errorf("Uploaded content does not match")
+		}
+	case err := <-downloadErr:
+		t.Fatalf("Download returned before seeding: %v", err)
+	case <-ctx.Done():
+		t.Fatalf("Leecher did not receive the content")
+	}
+
+	cancel()
+	if err := <-downloadErr; err != nil {
+		t.Errorf("Expected no error after seeding but got %v", err)
+	}
+}
+
+func TestDownloadUploadSlots(t *testing.T) {
+	swarm := newSwarm(t, 2*testPieceLength, 1)
+	var leechers []<-chan []byte
+	for i := 0; i < 3; i++ {
+		leechers = append(leechers, swarm.addLeecher())
+	}
+	torrent := swarm.torrent(swarm.infoDict("slots.bin"))
+
+	output := filepath.Join(t.TempDir(), "slots.bin")
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	downloadErr := make(chan error, 1)
+	go func() {
+		downloadErr <- torrent.Download(ctx, output, torrentlib.DownloadOptions{MaxConnections: 4, Seed: true, UploadSlots: 1})
+	}()
+
+	// one upload slot and the optimistic unchoke, the third leecher stays
+	// choked until the optimistic unchoke rotates
+	received := 0
+	timeout := time.After(5 * time.Second)
+	for received < 2 {
+		select {
+		case <-leechers[0]:
+			received++
+		case <-leechers[1]:
+			received++
+		case <-leechers[2]:
+			received++
+		case <-timeout:
+			t.Fatalf("Expected two leechers to be unchoked but %d were", received)
+		}
+	}
+
+	select {
+	case <-leechers[0]:
+		t.Errorf("Expected only two leechers to be unchoked")
+	case <-leechers[1]:
+		t.Errorf("Expected only two leechers to be unchoked")
+	case <-leechers[2]:
+		t.Errorf("Expected only two leechers to be unchoked")
+	case <-time.After(500 * time.Millisecond):
+	}
+
+	cancel()
+	if err := <-downloadErr; err != nil {
+		t.Errorf("Expected no error after seeding but got %v", err)
+	}
+}
+
+func TestDownloadInboundPeers(t *testing.T) {
+	listener, err := torrentlib.Listen(0)
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	defer listener.Close()
+	addr := net.JoinHostPort("127.0.0.1", strconv.Itoa(listener.Port()))
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	// two torrents share the listener
+	swarms := []*swarm{newSwarm(t, testPieceLength+1, 1), newSwarm(t, 2*testPieceLength, 1)}
+	downloadErrs := make(chan error, len(swarms))
+	var torrents []*torrentlib.Torrent
+	for i, swarm := range swarms {
+		torrent := swarm.torrent(swarm.infoDict(fmt.Sprintf("inbound%d.bin", i)))
+		torrents = append(torrents, torrent)
+		output := filepath.Join(t.TempDir(), "inbound.bin")
+		go func() {
+			downloadErrs <- torrent.Download(ctx, output, torrentlib.DownloadOptions{MaxConnections: 2, Seed: true, Listener: listener})
+		}()
+	}
+
+	for i, swarm := range swarms {
+		// NOTE: the download may not be accepting peers yet
+		var conn net.Conn
+		for conn == nil {
+			conn, err = dialHandshake(addr, torrents[i].InfoHash)
+			if err != nil {
+				if ctx.Err() != nil {
+					t.Fatalf("Failed to connect to the listener: %v", err)
+				}
+				time.Sleep(10 * time.Millisecond)
+			}
+		}
+		defer conn.Close()
+
+		data, err := swarm.leech(conn)
+		if err != nil {
+			t.Fatalf("Failed to leech torrent %d: %v", i, err)
+		}
+		if !bytes.Equal(data, swarm.content) {
+			t.Errorf("Uploaded content of torrent %d does not match", i)
+		}
+	}
+
+	if _, err := dialHandshake(addr, bytes.Repeat([]byte{1}, 20)); err == nil {
+		t.Errorf("Expected unknown infohash to be rejected")
+	}
+
+	for _, swarm := range swarms {
+		query := swarm.Query()
+		if query.Get("port") != strconv.Itoa(listener.Port()) {
+			t.Errorf("Expected port %d to be announced but got %s", listener.Port(), query.Get("port"))
+		}
+	}
+
+	cancel()
+	for range swarms {
+		if err := <-downloadErrs; err != nil {
+			t.Errorf("Expected no error after seeding but got %v", err)
+		}
+	}
+}
@@ -0,0 +1,321 @@
+package torrentlib_test
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha1"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/codecrafters-io/bittorrent-starter-go/internal/encoding/bencode"
+	"github.com/codecrafters-io/bittorrent-starter-go/internal/torrentlib"
+	"github.com/codecrafters-io/bittorrent-starter-go/internal/torrentlib/peerlib"
+)
+
+func TestParseMagnet(t *testing.T) {
+	link := "magnet:?xt=urn:btih:ad42ce8109f54c99613ce38f9b4d87e70f24a165&dn=magnet1.gif" +
+		"&tr=http%3A%2F%2Fbittorrent-test-tracker.codecrafters.io%2Fannounce&tr=udp%3A%2F%2Ftracker.example.com%3A80" +
+		"&x.pe=127.0.0.1:6881&x.pe=[::1]:6882&ws=http%3A%2F%2Fexample.com%2Fmagnet1.gif"
+
+	magnet, err := torrentlib.ParseMagnet(link)
+	if err != nil {
+		t.Fatalf("Failed to parse magnet link: %v", err)
+	}
+
+	if hex.EncodeToString(magnet.InfoHash[:]) != "ad42ce8109f54c99613ce38f9b4d87e70f24a165" {
+		t.Errorf("Unexpected info hash %x", magnet.InfoHash)
+	}
+	if magnet.Name != "magnet1.gif" {
+		t.Errorf("Expected name magnet1.gif but got %q", magnet.Name)
+	}
+	expectedTrackers := []string{"http://bittorrent-test-tracker.codecrafters.io/announce", "udp://tracker.example.com:80"}
+	if !slices.Equal(magnet.Trackers, expectedTrackers) {
+		t.Errorf("Expected trackers %v but got %v", expectedTrackers, magnet.Trackers)
+	}
+	if !slices.Equal(magnet.Peers, []string{"127.0.0.1:6881", "[::1]:6882"}) {
+		t.Errorf("Unexpected peers %v", magnet.Peers)
+	}
+	if !slices.Equal(magnet.WebSeeds, []string{"http://example.com/magnet1.gif"}) {
+		t.Errorf("Unexpected web seeds %v", magnet.WebSeeds)
+	}
+}
+
+func TestParseMagnetBase32(t *testing.T) {
+	// base32 of ad42ce8109f54c99613ce38f9b4d87e70f24a165
+	magnet, err := torrentlib.ParseMagnet("magnet:?xt=urn:btih:VVBM5AIJ6VGJSYJ44OHZWTMH44HSJILF")
+	if err != nil {
+		t.Fatalf("Failed to parse magnet link: %v", err)
+	}
+	if hex.EncodeToString(magnet.InfoHash[:]) != "ad42ce8109f54c99613ce38f9b4d87e70f24a165" {
+		t.Errorf("Unexpected info hash %x", magnet.InfoHash)
+	}
+}
+
+func TestParseMagnetInvalid(t *testing.T) {
+	for _, link := range []string{
+		"http://example.com/?xt=urn:btih:ad42ce8109f54c99613ce38f9b4d87e70f24a165",
+		"magnet:?dn=no-topic",
+		"magnet:?xt=urn:btih:ad42ce",
+		"magnet:?xt=urn:btih:zz42ce8109f54c99613ce38f9b4d87e70f24a165",
+		"magnet:?xt=urn:btih:ad42ce8109f54c99613ce38f9b4d87e70f24a165&x.pe=no-port",
+	} {
+		if _, err := torrentlib.ParseMagnet(link); err == nil {
+			t.Errorf("Expected error parsing %q", link)
+		}
+	}
+}
+
+func TestMagnetDownload(t *testing.T) {
+	listener, err := torrentlib.Listen(0)
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	defer listener.Close()
+
+	// the info dictionary is sent in several pieces of metadata
+	swarm := newSwarm(t, 3*testPieceLength+100, 1)
+	info := swarm.infoDict("magnet.bin")
+	info["x-padding"] = strings.Repeat("p", 2*torrentlib.MetadataPieceSize)
+	seeded := swarm.torrent(info)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	// a seeding download serves the metadata, the connection that fetched it
+	// may still be open when the pieces are downloaded
+	seedErr := make(chan error, 1)
+	go func() {
+		output := filepath.Join(t.TempDir(), "magnet.bin")
+		seedErr <- seeded.Download(ctx, output, torrentlib.DownloadOptions{MaxConnections: 3, Seed: true, Listener: listener})
+	}()
+
+	addr := net.JoinHostPort("127.0.0.1", strconv.Itoa(listener.Port()))
+	magnet, err := torrentlib.ParseMagnet(fmt.Sprintf("magnet:?xt=urn:btih:%x&x.pe=%s", seeded.InfoHash, addr))
+	if err != nil {
+		t.Fatalf("Failed to parse magnet link: %v", err)
+	}
+
+	// NOTE: the download may not be accepting peers yet
+	var torrent *torrentlib.Torrent
+	for torrent == nil {
+		torrent, err = magnet.FetchTorrent(ctx, 1, nil)
+		if err != nil {
+			if ctx.Err() != nil {
+				t.Fatalf("Failed to fetch torrent: %v", err)
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+
+	if !bytes.Equal(torrent.InfoHash, seeded.InfoHash) || torrent.Name != "magnet.bin" || torrent.Length != len(swarm.content) {
+		t.Errorf("Expected torrent %x %s %d but got %x %s %d", seeded.InfoHash, seeded.Name, seeded.Length, torrent.InfoHash, torrent.Name, torrent.Length)
+	}
+	if !slices.EqualFunc(torrent.PiecesHash, seeded.PiecesHash, bytes.Equal) {
+		t.Errorf("Piece hashes do not match")
+	}
+
+	// without trackers, the pieces come from the peers of the link
+	leecherListener, err := torrentlib.Listen(0)
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	defer leecherListener.Close()
+	output := filepath.Join(t.TempDir(), "magnet.bin")
+	if err := torrent.Download(ctx, output, torrentlib.DownloadOptions{MaxConnections: 2, Listener: leecherListener, Peers: torrent.Peers}); err != nil {
+		t.Fatalf("Failed to download: %v", err)
+	}
+	data, err := os.ReadFile(output)
+	if err != nil {
+		t.Fatalf("Failed to read output: %v", err)
+	}
+	if !bytes.Equal(data, swarm.content) {
+		t.Errorf("Downloaded content does not match")
+	}
+
+	cancel()
+	if err := <-seedErr; err != nil {
+		t.Errorf("Expected no error after seeding but got %v", err)
+	}
+}
+
+// metadataPeer is a peer that only sends the info dictionary. Its extension
+// handshake has no ut_metadata when metadataID is 0, and no metadata_size
+// when noSize is set. With corrupt, the first piece it sends is wrong. With
+// reply, every request is answered with it instead of the piece.
+type metadataPeer struct {
+	info       []byte
+	metadataID int
+	noSize     bool
+	corrupt    atomic.Bool
+	reply      []byte
+}
+
+func (p *metadataPeer) serve(t *testing.T) string {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	t.Cleanup(func() { listener.Close() })
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go p.serveConn(conn)
+		}
+	}()
+	return listener.Addr().String()
+}
+
+func (p *metadataPeer) serveConn(conn net.Conn) {
+	defer conn.Close()
+
+	handshake := make([]byte, 68)
+	if _, err := io.ReadFull(conn, handshake); err != nil {
+		return
+	}
+	copy(handshake[48:68], bytes.Repeat([]byte{'M'}, 20))
+	clear(handshake[20:28])
+	handshake[25] = 0x10
+	if _, err := conn.Write(handshake); err != nil {
+		return
+	}
+
+	m := map[string]any{}
+	if p.metadataID != 0 {
+		m["ut_metadata"] = p.metadataID
+	}
+	ours := map[string]any{"m": m}
+	if !p.noSize {
+		ours["metadata_size"] = len(p.info)
+	}
+	payload, _ := bencode.Encode(ours)
+	writeMessage(conn, 20, append([]byte{0}, payload...))
+
+	theirID := 0
+	for {
+		id, payload, err := readExtended(conn)
+		if err != nil {
+			return
+		}
+		if id == 0 {
+			var theirs peerlib.ExtensionHandshake
+			bencode.Unmarshal(payload, &theirs)
+			theirID = theirs.M["ut_metadata"]
+			continue
+		}
+
+		var req map[string]int
+		if err := bencode.Unmarshal(payload, &req); err != nil || req["msg_type"] != 0 {
+			continue
+		}
+		if p.reply != nil {
+			writeMessage(conn, 20, append([]byte{byte(theirID)}, p.reply...))
+			continue
+		}
+		piece := req["piece"]
+		start := piece * torrentlib.MetadataPieceSize
+		data := bytes.Clone(p.info[start:min(start+torrentlib.MetadataPieceSize, len(p.info))])
+		if p.corrupt.CompareAndSwap(true, false) {
+			data[0] ^= 0xFF
+		}
+		res, _ := bencode.Encode(map[string]any{"msg_type": 1, "piece": piece, "total_size": len(p.info)})
+		writeMessage(conn, 20, append(append([]byte{byte(theirID)}, res...), data...))
+	}
+}
+
+// metadataInfo returns an info dictionary sent in several pieces of metadata,
+// and its info hash
+func metadataInfo(t *testing.T) ([]byte, [20]byte) {
+	info := newSwarm(t, 3*testPieceLength, 0).infoDict("metadata.bin")
+	info["x-padding"] = strings.Repeat("p", 2*torrentlib.MetadataPieceSize)
+	data, err := bencode.Encode(info)
+	if err != nil {
+		t.Fatalf("Failed to encode info: %v", err)
+	}
+	return data, sha1.Sum(data)
+}
+
+func fetchFrom(ctx context.Context, t *testing.T, infoHash [20]byte, peers ...string) (*torrentlib.Torrent, error) {
+	link := fmt.Sprintf("magnet:?xt=urn:btih:%x", infoHash)
+	for _, peer := range peers {
+		link += "&x.pe=" + peer
+	}
+	magnet, err := torrentlib.ParseMagnet(link)
+	if err != nil {
+		t.Fatalf("Failed to parse magnet link: %v", err)
+	}
+	return magnet.FetchTorrent(ctx, 1, nil)
+}
+
+func TestMagnetCorruptMetadata(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	// the only peer sends a bad piece first, the metadata is asked again
+	info, infoHash := metadataInfo(t)
+	peer := &metadataPeer{info: info, metadataID: 3}
+	peer.corrupt.Store(true)
+
+	torrent, err := fetchFrom(ctx, t, infoHash, peer.serve(t))
+	if err != nil {
+		t.Fatalf("Failed to fetch torrent: %v", err)
+	}
+	if !bytes.Equal(torrent.InfoHash, infoHash[:]) {
+		t.Errorf("Expected info hash %x but got %x", infoHash, torrent.InfoHash)
+	}
+	if peer.corrupt.Load() {
+		t.Errorf("Expected the corrupt piece to be sent")
+	}
+}
+
+func TestMagnetPeersWithoutMetadata(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	// a single connection, the peers that can't send the metadata must not
+	// keep it
+	info, infoHash := metadataInfo(t)
+	noMetadata := &metadataPeer{info: info}
+	noSize := &metadataPeer{info: info, metadataID: 3, noSize: true}
+	good := &metadataPeer{info: info, metadataID: 3}
+
+	torrent, err := fetchFrom(ctx, t, infoHash, noMetadata.serve(t), noSize.serve(t), good.serve(t))
+	if err != nil {
+		t.Fatalf("Failed to fetch torrent: %v", err)
+	}
+	if !bytes.Equal(torrent.InfoHash, infoHash[:]) {
+		t.Errorf("Expected info hash %x but got %x", infoHash, torrent.InfoHash)
+	}
+}
+
+func TestMagnetBadMetadataMessages(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	// the lengths come from the peers, the ones sending bad ones are dropped
+	info, infoHash := metadataInfo(t)
+	negative := &metadataPeer{info: info, metadataID: 3, reply: []byte("d8:msg_typei1e5:piecei0e10:total_size-1:ae")}
+	oversized := &metadataPeer{info: info, metadataID: 3, reply: []byte("d8:msg_typei1e5:piece99999999999999:ae")}
+	good := &metadataPeer{info: info, metadataID: 3}
+
+	torrent, err := fetchFrom(ctx, t, infoHash, negative.serve(t), oversized.serve(t), good.serve(t))
+	if err != nil {
+		t.Fatalf("Failed to fetch torrent: %v", err)
+	}
+	if !bytes.Equal(torrent.InfoHash, infoHash[:]) {
+		t.Errorf("Expected info hash %x but got %x", infoHash, torrent.InfoHash)
+	}
+}
@@ -0,0 +1,267 @@
+package torrentlib_test
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/codecrafters-io/bittorrent-starter-go/internal/encoding/bencode"
+	"github.com/codecrafters-io/bittorrent-starter-go/internal/torrentlib"
+	"github.com/codecrafters-io/bittorrent-starter-go/internal/torrentlib/peerlib"
+	"github.com/codecrafters-io/bittorrent-starter-go/internal/torrentlib/trackerlib"
+)
+
+// readExtended reads messages until an extended one, and returns its extended
+// id and payload
+func readExtended(conn net.Conn) (byte, []byte, error) {
+	for {
+		prefix := make([]byte, 4)
+		if _, err := io.ReadFull(conn, prefix); err != nil {
+			return 0, nil, err
+		}
+		msg := make([]byte, binary.BigEndian.Uint32(prefix))
+		if _, err := io.ReadFull(conn, msg); err != nil {
+			return 0, nil, err
+		}
+		if len(msg) >= 2 && msg[0] == 20 {
+			return msg[1], msg[2:], nil
+		}
+	}
+}
+
+// waitInterested waits until the download is interested in a seeder, it
+// accepts peers by then
+func (s *swarm) waitInterested(ctx context.Context) {
+	for {
+		s.mu.Lock()
+		interested := s.interested
+		s.mu.Unlock()
+		if interested > 0 {
+			return
+		}
+		if ctx.Err() != nil {
+			s.t.Fatalf("Download never connected to the seeder")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestDownloadPex(t *testing.T) {
+	listener, err := torrentlib.Listen(0)
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	defer listener.Close()
+	addr := net.JoinHostPort("127.0.0.1", strconv.Itoa(listener.Port()))
+
+	// the tracker only knows a seeder that sends nothing, the download needs
+	// a seeder only known through pex
+	swarm := newSwarm(t, 2*testPieceLength, 1)
+	swarm.stall = true
+	hidden, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	defer hidden.Close()
+	go swarm.serveSeeder(hidden, 1)
+
+	torrent := swarm.torrent(swarm.infoDict("pex.bin"))
+	output := filepath.Join(t.TempDir(), "pex.bin")
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	downloadErr := make(chan error, 1)
+	go func() {
+		downloadErr <- torrent.Download(ctx, output, torrentlib.DownloadOptions{MaxConnections: 3, Listener: listener})
+	}()
+
+	// NOTE: the stalled seeder must be connected to be sent
+	swarm.waitInterested(ctx)
+
+	conn, err := dialHandshakeFrom(nil, peerlib.LocalCapabilities, addr, torrent.InfoHash)
+	if err != nil {
+		t.Fatalf("Failed to connect to the download: %v", err)
+	}
+	defer conn.Close()
+
+	id, payload, err := readExtended(conn)
+	if err != nil || id != 0 {
+		t.Fatalf("Expected extension handshake but got %d, %v", id, err)
+	}
+	var handshake peerlib.ExtensionHandshake
+	if err := bencode.Unmarshal(payload, &handshake); err != nil {
+		t.Fatalf("Failed to decode extension handshake: %v", err)
+	}
+	pexID, ok := handshake.M["ut_pex"]
+	if !ok {
+		t.Fatalf("Expected ut_pex in the extension handshake but got %v", handshake.M)
+	}
+
+	reply, _ := bencode.Encode(peerlib.ExtensionHandshake{M: map[string]int{"ut_pex": 1}})
+	writeMessage(conn, 20, append([]byte{0}, reply...))
+
+	// the peers connected are sent right after the handshake
+	id, payload, err = readExtended(conn)
+	if err != nil || id != 1 {
+		t.Fatalf("Expected ut_pex message but got %d, %v", id, err)
+	}
+	var msg map[string]string
+	if err := bencode.Unmarshal(payload, &msg); err != nil {
+		t.Fatalf("Failed to decode ut_pex message: %v", err)
+	}
+	added, err := trackerlib.ParseCompactPeers([]byte(msg["added"]))
+	if err != nil {
+		t.Fatalf("Failed to parse added peers: %v", err)
+	}
+	seeder := swarm.seeders[0].Addr().String()
+	if !slices.Equal(added, []string{seeder}) {
+		t.Errorf("Expected added peers %v but got %v", []string{seeder}, added)
+	}
+	if msg["added.f"] != "\x10" {
+		t.Errorf("Expected the seeder flagged as reachable but got %x", msg["added.f"])
+	}
+
+	compact, err := trackerlib.FormatCompactPeer(hidden.Addr().String())
+	if err != nil {
+		t.Fatalf("Failed to format peer: %v", err)
+	}
+	pex, _ := bencode.Encode(map[string]any{"added": string(compact), "added.f": "\x10"})
+	writeMessage(conn, 20, append([]byte{byte(pexID)}, pex...))
+
+	if err := <-downloadErr; err != nil {
+		t.Fatalf("Failed to download: %v", err)
+	}
+	data, err := os.ReadFile(output)
+	if err != nil {
+		t.Fatalf("Failed to read output: %v", err)
+	}
+	if !bytes.Equal(data, swarm.content) {
+		t.Errorf("Downloaded content does not match")
+	}
+	swarm.mu.Lock()
+	defer swarm.mu.Unlock()
+	if swarm.served[1] == 0 {
+		t.Errorf("Expected blocks from the seeder learned through pex")
+	}
+}
+
+func TestPexBadLengths(t *testing.T) {
+	listener, err := torrentlib.Listen(0)
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	defer listener.Close()
+	addr := net.JoinHostPort("127.0.0.1", strconv.Itoa(listener.Port()))
+
+	swarm := newSwarm(t, 2*testPieceLength, 1)
+	swarm.stall = true
+	torrent := swarm.torrent(swarm.infoDict("pex.bin"))
+	output := filepath.Join(t.TempDir(), "pex.bin")
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	downloadErr := make(chan error, 1)
+	go func() {
+		downloadErr <- torrent.Download(ctx, output, torrentlib.DownloadOptions{MaxConnections: 3, Listener: listener})
+	}()
+
+	swarm.waitInterested(ctx)
+
+	// the lengths come from the peer, it is dropped and the download goes on
+	for _, payload := range []string{
+		"d5:added-1:ae",
+		"d5:added99999999999999:ae",
+	} {
+		conn, err := dialHandshakeFrom(nil, peerlib.LocalCapabilities, addr, torrent.InfoHash)
+		if err != nil {
+			t.Fatalf("Failed to connect to the download: %v", err)
+		}
+		defer conn.Close()
+
+		id, handshakePayload, err := readExtended(conn)
+		if err != nil || id != 0 {
+			t.Fatalf("Expected extension handshake but got %d, %v", id, err)
+		}
+		var handshake peerlib.ExtensionHandshake
+		if err := bencode.Unmarshal(handshakePayload, &handshake); err != nil {
+			t.Fatalf("Failed to decode extension handshake: %v", err)
+		}
+		reply, _ := bencode.Encode(peerlib.ExtensionHandshake{M: map[string]int{"ut_pex": 1}})
+		writeMessage(conn, 20, append([]byte{0}, reply...))
+		writeMessage(conn, 20, append([]byte{byte(handshake.M["ut_pex"])}, payload...))
+
+		conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+		for err == nil {
+			_, _, err = readExtended(conn)
+		}
+		if errors.Is(err, os.ErrDeadlineExceeded) {
+			t.Errorf("Expected the connection to be closed after pex %q", payload)
+		}
+	}
+
+	select {
+	case err := <-downloadErr:
+		t.Fatalf("Expected the download to go on but it returned %v", err)
+	default:
+	}
+	cancel()
+	<-downloadErr
+}
+
+func TestPrivateTorrentNoPex(t *testing.T) {
+	listener, err := torrentlib.Listen(0)
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	defer listener.Close()
+	addr := net.JoinHostPort("127.0.0.1", strconv.Itoa(listener.Port()))
+
+	swarm := newSwarm(t, 2*testPieceLength, 1)
+	swarm.stall = true
+	info := swarm.infoDict("private.bin")
+	info["private"] = 1
+	torrent := swarm.torrent(info)
+	output := filepath.Join(t.TempDir(), "private.bin")
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	downloadErr := make(chan error, 1)
+	go func() {
+		downloadErr <- torrent.Download(ctx, output, torrentlib.DownloadOptions{MaxConnections: 3, Listener: listener})
+	}()
+
+	swarm.waitInterested(ctx)
+
+	conn, err := dialHandshakeFrom(nil, peerlib.LocalCapabilities, addr, torrent.InfoHash)
+	if err != nil {
+		t.Fatalf("Failed to connect to the download: %v", err)
+	}
+	defer conn.Close()
+
+	id, payload, err := readExtended(conn)
+	if err != nil || id != 0 {
+		t.Fatalf("Expected extension handshake but got %d, %v", id, err)
+	}
+	var handshake peerlib.ExtensionHandshake
+	if err := bencode.Unmarshal(payload, &handshake); err != nil {
+		t.Fatalf("Failed to decode extension handshake: %v", err)
+	}
+	if _, ok := handshake.M["ut_pex"]; ok {
+		t.Errorf("Expected no ut_pex in the extension handshake of a private torrent but got %v", handshake.M)
+	}
+
+	cancel()
+	<-downloadErr
+}
@@ -0,0 +1,173 @@
+package torrentlib_test
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/codecrafters-io/bittorrent-starter-go/internal/torrentlib"
+)
+
+func newStorage(t *testing.T, root string, files []torrentlib.File) *torrentlib.Storage {
+	storage, err := torrentlib.NewStorage(root, files)
+	if err != nil {
+		t.Fatalf("Failed to create storage: %v", err)
+	}
+	t.Cleanup(func() { storage.Close() })
+	return storage
+}
+
+func TestNewStorageMultiFile(t *testing.T) {
+	root := t.TempDir()
+	files := []torrentlib.File{
+		{Path: filepath.Join("root", "a.txt"), Length: 10, Offset: 0},
+		{Path: filepath.Join("root", "dir", "nested", "b.txt"), Length: 20, Offset: 10},
+		{Path: filepath.Join("root", "empty.txt"), Length: 0, Offset: 30},
+	}
+	newStorage(t, root, files)
+
+	for _, file := range files {
+		info, err := os.Stat(filepath.Join(root, file.Path))
+		if err != nil {
+			t.Fatalf("Expected file %s to be created: %v", file.Path, err)
+		}
+		if info.Size() != int64(file.Length) {
+			t.Errorf("Expected %s to have size %d but got %d", file.Path, file.Length, info.Size())
+		}
+	}
+	if info, err := os.Stat(filepath.Join(root, "root", "dir", "nested")); err != nil || !info.IsDir() {
+		t.Errorf("Expected directory root/dir/nested to be created: %v", err)
+	}
+}
+
+func TestNewStorageReopens(t *testing.T) {
+	root := t.TempDir()
+	files := []torrentlib.File{{Path: "a.txt", Length: 8, Offset: 0}}
+
+	// opening again keeps what was already written
+	storage := newStorage(t, root, files)
+	if _, err := storage.WriteAt([]byte("data"), 2); err != nil {
+		t.Fatalf("Failed to write: %v", err)
+	}
+	storage.Close()
+
+	storage = newStorage(t, root, files)
+	data := make([]byte, 4)
+	if _, err := storage.ReadAt(data, 2); err != nil {
+		t.Fatalf("Failed to read: %v", err)
+	}
+	if string(data) != "data" {
+		t.Errorf("Expected %q but got %q", "data", data)
+	}
+}
+
+func TestNewStorageRejectsBadPaths(t *testing.T) {
+	root := t.TempDir()
+	paths := []string{
+		filepath.Join("..", "evil.txt"),
+		filepath.Join("root", "..", "..", "evil.txt"),
+		filepath.Join(root, "absolute.txt"),
+		"",
+	}
+
+	for _, path := range paths {
+		files := []torrentlib.File{
+			{Path: "ok.txt", Length: 1, Offset: 0},
+			{Path: path, Length: 1, Offset: 1},
+		}
+		if storage, err := torrentlib.NewStorage(root, files); err == nil {
+			storage.Close()
+			t.Errorf("Expected error for path %q, got nil", path)
+		}
+	}
+
+	if _, err := os.Stat(filepath.Join(filepath.Dir(root), "evil.txt")); err == nil {
+		t.Errorf("Expected no file outside of the root")
+	}
+}
+
+func TestNewStorageRejectsNegativeLength(t *testing.T) {
+	files := []torrentlib.File{{Path: "a.txt", Length: -1, Offset: 0}}
+	if _, err := torrentlib.NewStorage(t.TempDir(), files); err == nil {
+		t.Errorf("Expected error for negative length, got nil")
+	}
+}
+
+func TestStorageOutOfBounds(t *testing.T) {
+	storage := newStorage(t, t.TempDir(), []torrentlib.File{{Path: "a.txt", Length: 4, Offset: 0}})
+
+	if _, err := storage.WriteAt([]byte("abc"), 2); err == nil {
+		t.Errorf("Expected error writing past the end, got nil")
+	}
+	if _, err := storage.ReadAt(make([]byte, 1), -1); err == nil {
+		t.Errorf("Expected error reading before the start, got nil")
+	}
+}
+
+func TestStorageSpansFiles(t *testing.T) {
+	root := t.TempDir()
+	files := []torrentlib.File{
+		{Path: "a.txt", Length: 4, Offset: 0},
+		{Path: "b.txt", Length: 3, Offset: 4},
+		{Path: "c.txt", Length: 5, Offset: 7},
+	}
+	storage := newStorage(t, root, files)
+
+	// a piece from the end of a.txt to the start of c.txt, over all of b.txt
+	piece := []byte("23abcXY")
+	n, err := storage.WriteAt(piece, 2)
+	if err != nil || n != len(piece) {
+		t.Fatalf("Failed to write across files, wrote %d: %v", n, err)
+	}
+
+	read := make([]byte, len(piece))
+	if n, err := storage.ReadAt(read, 2); err != nil || n != len(read) {
+		t.Fatalf("Failed to read across files, read %d: %v", n, err)
+	}
+	if string(read) != string(piece) {
+		t.Errorf("Expected %q but got %q", piece, read)
+	}
+
+	// each file holds its part, the rest is still zeros
+	expected := map[string]string{
+		"a.txt": "\x00\x0023",
+		"b.txt": "abc",
+		"c.txt": "XY\x00\x00\x00",
+	}
+	for path, content := range expected {
+		data, err := os.ReadFile(filepath.Join(root, path))
+		if err != nil {
+			t.Fatalf("Failed to read %s: %v", path, err)
+		}
+		if string(data) != content {
+			t.Errorf("Expected %s to hold %q but got %q", path, content, data)
+		}
+	}
+}
+
+func TestStorageSparse(t *testing.T) {
+	root := t.TempDir()
+	const length = 64 << 20
+	storage := newStorage(t, root, []torrentlib.File{{Path: "big.bin", Length: length, Offset: 0}})
+
+	// the file is preallocated to its full size, only the last bytes are
+	// written and the rest reads as zeros
+	if _, err := storage.WriteAt([]byte("end"), length-3); err != nil {
+		t.Fatalf("Failed to write: %v", err)
+	}
+	data := make([]byte, 4)
+	if _, err := storage.ReadAt(data, length-4); err != nil {
+		t.Fatalf("Failed to read: %v", err)
+	}
+	if string(data) != "\x00end" {
+		t.Errorf("Expected %q but got %q", "\x00end", data)
+	}
+
+	info, err := os.Stat(filepath.Join(root, "big.bin"))
+	if err != nil {
+		t.Fatalf("Failed to stat: %v", err)
+	}
+	if info.Size() != length {
+		t.Errorf("Expected size %d but got %d", length, info.Size())
+	}
+}
@@ -0,0 +1,134 @@
+package torrentlib_test
+
+import (
+	"encoding/hex"
+	"path/filepath"
+	"testing"
+
+	"github.com/codecrafters-io/bittorrent-starter-go/internal/encoding/bencode"
+	"github.com/codecrafters-io/bittorrent-starter-go/internal/torrentlib"
+)
+
+// none of these tests need a tracker, parsing never touches the network
+
+func TestOpenSingleFile(t *testing.T) {
+	torrent, err := torrentlib.Open("../../sample.torrent")
+	if err != nil {
+		t.Fatalf("Failed to open sample torrent: %v", err)
+	}
+
+	expectedHash := "d69f91e6b2ae4c542468d1073a71d4ea13879a7f"
+	if hex.EncodeToString(torrent.InfoHash) != expectedHash {
+		t.Errorf("Expected info hash %s but got %x", expectedHash, torrent.InfoHash)
+	}
+	if torrent.Length != 92063 {
+		t.Errorf("Expected length %d but got %d", 92063, torrent.Length)
+	}
+	if torrent.PieceLength != 32768 || torrent.TotalPieces != 3 {
+		t.Errorf("Expected 3 pieces of 32768 but got %d of %d", torrent.TotalPieces, torrent.PieceLength)
+	}
+	if torrent.MultiFile || len(torrent.Files) != 1 || torrent.Files[0].Path != "sample.txt" {
+		t.Errorf("Expected a single file sample.txt but got %+v", torrent.Files)
+	}
+	if len(torrent.Peers) != 0 {
+		t.Errorf("Expected no peers before announcing but got %v", torrent.Peers)
+	}
+	if torrent.Private {
+		t.Errorf("Expected a public torrent")
+	}
+}
+
+func multiFileTorrent(t *testing.T, paths ...[]any) []byte {
+	files := make([]any, len(paths))
+	for i, path := range paths {
+		files[i] = map[string]any{
+			"length": 10 * (i + 1),
+			"path":   path,
+		}
+	}
+	data, err := bencode.Encode(map[string]any{
+		"announce": "http://tracker.example/announce",
+		"info": map[string]any{
+			"files":        files,
+			"name":         "root",
+			"piece length": 16,
+			"pieces":       string(make([]byte, 20*4)),
+			"private":      1,
+		},
+	})
+	if err != nil {
+		t.Fatalf("Failed to encode torrent: %v", err)
+	}
+	return data
+}
+
+func TestParseMultiFile(t *testing.T) {
+	data := multiFileTorrent(t, []any{"a.txt"}, []any{"dir", "b.txt"}, []any{"c.txt"})
+
+	torrent, err := torrentlib.Parse(data)
+	if err != nil {
+		t.Fatalf("Failed to parse torrent: %v", err)
+	}
+
+	if !torrent.MultiFile {
+		t.Errorf("Expected a multi-file torrent")
+	}
+	if torrent.Length != 60 {
+		t.Errorf("Expected total length %d but got %d", 60, torrent.Length)
+	}
+	if !torrent.Private {
+		t.Errorf("Expected a private torrent")
+	}
+
+	expected := []torrentlib.File{
+		{Path: filepath.Join("root", "a.txt"), Length: 10, Offset: 0},
+		{Path: filepath.Join("root", "dir", "b.txt"), Length: 20, Offset: 10},
+		{Path: filepath.Join("root", "c.txt"), Length: 30, Offset: 30},
+	}
+	if len(torrent.Files) != len(expected) {
+		t.Fatalf("Expected %d files but got %d", len(expected), len(torrent.Files))
+	}
+	for i, file := range expected {
+		if torrent.Files[i] != file {
+			t.Errorf("Expected file %+v but got %+v", file, torrent.Files[i])
+		}
+	}
+}
+
+func TestParseRejectsPathTraversal(t *testing.T) {
+	data := multiFileTorrent(t, []any{"..", "evil.txt"})
+
+	if _, err := torrentlib.Parse(data); err == nil {
+		t.Errorf("Expected error for path traversal, got nil")
+	}
+}
+
+func TestParseInvalidPieces(t *testing.T) {
+	for _, test := range []struct {
+		name        string
+		pieceLength int
+		pieces      int
+	}{
+		{"zero piece length", 0, 20},
+		{"negative piece length", -16, 20},
+		{"partial hash", 16, 4*20 + 7},
+		{"missing hashes", 16, 3 * 20},
+		{"extra hashes", 16, 5 * 20},
+	} {
+		data, err := bencode.Encode(map[string]any{
+			"announce": "http://tracker.example/announce",
+			"info": map[string]any{
+				"length":       60,
+				"name":         "file.bin",
+				"piece length": test.pieceLength,
+				"pieces":       string(make([]byte, test.pieces)),
+			},
+		})
+		if err != nil {
+			t.Fatalf("Failed to encode torrent: %v", err)
+		}
+		if _, err := torrentlib.Parse(data); err == nil {
+			t.Errorf("Expected error for %s", test.name)
+		}
+	}
+}
@@ -0,0 +1,35 @@
+package trackerlib_test
+
+import (
+	"testing"
+
+	"github.com/codecrafters-io/bittorrent-starter-go/internal/torrentlib/trackerlib"
+)
+
+func TestFormatCompactPeer(t *testing.T) {
+	compact, err := trackerlib.FormatCompactPeer("10.0.0.1:6881")
+	if err != nil {
+		t.Fatalf("Failed to format peer: %v", err)
+	}
+	if string(compact) != "\x0a\x00\x00\x01\x1a\xe1" {
+		t.Errorf("Unexpected compact peer %x", compact)
+	}
+
+	compact6, err := trackerlib.FormatCompactPeer("[2001:db8::1]:6881")
+	if err != nil {
+		t.Fatalf("Failed to format peer: %v", err)
+	}
+	peers, err := trackerlib.ParseCompactPeers6(compact6)
+	if err != nil {
+		t.Fatalf("Failed to parse compact peer: %v", err)
+	}
+	if len(peers) != 1 || peers[0] != "[2001:db8::1]:6881" {
+		t.Errorf("Expected [2001:db8::1]:6881 but got %v", peers)
+	}
+
+	for _, addr := range []string{"10.0.0.1", "example.com:6881", "10.0.0.1:0", "10.0.0.1:70000"} {
+		if _, err := trackerlib.FormatCompactPeer(addr); err == nil {
+			t.Errorf("Expected error formatting %q", addr)
+		}
+	}
+}
@@ -0,0 +1,151 @@
+package trackerlib_test
+
+import (
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+
+	"github.com/codecrafters-io/bittorrent-starter-go/internal/encoding/bencode"
+	"github.com/codecrafters-io/bittorrent-starter-go/internal/torrentlib/trackerlib"
+)
+
+func newRespondingTracker(t *testing.T, response map[string]any, queries *[]string) *httptest.Server {
+	var mu sync.Mutex
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		*queries = append(*queries, r.URL.RawQuery)
+		mu.Unlock()
+
+		body, err := bencode.Encode(response)
+		if err != nil {
+			t.Errorf("Failed to encode tracker response: %v", err)
+		}
+		w.Write(body)
+	}))
+	t.Cleanup(server.Close)
+	return server
+}
+
+func TestHTTPFailureReason(t *testing.T) {
+	var queries []string
+	server := newRespondingTracker(t, map[string]any{"failure reason": "torrent not registered"}, &queries)
+
+	tracker, err := trackerlib.New(server.URL)
+	if err != nil {
+		t.Fatalf("Failed to create tracker: %v", err)
+	}
+
+	_, err = tracker.Announce(&trackerlib.AnnounceRequest{Port: 6881})
+	var failure *trackerlib.FailureError
+	if !errors.As(err, &failure) {
+		t.Fatalf("Expected a FailureError but got %v", err)
+	}
+	if failure.Reason != "torrent not registered" {
+		t.Errorf("Expected reason %q but got %q", "torrent not registered", failure.Reason)
+	}
+}
+
+func TestHTTPDictionaryPeersAndTrackerID(t *testing.T) {
+	var queries []string
+	server := newRespondingTracker(t, map[string]any{
+		"interval":        60,
+		"tracker id":      "abc 123",
+		"warning message": "be nice",
+		"complete":        4,
+		"incomplete":      2,
+		"peers": []any{
+			map[string]any{"ip": "10.0.0.1", "port": 6881, "peer id": "-XX0001-000000000000"},
+			map[string]any{"ip": "10.0.0.2", "port": 51413, "peer id": "-XX0001-000000000001"},
+		},
+	}, &queries)
+
+	tracker, err := trackerlib.New(server.URL)
+	if err != nil {
+		t.Fatalf("Failed to create tracker: %v", err)
+	}
+
+	res, err := tracker.Announce(&trackerlib.AnnounceRequest{Port: 6881})
+	if err != nil {
+		t.Fatalf("Failed to announce: %v", err)
+	}
+
+	expected := []string{"10.0.0.1:6881", "10.0.0.2:51413"}
+	if len(res.Peers) != len(expected) || res.Peers[0] != expected[0] || res.Peers[1] != expected[1] {
+		t.Errorf("Expected peers %v but got %v", expected, res.Peers)
+	}
+	if res.Seeders != 4 || res.Leechers != 2 {
+		t.Errorf("Expected 4 seeders and 2 leechers but got %+v", res)
+	}
+
+	// tracker id must be sent back on the next announce
+	if _, err := tracker.Announce(&trackerlib.AnnounceRequest{Port: 6881}); err != nil {
+		t.Fatalf("Failed to announce again: %v", err)
+	}
+	if len(queries) != 2 {
+		t.Fatalf("Expected 2 announces but got %d", len(queries))
+	}
+	request, _ := http.NewRequest("GET", "/?"+queries[1], nil)
+	if trackerID := request.URL.Query().Get("trackerid"); trackerID != "abc 123" {
+		t.Errorf("Expected trackerid %q but got %q", "abc 123", trackerID)
+	}
+}
+
+func TestHTTPAnnounceWithQuery(t *testing.T) {
+	var queries []string
+	server := newRespondingTracker(t, map[string]any{"interval": 60}, &queries)
+
+	// private trackers put the passkey in the announce URL
+	tracker, err := trackerlib.New(server.URL + "/announce?passkey=secret")
+	if err != nil {
+		t.Fatalf("Failed to create tracker: %v", err)
+	}
+
+	if _, err := tracker.Announce(&trackerlib.AnnounceRequest{Port: 6881}); err != nil {
+		t.Fatalf("Failed to announce: %v", err)
+	}
+	if len(queries) != 1 {
+		t.Fatalf("Expected 1 announce but got %d", len(queries))
+	}
+	request, _ := http.NewRequest("GET", "/?"+queries[0], nil)
+	query := request.URL.Query()
+	if passkey := query.Get("passkey"); passkey != "secret" {
+		t.Errorf("Expected passkey %q but got %q", "secret", passkey)
+	}
+	if port := query.Get("port"); port != "6881" {
+		t.Errorf("Expected port %q but got %q", "6881", port)
+	}
+}
+
+func TestHTTPPeers6(t *testing.T) {
+	var queries []string
+	compact := []byte{10, 0, 0, 1, 0x1A, 0xE1}
+	compact6 := []byte{0x20, 0x01, 0x0d, 0xb8, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 1, 0x1A, 0xE1}
+	server := newRespondingTracker(t, map[string]any{
+		"interval": 60,
+		"peers":    string(compact),
+		"peers6":   string(compact6),
+	}, &queries)
+
+	tracker, err := trackerlib.New(server.URL)
+	if err != nil {
+		t.Fatalf("Failed to create tracker: %v", err)
+	}
+
+	res, err := tracker.Announce(&trackerlib.AnnounceRequest{Port: 6881, IPv6: net.ParseIP("2001:db8::2")})
+	if err != nil {
+		t.Fatalf("Failed to announce: %v", err)
+	}
+
+	expected := []string{"10.0.0.1:6881", "[2001:db8::1]:6881"}
+	if len(res.Peers) != len(expected) || res.Peers[0] != expected[0] || res.Peers[1] != expected[1] {
+		t.Errorf("Expected peers %v but got %v", expected, res.Peers)
+	}
+
+	request, _ := http.NewRequest("GET", "/?"+queries[0], nil)
+	if ipv6 := request.URL.Query().Get("ipv6"); ipv6 != "2001:db8::2" {
+		t.Errorf("Expected ipv6 %q but got %q", "2001:db8::2", ipv6)
+	}
+}
@@ -0,0 +1,83 @@
+package trackerlib_test
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/codecrafters-io/bittorrent-starter-go/internal/encoding/bencode"
+	"github.com/codecrafters-io/bittorrent-starter-go/internal/torrentlib/trackerlib"
+)
+
+func TestScrapeURL(t *testing.T) {
+	cases := map[string]string{
+		"http://example.com/announce":         "http://example.com/scrape",
+		"http://example.com/x/announce":       "http://example.com/x/scrape",
+		"http://example.com/announce.php":     "http://example.com/scrape.php",
+		"http://example.com/a?x2%0644":        "",
+		"http://example.com/announce?x2%0644": "http://example.com/scrape?x2%0644",
+		"http://example.com/x%064announce":    "",
+		"http://example.com/announce/x":       "",
+		"http://example.com/a/announce?key=1": "http://example.com/a/scrape?key=1",
+	}
+
+	for announce, expected := range cases {
+		scrape, err := trackerlib.ScrapeURL(announce)
+		if expected == "" {
+			if err == nil {
+				t.Errorf("Expected %s to not support scrape, got %s", announce, scrape)
+			}
+			continue
+		}
+		if err != nil || scrape != expected {
+			t.Errorf("Expected scrape url %s for %s but got %s (%v)", expected, announce, scrape, err)
+		}
+	}
+}
+
+func TestHTTPScrapeMultipleHashes(t *testing.T) {
+	first := [20]byte{1}
+	second := [20]byte{2}
+	unknown := [20]byte{3}
+
+	var requested []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/scrape" {
+			http.NotFound(w, r)
+			return
+		}
+		requested = r.URL.Query()["info_hash"]
+
+		body, _ := bencode.Encode(map[string]any{
+			"files": map[string]any{
+				string(first[:]):  map[string]any{"complete": 5, "downloaded": 50, "incomplete": 10},
+				string(second[:]): map[string]any{"complete": 1, "downloaded": 2, "incomplete": 3},
+			},
+		})
+		w.Write(body)
+	}))
+	defer server.Close()
+
+	tracker, err := trackerlib.New(server.URL + "/announce")
+	if err != nil {
+		t.Fatalf("Failed to create tracker: %v", err)
+	}
+
+	stats, err := tracker.Scrape([][20]byte{first, second, unknown})
+	if err != nil {
+		t.Fatalf("Failed to scrape: %v", err)
+	}
+
+	if len(requested) != 3 {
+		t.Errorf("Expected 3 info hashes in a single request but got %d", len(requested))
+	}
+	if stats[first] != (trackerlib.ScrapeStats{Seeders: 5, Completed: 50, Leechers: 10}) {
+		t.Errorf("Unexpected stats for first torrent %+v", stats[first])
+	}
+	if stats[second] != (trackerlib.ScrapeStats{Seeders: 1, Completed: 2, Leechers: 3}) {
+		t.Errorf("Unexpected stats for second torrent %+v", stats[second])
+	}
+	if _, ok := stats[unknown]; ok {
+		t.Errorf("Expected no stats for unknown torrent")
+	}
+}
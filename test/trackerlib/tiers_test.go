@@ -0,0 +1,149 @@
+package trackerlib_test
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/codecrafters-io/bittorrent-starter-go/internal/encoding/bencode"
+	"github.com/codecrafters-io/bittorrent-starter-go/internal/torrentlib/trackerlib"
+)
+
+// newHTTPTrackerStub returns a tracker that answers every announce with the
+// given compact peers
+func newHTTPTrackerStub(t *testing.T, interval int, compactPeers string) *httptest.Server {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, err := bencode.Encode(map[string]any{
+			"interval": interval,
+			"peers":    compactPeers,
+		})
+		if err != nil {
+			t.Errorf("Failed to encode tracker response: %v", err)
+		}
+		w.Write(body)
+	}))
+	t.Cleanup(server.Close)
+	return server
+}
+
+// newDeadTrackerURL returns the URL of a tracker that refuses connections
+func newDeadTrackerURL() string {
+	server := httptest.NewServer(http.NotFoundHandler())
+	url := server.URL
+	server.Close()
+	return url
+}
+
+// newSilentUDPTrackerURL returns the URL of a UDP tracker that reads every
+// packet and never answers
+func newSilentUDPTrackerURL(t *testing.T) string {
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	go func() {
+		buf := make([]byte, 2048)
+		for {
+			if _, _, err := conn.ReadFromUDP(buf); err != nil {
+				return
+			}
+		}
+	}()
+	return "udp://" + conn.LocalAddr().String() + "/announce"
+}
+
+func TestTiersAnnounceMergesAndPromotes(t *testing.T) {
+	dead := newDeadTrackerURL()
+	first := newHTTPTrackerStub(t, 1800, string([]byte{10, 0, 0, 1, 0x1A, 0xE1}))
+	second := newHTTPTrackerStub(t, 900, string([]byte{10, 0, 0, 1, 0x1A, 0xE1, 10, 0, 0, 2, 0x1A, 0xE1}))
+
+	tiers := trackerlib.NewTiers([][]string{
+		{dead, first.URL},
+		{second.URL},
+	})
+
+	res, err := tiers.Announce(&trackerlib.AnnounceRequest{Port: 6881})
+	if err != nil {
+		t.Fatalf("Failed to announce: %v", err)
+	}
+
+	peers := append([]string(nil), res.Peers...)
+	sort.Strings(peers)
+	expected := []string{"10.0.0.1:6881", "10.0.0.2:6881"}
+	if len(peers) != len(expected) || peers[0] != expected[0] || peers[1] != expected[1] {
+		t.Errorf("Expected merged peers %v but got %v", expected, peers)
+	}
+	if res.Interval != 900 {
+		t.Errorf("Expected shortest interval %d but got %d", 900, res.Interval)
+	}
+
+	// the tracker that responded goes to the front of its tier
+	urls := tiers.URLs()
+	if urls[0][0] != first.URL {
+		t.Errorf("Expected %s at the front of the first tier but got %v", first.URL, urls[0])
+	}
+}
+
+func TestTiersAnnounceAllDead(t *testing.T) {
+	tiers := trackerlib.NewTiers([][]string{{newDeadTrackerURL()}, {newDeadTrackerURL()}})
+
+	if _, err := tiers.Announce(&trackerlib.AnnounceRequest{Port: 6881}); err == nil {
+		t.Errorf("Expected error when every tracker is dead, got nil")
+	}
+}
+
+func TestTiersAnnounceSilentUDPFallback(t *testing.T) {
+	silent := newSilentUDPTrackerURL(t)
+	good := newHTTPTrackerStub(t, 1800, string([]byte{10, 0, 0, 1, 0x1A, 0xE1}))
+	other := newHTTPTrackerStub(t, 1800, string([]byte{10, 0, 0, 2, 0x1A, 0xE1}))
+
+	// the silent tracker shares a tier with a good one, and has a tier of
+	// its own
+	tiers := trackerlib.NewTiers([][]string{{silent, good.URL}, {silent}, {other.URL}})
+	tiers.Timeout = 200 * time.Millisecond
+
+	// the lock is not held while waiting for the trackers
+	urls := make(chan [][]string)
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		urls <- tiers.URLs()
+	}()
+
+	start := time.Now()
+	done := make(chan struct{})
+	var res *trackerlib.AnnounceResponse
+	var err error
+	go func() {
+		defer close(done)
+		res, err = tiers.Announce(&trackerlib.AnnounceRequest{Port: 6881})
+	}()
+
+	select {
+	case <-urls:
+	case <-done:
+		t.Fatalf("Expected the announce to be waiting for the silent tracker")
+	case <-time.After(time.Second):
+		t.Fatalf("Expected URLs not to wait for the announce")
+	}
+	<-done
+
+	if err != nil {
+		t.Fatalf("Failed to announce: %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Errorf("Expected to fall back quickly but took %v", elapsed)
+	}
+	peers := res.Peers
+	sort.Strings(peers)
+	expected := []string{"10.0.0.1:6881", "10.0.0.2:6881"}
+	if len(peers) != len(expected) || peers[0] != expected[0] || peers[1] != expected[1] {
+		t.Errorf("Expected peers %v but got %v", expected, peers)
+	}
+	if front := tiers.URLs()[0][0]; front != good.URL {
+		t.Errorf("Expected %s at the front of the first tier but got %s", good.URL, front)
+	}
+}
@@ -0,0 +1,169 @@
+package trackerlib_test
+
+import (
+	"encoding/binary"
+	"net"
+	"sync/atomic"
+	"testing"
+
+	"github.com/codecrafters-io/bittorrent-starter-go/internal/torrentlib/trackerlib"
+)
+
+const testConnectionID = 0xC0FFEE
+
+// udpTrackerStub is a local stand-in for a BEP 15 tracker
+type udpTrackerStub struct {
+	conn     *net.UDPConn
+	connects atomic.Int32
+	// lastAnnounce is the last announce request received
+	lastAnnounce atomic.Pointer[[]byte]
+}
+
+func newUDPTrackerStub(t *testing.T) *udpTrackerStub {
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	stub := &udpTrackerStub{conn: conn}
+	t.Cleanup(func() { conn.Close() })
+	go stub.serve()
+	return stub
+}
+
+func (s *udpTrackerStub) URL() string {
+	return "udp://" + s.conn.LocalAddr().String() + "/announce"
+}
+
+func (s *udpTrackerStub) serve() {
+	buf := make([]byte, 2048)
+	for {
+		n, addr, err := s.conn.ReadFromUDP(buf)
+		if err != nil {
+			return
+		}
+		req := append([]byte(nil), buf[:n]...)
+		action := binary.BigEndian.Uint32(req[8:12])
+		transactionID := req[12:16]
+
+		var res []byte
+		switch {
+		case action == 0 && binary.BigEndian.Uint64(req[0:8]) == 0x41727101980:
+			s.connects.Add(1)
+			res = make([]byte, 16)
+			binary.BigEndian.PutUint64(res[8:16], testConnectionID)
+
+		case binary.BigEndian.Uint64(req[0:8]) != testConnectionID:
+			res = append(make([]byte, 8), []byte("bad connection id")...)
+			action = 3
+
+		case action == 1:
+			s.lastAnnounce.Store(&req)
+			res = make([]byte, 20, 32)
+			binary.BigEndian.PutUint32(res[8:12], 1800)
+			binary.BigEndian.PutUint32(res[12:16], 3)
+			binary.BigEndian.PutUint32(res[16:20], 7)
+			res = append(res, 10, 0, 0, 1, 0x1A, 0xE1)
+			res = append(res, 192, 168, 1, 2, 0x1A, 0xE2)
+
+		case action == 2:
+			hashes := (len(req) - 16) / 20
+			res = make([]byte, 8+12*hashes)
+			for i := 0; i < hashes; i++ {
+				binary.BigEndian.PutUint32(res[8+12*i:], uint32(i+1))
+				binary.BigEndian.PutUint32(res[12+12*i:], uint32(10*(i+1)))
+				binary.BigEndian.PutUint32(res[16+12*i:], uint32(100*(i+1)))
+			}
+		}
+
+		binary.BigEndian.PutUint32(res[0:4], action)
+		copy(res[4:8], transactionID)
+		s.conn.WriteToUDP(res, addr)
+	}
+}
+
+func TestUDPAnnounce(t *testing.T) {
+	stub := newUDPTrackerStub(t)
+
+	tracker, err := trackerlib.New(stub.URL())
+	if err != nil {
+		t.Fatalf("Failed to create tracker: %v", err)
+	}
+
+	req := &trackerlib.AnnounceRequest{
+		InfoHash: [20]byte{1, 2, 3},
+		PeerID:   [20]byte{4, 5, 6},
+		Port:     6881,
+		Left:     1234,
+	}
+	res, err := tracker.Announce(req)
+	if err != nil {
+		t.Fatalf("Failed to announce: %v", err)
+	}
+
+	if res.Interval != 1800 || res.Leechers != 3 || res.Seeders != 7 {
+		t.Errorf("Unexpected announce response %+v", res)
+	}
+	expectedPeers := []string{"10.0.0.1:6881", "192.168.1.2:6882"}
+	if len(res.Peers) != len(expectedPeers) {
+		t.Fatalf("Expected peers %v but got %v", expectedPeers, res.Peers)
+	}
+	for i, peer := range expectedPeers {
+		if res.Peers[i] != peer {
+			t.Errorf("Expected peer %s but got %s", peer, res.Peers[i])
+		}
+	}
+
+	sent := *stub.lastAnnounce.Load()
+	if len(sent) != 98 {
+		t.Fatalf("Expected announce request of 98 bytes but got %d", len(sent))
+	}
+	if sent[16] != 1 || sent[36] != 4 {
+		t.Errorf("Announce request has wrong info hash or peer id")
+	}
+	if left := binary.BigEndian.Uint64(sent[64:72]); left != 1234 {
+		t.Errorf("Expected left %d but got %d", 1234, left)
+	}
+	if port := binary.BigEndian.Uint16(sent[96:98]); port != 6881 {
+		t.Errorf("Expected port %d but got %d", 6881, port)
+	}
+
+	// connection ID must be reused for the next request
+	if _, err := tracker.Announce(req); err != nil {
+		t.Fatalf("Failed to announce again: %v", err)
+	}
+	if connects := stub.connects.Load(); connects != 1 {
+		t.Errorf("Expected a single connect request but got %d", connects)
+	}
+}
+
+func TestUDPScrape(t *testing.T) {
+	stub := newUDPTrackerStub(t)
+
+	tracker, err := trackerlib.New(stub.URL())
+	if err != nil {
+		t.Fatalf("Failed to create tracker: %v", err)
+	}
+	scraper, ok := tracker.(trackerlib.Scraper)
+	if !ok {
+		t.Fatalf("Expected udp tracker to support scrape")
+	}
+
+	hashes := [][20]byte{{1}, {2}}
+	stats, err := scraper.Scrape(hashes)
+	if err != nil {
+		t.Fatalf("Failed to scrape: %v", err)
+	}
+
+	for i, hash := range hashes {
+		expected := trackerlib.ScrapeStats{Seeders: i + 1, Completed: 10 * (i + 1), Leechers: 100 * (i + 1)}
+		if stats[hash] != expected {
+			t.Errorf("Expected stats %+v for hash %x but got %+v", expected, hash, stats[hash])
+		}
+	}
+}
+
+func TestNewUnsupportedScheme(t *testing.T) {
+	if _, err := trackerlib.New("wss://tracker.example/announce"); err == nil {
+		t.Errorf("Expected error for unsupported scheme, got nil")
+	}
+}